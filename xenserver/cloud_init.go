@@ -0,0 +1,291 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	cloudInitSchemaSRUUID        = "sr_uuid"
+	cloudInitSchemaUserData      = "user_data"
+	cloudInitSchemaMetaData      = "meta_data"
+	cloudInitSchemaNetworkConfig = "network_config"
+
+	// Key in VBD's other_config marking the NoCloud config drive
+	vbdOtherConfigConfigDrive = "config_drive"
+
+	// Volume label cloud-init looks for when searching for NoCloud data
+	configDriveVolumeLabel = "cidata"
+
+	isoSectorSize = 2048
+)
+
+// Returns the schema for the cloud_init block of the VM resource
+func resourceCloudInit() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			cloudInitSchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			cloudInitSchemaUserData: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			cloudInitSchemaMetaData: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+			cloudInitSchemaNetworkConfig: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+		},
+	}
+}
+
+// Renders the NoCloud files, uploads them as ISO image to a new VDI and attaches it to the VM as CD
+func createConfigDrive(c *Connection, vm *VMDescriptor, s map[string]interface{}) error {
+	metaData := s[cloudInitSchemaMetaData].(string)
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", vm.UUID, vm.Name)
+	}
+
+	files := map[string][]byte{
+		"user-data": []byte(s[cloudInitSchemaUserData].(string)),
+		"meta-data": []byte(metaData),
+	}
+
+	if networkConfig := s[cloudInitSchemaNetworkConfig].(string); networkConfig != "" {
+		files["network-config"] = []byte(networkConfig)
+	}
+
+	return createISODrive(c, vm, s[cloudInitSchemaSRUUID].(string), configDriveVolumeLabel, files)
+}
+
+// Uploads the files as ISO image to a new VDI on the SR and attaches it to the VM as CD.
+// The drive is marked as config drive, so that it is hidden from the schema and destroyed with the VM.
+func createISODrive(c *Connection, vm *VMDescriptor, srUUID string, label string, files map[string][]byte) error {
+	iso := buildISO(label, files)
+
+	sr := &SRDescriptor{
+		UUID: srUUID,
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	// Round up to the whole megabyte, some SRs refuse odd sizes
+	size := (len(iso) + (1 << 20) - 1) &^ ((1 << 20) - 1)
+
+	vdiRef, err := c.client.VDI.Create(c.session, xenAPI.VDIRecord{
+		NameLabel:       fmt.Sprintf("%s config drive", vm.Name),
+		NameDescription: fmt.Sprintf("Created by terraform with volume label %s", label),
+		VirtualSize:     size,
+		SR:              sr.SRRef,
+		Type:            xenAPI.VdiTypeUser,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Created config drive VDI %s on SR %s", vdiRef, sr.UUID)
+
+	if err = importRawVDI(c, vdiRef, vdiFormatRaw, bytes.NewReader(iso), int64(len(iso))); err != nil {
+		c.client.VDI.Destroy(c.session, vdiRef)
+		return err
+	}
+
+	vdi := &VDIDescriptor{
+		VDIRef: vdiRef,
+	}
+	if err = vdi.Query(c); err != nil {
+		return err
+	}
+
+	vbd := &VBDDescriptor{
+		VM:   vm,
+		VDI:  vdi,
+		Type: xenAPI.VbdTypeCD,
+		Mode: xenAPI.VbdModeRO,
+	}
+
+	if vbd, err = createVBD(c, vbd); err != nil {
+		return err
+	}
+
+	return c.client.VBD.AddToOtherConfig(c.session, vbd.VBDRef, vbdOtherConfigConfigDrive, "true")
+}
+
+// Returns VDIs backing the config drives attached to the VM
+func queryConfigDriveVDIs(c *Connection, vm *VMDescriptor) ([]xenAPI.VDIRef, error) {
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return nil, err
+	}
+
+	vdis := make([]xenAPI.VDIRef, 0)
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return nil, err
+		}
+
+		if vbd.OtherConfig[vbdOtherConfigConfigDrive] == "true" {
+			vdis = append(vdis, vbd.VDI)
+		}
+	}
+
+	return vdis, nil
+}
+
+// Builds a minimal ISO9660 image with all files placed into the root directory
+func buildISO(label string, files map[string][]byte) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Layout: system area, primary volume descriptor, terminator,
+	// L and M path tables, root directory, files
+	const (
+		pvdSector       = 16
+		lPathSector     = 18
+		mPathSector     = 19
+		rootDirSector   = 20
+		firstFileSector = 21
+	)
+
+	extents := make([]uint32, len(names))
+	next := uint32(firstFileSector)
+	for i, name := range names {
+		extents[i] = next
+		next += uint32((len(files[name]) + isoSectorSize - 1) / isoSectorSize)
+	}
+	totalSectors := next
+
+	image := make([]byte, int(totalSectors)*isoSectorSize)
+	sector := func(n uint32) []byte {
+		return image[int(n)*isoSectorSize : int(n+1)*isoSectorSize]
+	}
+
+	// Root directory
+	root := sector(rootDirSector)
+	offset := 0
+	offset += isoDirectoryRecord(root[offset:], []byte{0}, rootDirSector, isoSectorSize, true)
+	offset += isoDirectoryRecord(root[offset:], []byte{1}, rootDirSector, isoSectorSize, true)
+	for i, name := range names {
+		// Plain ISO9660 identifier, Linux maps it back to lower case without version suffix
+		identifier := []byte(strings.ToUpper(name) + ".;1")
+		offset += isoDirectoryRecord(root[offset:], identifier, extents[i], uint32(len(files[name])), false)
+		copy(image[int(extents[i])*isoSectorSize:], files[name])
+	}
+
+	// Path tables contain only the root directory
+	lPath := sector(lPathSector)
+	lPath[0] = 1
+	binary.LittleEndian.PutUint32(lPath[2:], rootDirSector)
+	binary.LittleEndian.PutUint16(lPath[6:], 1)
+
+	mPath := sector(mPathSector)
+	mPath[0] = 1
+	binary.BigEndian.PutUint32(mPath[2:], rootDirSector)
+	binary.BigEndian.PutUint16(mPath[6:], 1)
+
+	// Primary volume descriptor
+	pvd := sector(pvdSector)
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	pvd[6] = 1
+	isoPadString(pvd[8:40], "")
+	isoPadString(pvd[40:72], strings.ToUpper(label))
+	isoBothEndian32(pvd[80:], totalSectors)
+	isoBothEndian16(pvd[120:], 1)
+	isoBothEndian16(pvd[124:], 1)
+	isoBothEndian16(pvd[128:], isoSectorSize)
+	isoBothEndian32(pvd[132:], 10)
+	binary.LittleEndian.PutUint32(pvd[140:], lPathSector)
+	binary.BigEndian.PutUint32(pvd[148:], mPathSector)
+	isoDirectoryRecord(pvd[156:190], []byte{0}, rootDirSector, isoSectorSize, true)
+	isoPadString(pvd[190:813], "")
+	for _, date := range [][]byte{pvd[813:830], pvd[830:847], pvd[847:864], pvd[864:881]} {
+		copy(date, "0000000000000000")
+	}
+	pvd[881] = 1
+
+	// Volume descriptor set terminator
+	terminator := sector(pvdSector + 1)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	return image
+}
+
+// Writes directory record and returns its length
+func isoDirectoryRecord(b []byte, identifier []byte, extent uint32, size uint32, isDir bool) int {
+	length := 33 + len(identifier)
+	if length%2 != 0 {
+		length++
+	}
+
+	b[0] = byte(length)
+	isoBothEndian32(b[2:], extent)
+	isoBothEndian32(b[10:], size)
+	// Recording date is left as 1900-01-01 00:00:00 UTC
+	if isDir {
+		b[25] = 2
+	}
+	isoBothEndian16(b[28:], 1)
+	b[32] = byte(len(identifier))
+	copy(b[33:], identifier)
+
+	return length
+}
+
+func isoBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func isoBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func isoPadString(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
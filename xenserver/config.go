@@ -15,6 +15,7 @@ type Config struct {
 type Connection struct {
 	client  *xenAPI.Client
 	session xenAPI.SessionRef
+	url     string
 }
 
 // NewConnection ...
@@ -29,5 +30,5 @@ func (cfg *Config) NewConnection() (*Connection, error) {
 		return nil, err
 	}
 
-	return &Connection{client, session}, nil
+	return &Connection{client, session, cfg.URL}, nil
 }
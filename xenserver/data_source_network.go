@@ -0,0 +1,101 @@
+package xenserver
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	networkDataSourceSchemaName        = "name_label"
+	networkDataSourceSchemaBridge      = "bridge"
+	networkDataSourceSchemaUUID        = "uuid"
+	networkDataSourceSchemaDescription = "description"
+	networkDataSourceSchemaMTU         = "mtu"
+	networkDataSourceSchemaManaged     = "managed"
+)
+
+func dataSourceXenServerNetwork() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceXenServerNetworkRead,
+		Schema: map[string]*schema.Schema{
+			networkDataSourceSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			networkDataSourceSchemaBridge: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			networkDataSourceSchemaUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			networkDataSourceSchemaDescription: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			networkDataSourceSchemaMTU: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			networkDataSourceSchemaManaged: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceXenServerNetworkRead(d *schema.ResourceData, meta interface{}) error {
+	c := meta.(*Connection)
+
+	name := d.Get(networkDataSourceSchemaName).(string)
+	bridge := d.Get(networkDataSourceSchemaBridge).(string)
+
+	if name == "" && bridge == "" {
+		return fmt.Errorf("one of %q or %q must be set", networkDataSourceSchemaName, networkDataSourceSchemaBridge)
+	}
+
+	networks, err := c.client.Network.GetAllRecords(c.session)
+	if err != nil {
+		return err
+	}
+
+	var found *NetworkDescriptor
+	for networkRef, record := range networks {
+		if name != "" && record.NameLabel != name {
+			continue
+		}
+		if bridge != "" && record.Bridge != bridge {
+			continue
+		}
+
+		if found != nil {
+			return fmt.Errorf("network lookup by name %q and bridge %q is ambiguous, it matches %s and %s", name, bridge, found.UUID, record.UUID)
+		}
+
+		found = &NetworkDescriptor{
+			NetworkRef: networkRef,
+		}
+		if err = found.Query(c); err != nil {
+			return err
+		}
+	}
+
+	if found == nil {
+		return fmt.Errorf("network with name %q and bridge %q not found", name, bridge)
+	}
+
+	d.SetId(found.UUID)
+	d.Set(networkDataSourceSchemaUUID, found.UUID)
+	d.Set(networkDataSourceSchemaName, found.Name)
+	d.Set(networkDataSourceSchemaBridge, found.Bridge)
+	d.Set(networkDataSourceSchemaDescription, found.Description)
+	d.Set(networkDataSourceSchemaMTU, found.MTU)
+	d.Set(networkDataSourceSchemaManaged, found.Managed)
+
+	return nil
+}
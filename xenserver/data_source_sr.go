@@ -0,0 +1,133 @@
+package xenserver
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	srDataSourceSchemaName        = "name_label"
+	srDataSourceSchemaUUID        = "uuid"
+	srDataSourceSchemaDescription = "description"
+	srDataSourceSchemaType        = "type"
+	srDataSourceSchemaContentType = "content_type"
+	srDataSourceSchemaShared      = "shared"
+	srDataSourceSchemaTags        = "tags"
+	srDataSourceSchemaOtherConfig = "other_config"
+
+	srDataSourceSchemaPhysicalSize        = "physical_size"
+	srDataSourceSchemaPhysicalUtilisation = "physical_utilisation"
+	srDataSourceSchemaVirtualAllocation   = "virtual_allocation"
+)
+
+func dataSourceXenServerSR() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceXenServerSRRead,
+		Schema: map[string]*schema.Schema{
+			srDataSourceSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			srDataSourceSchemaUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			srDataSourceSchemaDescription: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			srDataSourceSchemaType: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			srDataSourceSchemaContentType: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			srDataSourceSchemaShared: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			srDataSourceSchemaTags: &schema.Schema{
+				Type:     schema.TypeSet,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+			srDataSourceSchemaOtherConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+			srDataSourceSchemaPhysicalSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			srDataSourceSchemaPhysicalUtilisation: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			srDataSourceSchemaVirtualAllocation: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceXenServerSRRead(d *schema.ResourceData, meta interface{}) error {
+	c := meta.(*Connection)
+
+	name := d.Get(srDataSourceSchemaName).(string)
+	uuid := d.Get(srDataSourceSchemaUUID).(string)
+
+	sr := &SRDescriptor{}
+	switch {
+	case uuid != "":
+		sr.UUID = uuid
+		if err := sr.Load(c); err != nil {
+			return err
+		}
+
+		if name != "" && sr.Name != name {
+			return fmt.Errorf("SR %s is named %q, not %q", uuid, sr.Name, name)
+		}
+	case name != "":
+		srs, err := c.client.SR.GetByNameLabel(c.session, name)
+		if err != nil {
+			return err
+		}
+
+		if len(srs) == 0 {
+			return fmt.Errorf("SR with name %q not found", name)
+		}
+
+		if len(srs) > 1 {
+			return fmt.Errorf("SR lookup by name %q is ambiguous, it matches %d SRs", name, len(srs))
+		}
+
+		sr.SRRef = srs[0]
+		if err = sr.Query(c); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("one of %q or %q must be set", srDataSourceSchemaName, srDataSourceSchemaUUID)
+	}
+
+	d.SetId(sr.UUID)
+	d.Set(srDataSourceSchemaUUID, sr.UUID)
+	d.Set(srDataSourceSchemaName, sr.Name)
+	d.Set(srDataSourceSchemaDescription, sr.Description)
+	d.Set(srDataSourceSchemaType, sr.Type)
+	d.Set(srDataSourceSchemaContentType, sr.ContentType)
+	d.Set(srDataSourceSchemaShared, sr.Shared)
+	d.Set(srDataSourceSchemaTags, sr.Tags)
+	d.Set(srDataSourceSchemaOtherConfig, sr.OtherConfig)
+	d.Set(srDataSourceSchemaPhysicalSize, sr.PhysicalSize)
+	d.Set(srDataSourceSchemaPhysicalUtilisation, sr.PhysicalUtilisation)
+	d.Set(srDataSourceSchemaVirtualAllocation, sr.VirtualAllocation)
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package xenserver
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	vdiDataSourceSchemaName     = "name_label"
+	vdiDataSourceSchemaSRUUID   = "sr_uuid"
+	vdiDataSourceSchemaUUID     = "uuid"
+	vdiDataSourceSchemaSize     = "size"
+	vdiDataSourceSchemaShared   = "shared"
+	vdiDataSourceSchemaReadOnly = "read_only"
+)
+
+func dataSourceXenServerVDI() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceXenServerVDIRead,
+		Schema: map[string]*schema.Schema{
+			vdiDataSourceSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			vdiDataSourceSchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			vdiDataSourceSchemaUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			vdiDataSourceSchemaSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			vdiDataSourceSchemaShared: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			vdiDataSourceSchemaReadOnly: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceXenServerVDIRead(d *schema.ResourceData, meta interface{}) error {
+	c := meta.(*Connection)
+
+	name := d.Get(vdiDataSourceSchemaName).(string)
+	srUUID := d.Get(vdiDataSourceSchemaSRUUID).(string)
+
+	vdiRefs, err := c.client.VDI.GetByNameLabel(c.session, name)
+	if err != nil {
+		return err
+	}
+
+	var found *VDIDescriptor
+	for _, vdiRef := range vdiRefs {
+		record, err := c.client.VDI.GetRecord(c.session, vdiRef)
+		if err != nil {
+			return err
+		}
+
+		// Snapshots carry the name of their VDI
+		if record.IsASnapshot {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			VDIRef: vdiRef,
+		}
+		if err = vdi.Query(c); err != nil {
+			return err
+		}
+
+		if srUUID != "" && vdi.SR.UUID != srUUID {
+			continue
+		}
+
+		if found != nil {
+			return fmt.Errorf("VDI name %q is ambiguous, it matches %s and %s", name, found.UUID, vdi.UUID)
+		}
+		found = vdi
+	}
+
+	if found == nil {
+		if srUUID != "" {
+			return fmt.Errorf("VDI %q not found on SR %s", name, srUUID)
+		}
+		return fmt.Errorf("VDI %q not found", name)
+	}
+
+	d.SetId(found.UUID)
+	d.Set(vdiDataSourceSchemaUUID, found.UUID)
+	d.Set(vdiDataSourceSchemaSRUUID, found.SR.UUID)
+	d.Set(vdiDataSourceSchemaSize, found.Size)
+	d.Set(vdiDataSourceSchemaShared, found.IsShared)
+	d.Set(vdiDataSourceSchemaReadOnly, found.IsReadOnly)
+
+	return nil
+}
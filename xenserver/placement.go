@@ -0,0 +1,220 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+)
+
+const (
+	placementStrategyDefault        = "default"
+	placementStrategyMostFreeMemory = "most_free_memory"
+	placementStrategyFewestVMs      = "fewest_vms"
+	placementStrategyExplicitHost   = "explicit_host"
+)
+
+var placementStrategies = []string{
+	placementStrategyDefault,
+	placementStrategyMostFreeMemory,
+	placementStrategyFewestVMs,
+	placementStrategyExplicitHost,
+}
+
+// Selects the host to start the VM on, null reference leaves the decision to XAPI
+func selectPlacementHost(c *Connection, strategy string, vm *VMDescriptor) (xenAPI.HostRef, error) {
+	switch strategy {
+	case "", placementStrategyDefault:
+		return nullRef, nil
+	case placementStrategyExplicitHost:
+		if vm.Affinity == "" || vm.Affinity == nullRef {
+			return "", fmt.Errorf("%q placement requires %q to be set", placementStrategyExplicitHost, vmSchemaAffinityHost)
+		}
+		return vm.Affinity, nil
+	}
+
+	hosts, err := c.client.Host.GetAllRecords(c.session)
+	if err != nil {
+		return "", err
+	}
+
+	var selected xenAPI.HostRef = nullRef
+	var best int
+
+	for ref, host := range hosts {
+		if !host.Enabled {
+			log.Printf("[DEBUG] Skipping disabled host %s", host.NameLabel)
+			continue
+		}
+
+		var score int
+		switch strategy {
+		case placementStrategyMostFreeMemory:
+			if score, err = c.client.Host.ComputeFreeMemory(c.session, ref); err != nil {
+				return "", err
+			}
+		case placementStrategyFewestVMs:
+			// Control domain is resident on every host, so it does not affect the ordering
+			score = -len(host.ResidentVMs)
+		default:
+			return "", fmt.Errorf("unsupported placement strategy %q", strategy)
+		}
+
+		log.Printf("[DEBUG] Host %s scored %d for %s placement", host.NameLabel, score, strategy)
+
+		if selected == nullRef || score > best {
+			best = score
+			selected = ref
+		}
+	}
+
+	if selected == nullRef {
+		return "", fmt.Errorf("no enabled host available for %s placement", strategy)
+	}
+
+	return selected, nil
+}
+
+// Starts the VM on the host chosen by the placement strategy
+func startVMWithPlacement(c *Connection, strategy string, vm *VMDescriptor) error {
+	host, err := selectPlacementHost(c, strategy, vm)
+	if err != nil {
+		return err
+	}
+
+	if host == nullRef {
+		return c.client.VM.Start(c.session, vm.VMRef, false, false)
+	}
+
+	log.Printf("[DEBUG] Starting VM %s on host %s", vm.UUID, host)
+
+	return c.client.VM.StartOn(c.session, vm.VMRef, host, false, false)
+}
+
+// Live migrates a running VM to the host. VMs with all disks on shared storage are moved
+// with pool_migrate, otherwise the disks are moved to the given SR with storage motion.
+func migrateVM(c *Connection, vm *VMDescriptor, host xenAPI.HostRef, srUUID string) error {
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	localVDIs := make([]xenAPI.VDIRef, 0)
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		// ISOs stay in their library, only config drives are disks of the VM itself
+		if vbd.Empty || (vbd.Type == xenAPI.VbdTypeCD && vbd.OtherConfig[vbdOtherConfigConfigDrive] != "true") {
+			continue
+		}
+
+		sr, err := c.client.VDI.GetSR(c.session, vbd.VDI)
+		if err != nil {
+			return err
+		}
+
+		shared, err := c.client.SR.GetShared(c.session, sr)
+		if err != nil {
+			return err
+		}
+
+		if !shared {
+			localVDIs = append(localVDIs, vbd.VDI)
+		}
+	}
+
+	if len(localVDIs) == 0 {
+		log.Printf("[DEBUG] Migrating VM %s to host %s", vm.UUID, host)
+		if err = c.client.VM.PoolMigrate(c.session, vm.VMRef, host, map[string]string{"live": "true"}); err != nil {
+			return err
+		}
+		return vm.Query(c)
+	}
+
+	if srUUID == "" {
+		return fmt.Errorf("VM %q has disks on non-shared storage, %q is required to migrate it", vm.Name, vmSchemaMigrationSRUUID)
+	}
+
+	sr := &SRDescriptor{
+		UUID: srUUID,
+	}
+	if err = sr.Load(c); err != nil {
+		return err
+	}
+
+	network, err := queryMigrationNetwork(c, host)
+	if err != nil {
+		return err
+	}
+
+	dest, err := c.client.Host.MigrateReceive(c.session, host, network, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	vdiMap := make(map[xenAPI.VDIRef]xenAPI.SRRef)
+	for _, vdi := range localVDIs {
+		vdiMap[vdi] = sr.SRRef
+	}
+
+	log.Printf("[DEBUG] Migrating VM %s with storage to host %s and SR %s", vm.UUID, host, sr.UUID)
+	_, err = c.client.VM.MigrateSend(c.session, vm.VMRef, dest, true, vdiMap, map[xenAPI.VIFRef]xenAPI.NetworkRef{}, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	return vm.Query(c)
+}
+
+// Returns the network of the host's interface dedicated to migration traffic,
+// falling back to the management interface
+func queryMigrationNetwork(c *Connection, host xenAPI.HostRef) (xenAPI.NetworkRef, error) {
+	pifs, err := c.client.Host.GetPIFs(c.session, host)
+	if err != nil {
+		return "", err
+	}
+
+	var management xenAPI.NetworkRef
+	for _, pifRef := range pifs {
+		pif, err := c.client.PIF.GetRecord(c.session, pifRef)
+		if err != nil {
+			return "", err
+		}
+
+		if pif.OtherConfig[pifOtherConfigManagementPurpose] == pifPurposes[pifPurposeMigration] && pif.IP != "" {
+			log.Printf("[DEBUG] Using migration interface %s of host %s", pif.Device, host)
+			return pif.Network, nil
+		}
+
+		if pif.Management {
+			management = pif.Network
+		}
+	}
+
+	if management == "" {
+		return "", fmt.Errorf("host %s has no management interface", host)
+	}
+
+	return management, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fiveai/go-xen-api-client"
+)
+
+const (
+	powerStateRunning   = "running"
+	powerStateHalted    = "halted"
+	powerStateSuspended = "suspended"
+)
+
+var powerStates = []string{
+	powerStateRunning,
+	powerStateHalted,
+	powerStateSuspended,
+}
+
+// Moves the VM to the requested power state. Clean operations are used unless force is set.
+// The placement strategy is only used when the VM has to be started from halted state.
+func setVMPowerState(c *Connection, vm *VMDescriptor, target string, force bool, placement string) error {
+	current := strings.ToLower(string(vm.PowerState))
+
+	log.Printf("[DEBUG] Changing power state of VM %s from %s to %s", vm.UUID, current, target)
+
+	if current == target {
+		return nil
+	}
+
+	var err error
+
+	switch target {
+	case powerStateRunning:
+		switch vm.PowerState {
+		case xenAPI.VMPowerStateHalted:
+			err = startVMWithPlacement(c, placement, vm)
+		case xenAPI.VMPowerStateSuspended:
+			err = c.client.VM.Resume(c.session, vm.VMRef, false, force)
+		case xenAPI.VMPowerStatePaused:
+			err = c.client.VM.Unpause(c.session, vm.VMRef)
+		}
+	case powerStateHalted:
+		switch vm.PowerState {
+		case xenAPI.VMPowerStateRunning:
+			if force {
+				err = c.client.VM.HardShutdown(c.session, vm.VMRef)
+			} else {
+				err = c.client.VM.CleanShutdown(c.session, vm.VMRef)
+			}
+		case xenAPI.VMPowerStateSuspended, xenAPI.VMPowerStatePaused:
+			// Neither state allows clean shutdown
+			err = c.client.VM.HardShutdown(c.session, vm.VMRef)
+		}
+	case powerStateSuspended:
+		switch vm.PowerState {
+		case xenAPI.VMPowerStateHalted:
+			if err = startVMWithPlacement(c, placement, vm); err == nil {
+				err = c.client.VM.Suspend(c.session, vm.VMRef)
+			}
+		case xenAPI.VMPowerStatePaused:
+			if err = c.client.VM.Unpause(c.session, vm.VMRef); err == nil {
+				err = c.client.VM.Suspend(c.session, vm.VMRef)
+			}
+		case xenAPI.VMPowerStateRunning:
+			err = c.client.VM.Suspend(c.session, vm.VMRef)
+		}
+	default:
+		return fmt.Errorf("unsupported power state %q", target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return vm.Query(c)
+}
+
+// Shuts the VM down cleanly, falling back to hard shutdown when the guest does not
+// halt within the timeout or refuses the clean shutdown
+func shutdownVM(c *Connection, vm *VMDescriptor, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.VM.CleanShutdown(c.session, vm.VMRef)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			return vm.Query(c)
+		}
+		log.Printf("[WARN] Clean shutdown of VM %s failed, forcing it - %s", vm.UUID, err)
+	case <-time.After(timeout):
+		log.Printf("[WARN] Clean shutdown of VM %s timed out after %s, forcing it", vm.UUID, timeout)
+	}
+
+	// Guest may have finished shutting down in the meantime
+	if err := vm.Query(c); err != nil {
+		return err
+	}
+	if vm.PowerState == xenAPI.VMPowerStateHalted {
+		return nil
+	}
+
+	if err := c.client.VM.HardShutdown(c.session, vm.VMRef); err != nil {
+		return err
+	}
+
+	return vm.Query(c)
+}
@@ -35,13 +35,30 @@ func Provider() terraform.ResourceProvider {
 		},
 
 		DataSourcesMap: map[string]*schema.Resource{
-			"xenserver_pifs": dataSourceXenServerPifs(),
+			"xenserver_network": dataSourceXenServerNetwork(),
+			"xenserver_pifs":    dataSourceXenServerPifs(),
+			"xenserver_sr":      dataSourceXenServerSR(),
+			"xenserver_vdi":     dataSourceXenServerVDI(),
 		},
 
 		ResourcesMap: map[string]*schema.Resource{
-			"xenserver_vm":      resourceVM(),
-			"xenserver_vdi":     resourceVDI(),
-			"xenserver_network": resourceNetwork(),
+			"xenserver_vm":                          resourceVM(),
+			"xenserver_vm_export":                   resourceVMExport(),
+			"xenserver_vdi":                         resourceVDI(),
+			"xenserver_vdi_copy":                    resourceVDICopy(),
+			"xenserver_vdi_export":                  resourceVDIExport(),
+			"xenserver_vdi_snapshot":                resourceVDISnapshot(),
+			"xenserver_network":                     resourceNetwork(),
+			"xenserver_vbd":                         resourceVBDAttachment(),
+			"xenserver_vlan":                        resourceVLAN(),
+			"xenserver_internal_management_network": resourceInternalManagementNetwork(),
+			"xenserver_pif_ip":                      resourcePIFIP(),
+			"xenserver_bond":                        resourceBond(),
+			"xenserver_sr":                          resourceSR(),
+			"xenserver_pool_default_sr":             resourcePoolDefaultSR(),
+			"xenserver_pbd":                         resourcePBD(),
+			"xenserver_sdn_controller":              resourceSDNController(),
+			"xenserver_tunnel":                      resourceTunnel(),
 		},
 
 		ConfigureFunc: providerConfigure,
@@ -76,4 +93,13 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 // used to ignore any case-changes in a return value.
 func ignoreCaseDiffSuppressFunc(k, old, new string, d *schema.ResourceData) bool {
 	return strings.ToLower(old) == strings.ToLower(new)
-}
\ No newline at end of file
+}
+
+// readStringSet converts a set of strings from the schema to a slice.
+func readStringSet(s *schema.Set) []string {
+	values := make([]string, 0, s.Len())
+	for _, v := range s.List() {
+		values = append(values, v.(string))
+	}
+	return values
+}
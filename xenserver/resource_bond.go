@@ -0,0 +1,386 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	bondSchemaNetwork          = "network"
+	bondSchemaPIFs             = "pifs"
+	bondSchemaMode             = "mode"
+	bondSchemaHashingAlgorithm = "hashing_algorithm"
+	bondSchemaMAC              = "mac"
+	bondSchemaMaster           = "master"
+	bondSchemaLACPTime         = "lacp_time"
+	bondSchemaProperties       = "properties"
+	bondSchemaPrimaryPIF       = "primary_pif"
+)
+
+const (
+	// Bond property selecting how LACP bonds spread traffic across their members
+	bondPropertyHashingAlgorithm = "hashing_algorithm"
+	// Bond property selecting how often LACP partners exchange control frames
+	bondPropertyLACPTime = "lacp-time"
+)
+
+func resourceBond() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceBondCreate,
+		Read:   resourceBondRead,
+		Update: resourceBondUpdate,
+		Delete: resourceBondDelete,
+		Exists: resourceBondExists,
+
+		Schema: map[string]*schema.Schema{
+			bondSchemaNetwork: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			bondSchemaPIFs: &schema.Schema{
+				Type:     schema.TypeSet,
+				Required: true,
+				ForceNew: true,
+				MinItems: 2,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+
+			bondSchemaMode: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  string(xenAPI.BondModeBalanceSlb),
+				ValidateFunc: validation.StringInSlice([]string{
+					string(xenAPI.BondModeBalanceSlb),
+					string(xenAPI.BondModeActiveBackup),
+					string(xenAPI.BondModeLacp),
+				}, false),
+			},
+
+			bondSchemaHashingAlgorithm: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{"src_mac", "tcpudp_ports"}, false),
+			},
+
+			bondSchemaMAC: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
+
+			bondSchemaMaster: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			bondSchemaLACPTime: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{"slow", "fast"}, false),
+			},
+
+			// Further properties such as updelay or lacp-fallback-ab, passed to XAPI as they are
+			bondSchemaProperties: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			// XAPI makes the first member the primary one, which carries the traffic of active-backup bonds
+			bondSchemaPrimaryPIF: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
+		},
+	}
+}
+
+func resourceBondCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Get(bondSchemaNetwork).(string),
+	}
+	if err := network.Load(c); err != nil {
+		return err
+	}
+
+	uuids := readStringSet(d.Get(bondSchemaPIFs).(*schema.Set))
+	if primary := d.Get(bondSchemaPrimaryPIF).(string); primary != "" {
+		if !containsString(uuids, primary) {
+			return fmt.Errorf("%q %s is not one of %q", bondSchemaPrimaryPIF, primary, bondSchemaPIFs)
+		}
+		ordered := []string{primary}
+		for _, uuid := range uuids {
+			if uuid != primary {
+				ordered = append(ordered, uuid)
+			}
+		}
+		uuids = ordered
+	}
+
+	members := make([]xenAPI.PIFRef, 0)
+	for _, uuid := range uuids {
+		pif := &PIFDescriptor{
+			UUID: uuid,
+		}
+		if err := pif.Load(c); err != nil {
+			return err
+		}
+		members = append(members, pif.PIFRef)
+	}
+
+	mode := xenAPI.BondMode(d.Get(bondSchemaMode).(string))
+
+	properties, err := readBondProperties(d)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Creating %s bond of %d PIFs on network %s", mode, len(members), network.UUID)
+
+	// Members keep their addressing on the bond master, which takes over their traffic
+	bondRef, err := c.client.Bond.Create(c.session, network.NetworkRef, members, d.Get(bondSchemaMAC).(string), mode, properties)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create bond - %s", err)
+		return err
+	}
+
+	bond := &BondDescriptor{
+		BondRef: bondRef,
+	}
+	if err = bond.Query(c); err != nil {
+		return err
+	}
+
+	d.SetId(bond.UUID)
+
+	return resourceBondRead(d, m)
+}
+
+func resourceBondRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	bond := &BondDescriptor{
+		UUID: d.Id(),
+	}
+	if err := bond.Load(c); err != nil {
+		return err
+	}
+
+	network := &NetworkDescriptor{
+		NetworkRef: bond.Master.Network,
+	}
+	if err := network.Query(c); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaNetwork, network.UUID); err != nil {
+		return err
+	}
+
+	pifs := make([]string, 0, len(bond.Slaves))
+	for _, slave := range bond.Slaves {
+		pifs = append(pifs, slave.UUID)
+	}
+	if err := d.Set(bondSchemaPIFs, pifs); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaMode, string(bond.Mode)); err != nil {
+		return err
+	}
+
+	// XAPI reports the LACP properties for all bonds, they are only meaningful for LACP bonds
+	lacp := bond.Mode == xenAPI.BondModeLacp
+
+	hashingAlgorithm, lacpTime := "", ""
+	if lacp {
+		hashingAlgorithm = bond.Properties[bondPropertyHashingAlgorithm]
+		lacpTime = bond.Properties[bondPropertyLACPTime]
+	}
+
+	if err := d.Set(bondSchemaHashingAlgorithm, hashingAlgorithm); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaMAC, bond.Master.MAC); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaMaster, bond.Master.UUID); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaLACPTime, lacpTime); err != nil {
+		return err
+	}
+
+	// XAPI fills in defaults for all properties, only track the configured ones
+	dProperties := d.Get(bondSchemaProperties).(map[string]interface{})
+	if err := d.Set(bondSchemaProperties, filterManagedMap(bond.Properties, dProperties)); err != nil {
+		return err
+	}
+
+	if err := d.Set(bondSchemaPrimaryPIF, bond.PrimarySlave); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Collects the bond properties of the configuration. The dedicated attributes only apply to LACP bonds,
+// values left over in the state from a former LACP mode are ignored for other modes.
+func readBondProperties(d *schema.ResourceData) (map[string]string, error) {
+	properties := make(map[string]string)
+	for k, v := range d.Get(bondSchemaProperties).(map[string]interface{}) {
+		if k == bondPropertyHashingAlgorithm || k == bondPropertyLACPTime {
+			return nil, fmt.Errorf("%q must be set with its own attribute instead of %q", k, bondSchemaProperties)
+		}
+		properties[k] = v.(string)
+	}
+
+	lacp := d.Get(bondSchemaMode).(string) == string(xenAPI.BondModeLacp)
+
+	if algorithm := d.Get(bondSchemaHashingAlgorithm).(string); algorithm != "" {
+		if !lacp {
+			if d.HasChange(bondSchemaHashingAlgorithm) {
+				return nil, fmt.Errorf("%q is only supported by %s bonds", bondSchemaHashingAlgorithm, xenAPI.BondModeLacp)
+			}
+		} else {
+			properties[bondPropertyHashingAlgorithm] = algorithm
+		}
+	}
+
+	if lacpTime := d.Get(bondSchemaLACPTime).(string); lacpTime != "" {
+		if !lacp {
+			if d.HasChange(bondSchemaLACPTime) {
+				return nil, fmt.Errorf("%q is only supported by %s bonds", bondSchemaLACPTime, xenAPI.BondModeLacp)
+			}
+		} else {
+			properties[bondPropertyLACPTime] = lacpTime
+		}
+	}
+
+	return properties, nil
+}
+
+func resourceBondUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	bond := &BondDescriptor{
+		UUID: d.Id(),
+	}
+	if err := bond.Load(c); err != nil {
+		return err
+	}
+
+	d.Partial(true)
+
+	if d.HasChange(bondSchemaMode) {
+		mode := xenAPI.BondMode(d.Get(bondSchemaMode).(string))
+
+		log.Printf("[DEBUG] Changing mode of bond %s to %s", bond.UUID, mode)
+		if err := c.client.Bond.SetMode(c.session, bond.BondRef, mode); err != nil {
+			return err
+		}
+
+		d.SetPartial(bondSchemaMode)
+	}
+
+	if d.HasChange(bondSchemaHashingAlgorithm) || d.HasChange(bondSchemaLACPTime) || d.HasChange(bondSchemaProperties) {
+		properties, err := readBondProperties(d)
+		if err != nil {
+			return err
+		}
+
+		// Properties removed from the configuration keep their current value
+		for k, v := range properties {
+			if bond.Properties[k] == v {
+				continue
+			}
+
+			log.Printf("[DEBUG] Setting property %s of bond %s to %s", k, bond.UUID, v)
+			if err := c.client.Bond.SetProperty(c.session, bond.BondRef, k, v); err != nil {
+				return err
+			}
+		}
+
+		d.SetPartial(bondSchemaHashingAlgorithm)
+		d.SetPartial(bondSchemaLACPTime)
+		d.SetPartial(bondSchemaProperties)
+	}
+
+	d.Partial(false)
+
+	return resourceBondRead(d, m)
+}
+
+// Destroying the bond moves the addressing of the bond master back to the first member
+func resourceBondDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	bond := &BondDescriptor{
+		UUID: d.Id(),
+	}
+	if err := bond.Load(c); err != nil {
+		return err
+	}
+
+	if err := c.client.Bond.Destroy(c.session, bond.BondRef); err != nil {
+		log.Printf("[ERROR] Failed to destroy bond %s - %s", bond.UUID, err)
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceBondExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	bond := &BondDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := bond.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
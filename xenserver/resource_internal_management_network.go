@@ -0,0 +1,221 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	internalManagementSchemaIPBegin = "ip_begin"
+	internalManagementSchemaIPEnd   = "ip_end"
+	internalManagementSchemaNetmask = "netmask"
+	internalManagementSchemaName    = "name_label"
+	internalManagementSchemaBridge  = "bridge"
+)
+
+// XAPI marks the network connecting guests with dom0 with this other_config key
+const networkOtherConfigHostInternalManagement = "is_host_internal_management_network"
+
+func resourceInternalManagementNetwork() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceInternalManagementNetworkCreate,
+		Read:   resourceInternalManagementNetworkRead,
+		Update: resourceInternalManagementNetworkUpdate,
+		Delete: resourceInternalManagementNetworkDelete,
+
+		Schema: map[string]*schema.Schema{
+			internalManagementSchemaIPBegin: &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			internalManagementSchemaIPEnd: &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			internalManagementSchemaNetmask: &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			internalManagementSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			internalManagementSchemaBridge: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// Returns the host internal management network of the pool
+func queryInternalManagementNetwork(c *Connection) (*NetworkDescriptor, error) {
+	networks, err := c.client.Network.GetAllRecords(c.session)
+	if err != nil {
+		return nil, err
+	}
+
+	for networkRef, record := range networks {
+		if record.OtherConfig[networkOtherConfigHostInternalManagement] != "true" {
+			continue
+		}
+
+		network := &NetworkDescriptor{
+			NetworkRef: networkRef,
+		}
+		if err = network.Query(c); err != nil {
+			return nil, err
+		}
+
+		return network, nil
+	}
+
+	return nil, fmt.Errorf("pool has no host internal management network")
+}
+
+// Checks that the range is ordered and lies within one subnet of the netmask
+func validateInternalManagementRange(begin, end, netmask string) error {
+	ipBegin := net.ParseIP(begin).To4()
+	ipEnd := net.ParseIP(end).To4()
+	mask := net.IPMask(net.ParseIP(netmask).To4())
+
+	if bytes.Compare(ipBegin, ipEnd) > 0 {
+		return fmt.Errorf("%q %s is after %q %s", internalManagementSchemaIPBegin, begin, internalManagementSchemaIPEnd, end)
+	}
+
+	if !ipBegin.Mask(mask).Equal(ipEnd.Mask(mask)) {
+		return fmt.Errorf("range %s-%s does not fit into a single subnet with netmask %s", begin, end, netmask)
+	}
+
+	return nil
+}
+
+func updateInternalManagementNetwork(c *Connection, network *NetworkDescriptor, d *schema.ResourceData) error {
+	begin := d.Get(internalManagementSchemaIPBegin).(string)
+	end := d.Get(internalManagementSchemaIPEnd).(string)
+	netmask := d.Get(internalManagementSchemaNetmask).(string)
+
+	if err := validateInternalManagementRange(begin, end, netmask); err != nil {
+		return err
+	}
+
+	if network.OtherConfig == nil {
+		network.OtherConfig = make(map[string]string)
+	}
+	network.OtherConfig[internalManagementSchemaIPBegin] = begin
+	network.OtherConfig[internalManagementSchemaIPEnd] = end
+	network.OtherConfig[internalManagementSchemaNetmask] = netmask
+
+	log.Printf("[DEBUG] Setting range of host internal management network %s to %s-%s/%s", network.UUID, begin, end, netmask)
+
+	return c.client.Network.SetOtherConfig(c.session, network.NetworkRef, network.OtherConfig)
+}
+
+func resourceInternalManagementNetworkCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network, err := queryInternalManagementNetwork(c)
+	if err != nil {
+		return err
+	}
+
+	if err = updateInternalManagementNetwork(c, network, d); err != nil {
+		return err
+	}
+
+	d.SetId(network.UUID)
+
+	return resourceInternalManagementNetworkRead(d, m)
+}
+
+func resourceInternalManagementNetworkRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Id(),
+	}
+	if err := network.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok && xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+			d.SetId("")
+			return nil
+		}
+		return err
+	}
+
+	if err := d.Set(internalManagementSchemaIPBegin, network.OtherConfig[internalManagementSchemaIPBegin]); err != nil {
+		return err
+	}
+
+	if err := d.Set(internalManagementSchemaIPEnd, network.OtherConfig[internalManagementSchemaIPEnd]); err != nil {
+		return err
+	}
+
+	if err := d.Set(internalManagementSchemaNetmask, network.OtherConfig[internalManagementSchemaNetmask]); err != nil {
+		return err
+	}
+
+	if err := d.Set(internalManagementSchemaName, network.Name); err != nil {
+		return err
+	}
+
+	if err := d.Set(internalManagementSchemaBridge, network.Bridge); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceInternalManagementNetworkUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Id(),
+	}
+	if err := network.Load(c); err != nil {
+		return err
+	}
+
+	if err := updateInternalManagementNetwork(c, network, d); err != nil {
+		return err
+	}
+
+	return resourceInternalManagementNetworkRead(d, m)
+}
+
+// The network belongs to XAPI, so the range is left in place when the resource is destroyed
+func resourceInternalManagementNetworkDelete(d *schema.ResourceData, m interface{}) error {
+	log.Printf("[DEBUG] Leaving range of host internal management network %s in place", d.Id())
+
+	d.SetId("")
+	return nil
+}
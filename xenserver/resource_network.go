@@ -19,17 +19,29 @@
 package xenserver
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/fiveai/go-xen-api-client"
 )
 
 const (
-	networkSchemaName        = "name_label"
-	networkSchemaDescription = "description"
-	networkSchemaBridge      = "bridge"
-	networkSchemaMTU         = "mtu"
+	networkSchemaName               = "name_label"
+	networkSchemaDescription        = "description"
+	networkSchemaBridge             = "bridge"
+	networkSchemaMTU                = "mtu"
+	networkSchemaOtherConfig        = "other_config"
+	networkSchemaPurpose            = "purpose"
+	networkSchemaDefaultLockingMode = "default_locking_mode"
+	networkSchemaManaged            = "managed"
+)
+
+const (
+	networkDefaultMTU = 1500
+	networkMinMTU     = 68
+	networkMaxMTU     = 9216
 )
 
 func resourceNetwork() *schema.Resource {
@@ -52,15 +64,53 @@ func resourceNetwork() *schema.Resource {
 			},
 
 			networkSchemaMTU: &schema.Schema{
-				Type:     schema.TypeInt,
-				Optional: true,
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      networkDefaultMTU,
+				ValidateFunc: validation.IntBetween(networkMinMTU, networkMaxMTU),
 			},
 
+			// XAPI picks a bridge for pool-internal networks when none is given
 			networkSchemaBridge: &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+				Computed: true,
 				ForceNew: true,
 			},
+
+			networkSchemaOtherConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			networkSchemaPurpose: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+					ValidateFunc: validation.StringInSlice([]string{
+						string(xenAPI.NetworkPurposeNbd),
+						string(xenAPI.NetworkPurposeInsecureNbd),
+					}, false),
+				},
+				Set: schema.HashString,
+			},
+
+			networkSchemaDefaultLockingMode: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  string(xenAPI.NetworkDefaultLockingModeUnlocked),
+				ValidateFunc: validation.StringInSlice([]string{
+					string(xenAPI.NetworkDefaultLockingModeUnlocked),
+					string(xenAPI.NetworkDefaultLockingModeDisabled),
+				}, false),
+			},
+
+			// Unmanaged networks use a bridge which XAPI does not create on the hosts
+			networkSchemaManaged: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
 		},
 	}
 }
@@ -73,6 +123,11 @@ func resourceNetworkCreate(d *schema.ResourceData, m interface{}) error {
 		NameDescription: d.Get(networkSchemaDescription).(string),
 		MTU:             d.Get(networkSchemaMTU).(int),
 		Bridge:          d.Get(networkSchemaBridge).(string),
+		OtherConfig:     make(map[string]string),
+	}
+
+	for k, v := range d.Get(networkSchemaOtherConfig).(map[string]interface{}) {
+		networkRecord.OtherConfig[k] = v.(string)
 	}
 
 	if networkRef, err := c.client.Network.Create(c.session, networkRecord); err == nil {
@@ -86,6 +141,17 @@ func resourceNetworkCreate(d *schema.ResourceData, m interface{}) error {
 		}
 		log.Println("UUID is ", network.UUID)
 		d.SetId(network.UUID)
+
+		if err := updateNetworkPurpose(c, network, readStringSet(d.Get(networkSchemaPurpose).(*schema.Set))); err != nil {
+			return err
+		}
+
+		lockingMode := xenAPI.NetworkDefaultLockingMode(d.Get(networkSchemaDefaultLockingMode).(string))
+		if lockingMode != network.DefaultLockingMode {
+			if err := c.client.Network.SetDefaultLockingMode(c.session, networkRef, lockingMode); err != nil {
+				return err
+			}
+		}
 	} else {
 		log.Println("Network not created!")
 		return err
@@ -122,6 +188,24 @@ func resourceNetworkRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	// XAPI keeps its own keys in other_config, only track the configured ones
+	dOtherConfig := d.Get(networkSchemaOtherConfig).(map[string]interface{})
+	if err := d.Set(networkSchemaOtherConfig, filterManagedMap(network.OtherConfig, dOtherConfig)); err != nil {
+		return err
+	}
+
+	if err := d.Set(networkSchemaPurpose, network.Purpose); err != nil {
+		return err
+	}
+
+	if err := d.Set(networkSchemaDefaultLockingMode, string(network.DefaultLockingMode)); err != nil {
+		return err
+	}
+
+	if err := d.Set(networkSchemaManaged, network.Managed); err != nil {
+		return err
+	}
+
 	return nil
 }
 func resourceNetworkUpdate(d *schema.ResourceData, m interface{}) error {
@@ -148,6 +232,10 @@ func resourceNetworkUpdate(d *schema.ResourceData, m interface{}) error {
 	if d.HasChange(networkSchemaMTU) {
 		_, n := d.GetChange(networkSchemaMTU)
 
+		if err := checkNetworkMTU(c, network, n.(int)); err != nil {
+			return err
+		}
+
 		if err := c.client.Network.SetMTU(c.session, network.NetworkRef, n.(int)); err != nil {
 			return err
 		}
@@ -165,6 +253,35 @@ func resourceNetworkUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetPartial(networkSchemaDescription)
 	}
 
+	if d.HasChange(networkSchemaOtherConfig) {
+		o, n := d.GetChange(networkSchemaOtherConfig)
+		mergeManagedMap(network.OtherConfig, o.(map[string]interface{}), n.(map[string]interface{}))
+
+		if err := c.client.Network.SetOtherConfig(c.session, network.NetworkRef, network.OtherConfig); err != nil {
+			return err
+		}
+
+		d.SetPartial(networkSchemaOtherConfig)
+	}
+
+	if d.HasChange(networkSchemaPurpose) {
+		if err := updateNetworkPurpose(c, network, readStringSet(d.Get(networkSchemaPurpose).(*schema.Set))); err != nil {
+			return err
+		}
+
+		d.SetPartial(networkSchemaPurpose)
+	}
+
+	if d.HasChange(networkSchemaDefaultLockingMode) {
+		_, n := d.GetChange(networkSchemaDefaultLockingMode)
+
+		if err := c.client.Network.SetDefaultLockingMode(c.session, network.NetworkRef, xenAPI.NetworkDefaultLockingMode(n.(string))); err != nil {
+			return err
+		}
+
+		d.SetPartial(networkSchemaDefaultLockingMode)
+	}
+
 	return nil
 }
 func resourceNetworkDelete(d *schema.ResourceData, m interface{}) error {
@@ -203,3 +320,91 @@ func resourceNetworkExists(d *schema.ResourceData, m interface{}) (bool, error)
 
 	return true, nil
 }
+
+// Replaces the purposes of the network. Stale purposes are removed first, as XAPI refuses
+// to combine nbd and insecure_nbd on the same network.
+func updateNetworkPurpose(c *Connection, network *NetworkDescriptor, purposes []string) error {
+	if containsString(purposes, string(xenAPI.NetworkPurposeNbd)) && containsString(purposes, string(xenAPI.NetworkPurposeInsecureNbd)) {
+		return fmt.Errorf("%q can not contain both %q and %q", networkSchemaPurpose, xenAPI.NetworkPurposeNbd, xenAPI.NetworkPurposeInsecureNbd)
+	}
+
+	for _, purpose := range network.Purpose {
+		if containsString(purposes, purpose) {
+			continue
+		}
+
+		log.Printf("[DEBUG] Removing purpose %s from network %s", purpose, network.UUID)
+		if err := c.client.Network.RemovePurpose(c.session, network.NetworkRef, xenAPI.NetworkPurpose(purpose)); err != nil {
+			return err
+		}
+	}
+
+	for _, purpose := range purposes {
+		if containsString(network.Purpose, purpose) {
+			continue
+		}
+
+		log.Printf("[DEBUG] Adding purpose %s to network %s", purpose, network.UUID)
+		if err := c.client.Network.AddPurpose(c.session, network.NetworkRef, xenAPI.NetworkPurpose(purpose)); err != nil {
+			return err
+		}
+	}
+
+	network.Purpose = purposes
+
+	return nil
+}
+
+// Verifies that the interfaces already on the network can carry the MTU: VIFs must not use a
+// larger MTU and VLANs need a tagged PIF with at least the same MTU
+func checkNetworkMTU(c *Connection, network *NetworkDescriptor, mtu int) error {
+	vifRefs, err := c.client.Network.GetVIFs(c.session, network.NetworkRef)
+	if err != nil {
+		return err
+	}
+
+	for _, vifRef := range vifRefs {
+		vif, err := c.client.VIF.GetRecord(c.session, vifRef)
+		if err != nil {
+			return err
+		}
+
+		if vif.MTU > mtu {
+			return fmt.Errorf("VIF %s uses MTU %d, which is larger than the new MTU %d of network %q", vif.UUID, vif.MTU, mtu, network.Name)
+		}
+	}
+
+	pifRefs, err := c.client.Network.GetPIFs(c.session, network.NetworkRef)
+	if err != nil {
+		return err
+	}
+
+	for _, pifRef := range pifRefs {
+		pif, err := c.client.PIF.GetRecord(c.session, pifRef)
+		if err != nil {
+			return err
+		}
+
+		if pif.VLANMasterOf == "" || pif.VLANMasterOf == nullRef {
+			continue
+		}
+
+		vlan, err := c.client.VLAN.GetRecord(c.session, pif.VLANMasterOf)
+		if err != nil {
+			return err
+		}
+
+		tagged, err := c.client.PIF.GetRecord(c.session, vlan.TaggedPIF)
+		if err != nil {
+			return err
+		}
+
+		if tagged.MTU < mtu {
+			return fmt.Errorf("VLAN %d of network %q runs over PIF %s with MTU %d, which is smaller than the new MTU %d", vlan.Tag, network.Name, tagged.UUID, tagged.MTU, mtu)
+		}
+	}
+
+	log.Printf("[DEBUG] Network %s can carry MTU %d", network.UUID, mtu)
+
+	return nil
+}
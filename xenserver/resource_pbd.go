@@ -0,0 +1,293 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	pbdSchemaSRUUID       = "sr_uuid"
+	pbdSchemaHostUUID     = "host_uuid"
+	pbdSchemaDeviceConfig = "device_config"
+	pbdSchemaPlugged      = "plugged"
+)
+
+func resourcePBD() *schema.Resource {
+	return &schema.Resource{
+		Create: resourcePBDCreate,
+		Read:   resourcePBDRead,
+		Update: resourcePBDUpdate,
+		Delete: resourcePBDDelete,
+		Exists: resourcePBDExists,
+
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Schema: map[string]*schema.Schema{
+			pbdSchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			pbdSchemaHostUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			// Copied from another PBD of the SR when not set
+			pbdSchemaDeviceConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: true,
+			},
+
+			pbdSchemaPlugged: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+		},
+	}
+}
+
+// Plugs or unplugs the PBD unless it is already in the requested state
+func setPBDPlugged(c *Connection, pbd *PBDDescriptor, plugged bool) error {
+	if pbd.CurrentlyAttached == plugged {
+		return nil
+	}
+
+	if plugged {
+		log.Printf("[DEBUG] Plugging PBD %s", pbd.UUID)
+		if err := c.client.PBD.Plug(c.session, pbd.PBDRef); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[DEBUG] Unplugging PBD %s", pbd.UUID)
+		if err := c.client.PBD.Unplug(c.session, pbd.PBDRef); err != nil {
+			return err
+		}
+	}
+
+	return pbd.Query(c)
+}
+
+// Returns the device_config to connect the host to the SR with
+func readPBDDeviceConfig(c *Connection, d *schema.ResourceData, sr *SRDescriptor) (map[string]string, error) {
+	deviceConfig := make(map[string]string)
+	for k, v := range d.Get(pbdSchemaDeviceConfig).(map[string]interface{}) {
+		deviceConfig[k] = v.(string)
+	}
+
+	if len(deviceConfig) > 0 {
+		return deviceConfig, nil
+	}
+
+	// All PBDs of a shared SR use the same device_config
+	if len(sr.PBDs) == 0 {
+		return nil, fmt.Errorf("SR %s has no PBD to copy the device_config from, %q must be set", sr.UUID, pbdSchemaDeviceConfig)
+	}
+
+	pbd := &PBDDescriptor{
+		PBDRef: sr.PBDs[0],
+	}
+	if err := pbd.Query(c); err != nil {
+		return nil, err
+	}
+
+	return pbd.DeviceConfig, nil
+}
+
+func resourcePBDCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	sr := &SRDescriptor{
+		UUID: d.Get(pbdSchemaSRUUID).(string),
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	host := &HostDescriptor{
+		UUID: d.Get(pbdSchemaHostUUID).(string),
+	}
+	if err := host.Load(c); err != nil {
+		return err
+	}
+
+	for _, pbdRef := range sr.PBDs {
+		existing := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err := existing.Query(c); err != nil {
+			return err
+		}
+
+		// XAPI allows a single PBD per host and SR. An existing one may belong to another
+		// resource, e.g. the SR, so it is not taken over silently.
+		if existing.Host == host.HostRef {
+			return fmt.Errorf("host %s already has PBD %s for SR %s, import it to manage it", host.UUID, existing.UUID, sr.UUID)
+		}
+	}
+
+	deviceConfig, err := readPBDDeviceConfig(c, d, sr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Creating PBD of SR %s on host %s", sr.UUID, host.Name)
+	pbdRef, err := c.client.PBD.Create(c.session, xenAPI.PBDRecord{
+		Host:         host.HostRef,
+		SR:           sr.SRRef,
+		DeviceConfig: deviceConfig,
+		OtherConfig:  map[string]string{},
+	})
+	if err != nil {
+		return err
+	}
+
+	pbd := &PBDDescriptor{
+		PBDRef: pbdRef,
+	}
+	if err = pbd.Query(c); err != nil {
+		return err
+	}
+
+	d.SetId(pbd.UUID)
+
+	if err := setPBDPlugged(c, pbd, d.Get(pbdSchemaPlugged).(bool)); err != nil {
+		return err
+	}
+
+	return resourcePBDRead(d, m)
+}
+
+func resourcePBDRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pbd := &PBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pbd.Load(c); err != nil {
+		return err
+	}
+
+	sr := &SRDescriptor{
+		SRRef: pbd.SR,
+	}
+	if err := sr.Query(c); err != nil {
+		return err
+	}
+
+	host := &HostDescriptor{
+		HostRef: pbd.Host,
+	}
+	if err := host.Query(c); err != nil {
+		return err
+	}
+
+	if err := d.Set(pbdSchemaSRUUID, sr.UUID); err != nil {
+		return err
+	}
+
+	if err := d.Set(pbdSchemaHostUUID, host.UUID); err != nil {
+		return err
+	}
+
+	// Only configured keys are tracked, XAPI and storage managers add their own
+	deviceConfig := filterManagedMap(pbd.DeviceConfig, d.Get(pbdSchemaDeviceConfig).(map[string]interface{}))
+	if err := d.Set(pbdSchemaDeviceConfig, deviceConfig); err != nil {
+		return err
+	}
+
+	if err := d.Set(pbdSchemaPlugged, pbd.CurrentlyAttached); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourcePBDUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pbd := &PBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pbd.Load(c); err != nil {
+		return err
+	}
+
+	if d.HasChange(pbdSchemaPlugged) {
+		if err := setPBDPlugged(c, pbd, d.Get(pbdSchemaPlugged).(bool)); err != nil {
+			return err
+		}
+	}
+
+	return resourcePBDRead(d, m)
+}
+
+func resourcePBDDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pbd := &PBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pbd.Load(c); err != nil {
+		return err
+	}
+
+	if err := setPBDPlugged(c, pbd, false); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Destroying PBD %s", pbd.UUID)
+	if err := c.client.PBD.Destroy(c.session, pbd.PBDRef); err != nil {
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourcePBDExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	pbd := &PBDDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := pbd.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,379 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	pifIPSchemaPIFUUID        = "pif_uuid"
+	pifIPSchemaMode           = "mode"
+	pifIPSchemaIP             = "ip"
+	pifIPSchemaNetmask        = "netmask"
+	pifIPSchemaGateway        = "gateway"
+	pifIPSchemaDNS            = "dns"
+	pifIPSchemaDevice         = "device"
+	pifIPSchemaManagement     = "management"
+	pifIPSchemaDisallowUnplug = "disallow_unplug"
+	pifIPSchemaPurpose        = "purpose"
+)
+
+const (
+	pifPurposeStorage   = "storage"
+	pifPurposeMigration = "migration"
+)
+
+// other_config key XenCenter uses to name the traffic a secondary interface is dedicated to
+const pifOtherConfigManagementPurpose = "management_purpose"
+
+var pifPurposes = map[string]string{
+	pifPurposeStorage:   "Storage",
+	pifPurposeMigration: "Migration",
+}
+
+const (
+	pifIPModeNone   = "none"
+	pifIPModeDHCP   = "dhcp"
+	pifIPModeStatic = "static"
+)
+
+var pifIPModes = map[string]xenAPI.IPConfigurationMode{
+	pifIPModeNone:   xenAPI.IPConfigurationModeNone,
+	pifIPModeDHCP:   xenAPI.IPConfigurationModeDHCP,
+	pifIPModeStatic: xenAPI.IPConfigurationModeStatic,
+}
+
+func resourcePIFIP() *schema.Resource {
+	return &schema.Resource{
+		Create: resourcePIFIPCreate,
+		Read:   resourcePIFIPRead,
+		Update: resourcePIFIPUpdate,
+		Delete: resourcePIFIPDelete,
+		Exists: resourcePIFIPExists,
+
+		Schema: map[string]*schema.Schema{
+			pifIPSchemaPIFUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			pifIPSchemaMode: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ValidateFunc: validation.StringInSlice([]string{
+					pifIPModeNone,
+					pifIPModeDHCP,
+					pifIPModeStatic,
+				}, false),
+			},
+
+			// Addressing is reported by XAPI for DHCP interfaces
+			pifIPSchemaIP: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			pifIPSchemaNetmask: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			pifIPSchemaGateway: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			// Comma separated list of name servers, as XAPI stores it
+			pifIPSchemaDNS: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+
+			pifIPSchemaDisallowUnplug: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			pifIPSchemaPurpose: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: validation.StringInSlice([]string{
+					pifPurposeStorage,
+					pifPurposeMigration,
+				}, false),
+			},
+
+			pifIPSchemaDevice: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			pifIPSchemaManagement: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// Applies the configured addressing to the PIF. XAPI replugs the interface, so connections
+// through it are interrupted briefly.
+func reconfigurePIFIP(c *Connection, pif *PIFDescriptor, d *schema.ResourceData) error {
+	mode := d.Get(pifIPSchemaMode).(string)
+
+	var ip, netmask, gateway, dns string
+	if mode == pifIPModeStatic {
+		ip = d.Get(pifIPSchemaIP).(string)
+		netmask = d.Get(pifIPSchemaNetmask).(string)
+		gateway = d.Get(pifIPSchemaGateway).(string)
+		dns = d.Get(pifIPSchemaDNS).(string)
+
+		if ip == "" || netmask == "" {
+			return fmt.Errorf("%s mode requires %q and %q to be set", pifIPModeStatic, pifIPSchemaIP, pifIPSchemaNetmask)
+		}
+	}
+
+	if mode == pifIPModeNone && pif.Management {
+		return fmt.Errorf("PIF %s is the management interface of its host and needs an address", pif.UUID)
+	}
+
+	log.Printf("[DEBUG] Reconfiguring IP of PIF %s: %s %q/%q via %q", pif.UUID, mode, ip, netmask, gateway)
+
+	return c.client.PIF.ReconfigureIP(c.session, pif.PIFRef, pifIPModes[mode], ip, netmask, gateway, dns)
+}
+
+// Marks the PIF as dedicated to the traffic of the purpose, empty purpose removes the mark
+func updatePIFPurpose(c *Connection, pif *PIFDescriptor, purpose string) error {
+	current, ok := pif.OtherConfig[pifOtherConfigManagementPurpose]
+	if current == pifPurposes[purpose] {
+		return nil
+	}
+
+	if ok {
+		if err := c.client.PIF.RemoveFromOtherConfig(c.session, pif.PIFRef, pifOtherConfigManagementPurpose); err != nil {
+			return err
+		}
+	}
+
+	if purpose == "" {
+		return nil
+	}
+
+	log.Printf("[DEBUG] Dedicating PIF %s to %s traffic", pif.UUID, purpose)
+
+	return c.client.PIF.AddToOtherConfig(c.session, pif.PIFRef, pifOtherConfigManagementPurpose, pifPurposes[purpose])
+}
+
+func resourcePIFIPCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pif := &PIFDescriptor{
+		UUID: d.Get(pifIPSchemaPIFUUID).(string),
+	}
+	if err := pif.Load(c); err != nil {
+		return err
+	}
+
+	if err := reconfigurePIFIP(c, pif, d); err != nil {
+		log.Printf("[ERROR] Failed to reconfigure IP of PIF %s - %s", pif.UUID, err)
+		return err
+	}
+
+	d.SetId(pif.UUID)
+
+	if disallowUnplug := d.Get(pifIPSchemaDisallowUnplug).(bool); disallowUnplug != pif.DisallowUnplug {
+		if err := c.client.PIF.SetDisallowUnplug(c.session, pif.PIFRef, disallowUnplug); err != nil {
+			return err
+		}
+	}
+
+	if err := updatePIFPurpose(c, pif, d.Get(pifIPSchemaPurpose).(string)); err != nil {
+		return err
+	}
+
+	return resourcePIFIPRead(d, m)
+}
+
+func resourcePIFIPRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pif := &PIFDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pif.Load(c); err != nil {
+		return err
+	}
+
+	mode := pifIPModeNone
+	for k, v := range pifIPModes {
+		if v == pif.IPMode {
+			mode = k
+		}
+	}
+
+	if err := d.Set(pifIPSchemaPIFUUID, pif.UUID); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaMode, mode); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaIP, pif.IP); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaNetmask, pif.Netmask); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaGateway, pif.Gateway); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaDNS, pif.DNS); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaDevice, pif.Device); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaManagement, pif.Management); err != nil {
+		return err
+	}
+
+	if err := d.Set(pifIPSchemaDisallowUnplug, pif.DisallowUnplug); err != nil {
+		return err
+	}
+
+	purpose := ""
+	for k, v := range pifPurposes {
+		if pif.OtherConfig[pifOtherConfigManagementPurpose] == v {
+			purpose = k
+		}
+	}
+	if err := d.Set(pifIPSchemaPurpose, purpose); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourcePIFIPUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pif := &PIFDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pif.Load(c); err != nil {
+		return err
+	}
+
+	if d.HasChange(pifIPSchemaMode) || d.HasChange(pifIPSchemaIP) || d.HasChange(pifIPSchemaNetmask) ||
+		d.HasChange(pifIPSchemaGateway) || d.HasChange(pifIPSchemaDNS) {
+		if err := reconfigurePIFIP(c, pif, d); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(pifIPSchemaDisallowUnplug) {
+		if err := c.client.PIF.SetDisallowUnplug(c.session, pif.PIFRef, d.Get(pifIPSchemaDisallowUnplug).(bool)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(pifIPSchemaPurpose) {
+		if err := updatePIFPurpose(c, pif, d.Get(pifIPSchemaPurpose).(string)); err != nil {
+			return err
+		}
+	}
+
+	return resourcePIFIPRead(d, m)
+}
+
+// Removes the addressing and designation from the PIF. The management interface keeps its address,
+// as the host would become unreachable otherwise.
+func resourcePIFIPDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pif := &PIFDescriptor{
+		UUID: d.Id(),
+	}
+	if err := pif.Load(c); err != nil {
+		return err
+	}
+
+	if err := updatePIFPurpose(c, pif, ""); err != nil {
+		return err
+	}
+
+	if pif.DisallowUnplug {
+		if err := c.client.PIF.SetDisallowUnplug(c.session, pif.PIFRef, false); err != nil {
+			return err
+		}
+	}
+
+	if pif.Management {
+		log.Printf("[WARN] PIF %s is the management interface, keeping its IP configuration", pif.UUID)
+	} else if pif.IPMode != xenAPI.IPConfigurationModeNone {
+		log.Printf("[DEBUG] Removing IP configuration of PIF %s", pif.UUID)
+		if err := c.client.PIF.ReconfigureIP(c.session, pif.PIFRef, xenAPI.IPConfigurationModeNone, "", "", "", ""); err != nil {
+			return err
+		}
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourcePIFIPExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	pif := &PIFDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := pif.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,174 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	poolDefaultSRSchemaDefault   = "default_sr_uuid"
+	poolDefaultSRSchemaSuspend   = "suspend_image_sr_uuid"
+	poolDefaultSRSchemaCrashDump = "crash_dump_sr_uuid"
+)
+
+func resourcePoolDefaultSR() *schema.Resource {
+	return &schema.Resource{
+		Create: resourcePoolDefaultSRCreate,
+		Read:   resourcePoolDefaultSRRead,
+		Update: resourcePoolDefaultSRUpdate,
+		Delete: resourcePoolDefaultSRDelete,
+
+		Schema: map[string]*schema.Schema{
+			poolDefaultSRSchemaDefault: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			// Left as configured in the pool when not set
+			poolDefaultSRSchemaSuspend: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+
+			poolDefaultSRSchemaCrashDump: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// Returns the UUID of the SR, or an empty string for a null reference
+func querySRUUID(c *Connection, srRef xenAPI.SRRef) (string, error) {
+	if srRef == "" || srRef == nullRef {
+		return "", nil
+	}
+
+	sr := &SRDescriptor{
+		SRRef: srRef,
+	}
+	if err := sr.Query(c); err != nil {
+		return "", err
+	}
+
+	return sr.UUID, nil
+}
+
+func updatePoolDefaultSRs(c *Connection, pool *PoolDescriptor, d *schema.ResourceData) error {
+	setters := map[string]func(xenAPI.SessionRef, xenAPI.PoolRef, xenAPI.SRRef) error{
+		poolDefaultSRSchemaDefault:   c.client.Pool.SetDefaultSR,
+		poolDefaultSRSchemaSuspend:   c.client.Pool.SetSuspendImageSR,
+		poolDefaultSRSchemaCrashDump: c.client.Pool.SetCrashDumpSR,
+	}
+
+	for key, set := range setters {
+		uuid, ok := d.GetOk(key)
+		if !ok || !d.HasChange(key) {
+			continue
+		}
+
+		sr := &SRDescriptor{
+			UUID: uuid.(string),
+		}
+		if err := sr.Load(c); err != nil {
+			return err
+		}
+
+		log.Printf("[DEBUG] Setting %s of pool %s to %s", key, pool.UUID, sr.UUID)
+		if err := set(c.session, pool.PoolRef, sr.SRRef); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourcePoolDefaultSRCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pool := &PoolDescriptor{}
+	if err := pool.Load(c); err != nil {
+		return err
+	}
+
+	if err := updatePoolDefaultSRs(c, pool, d); err != nil {
+		return err
+	}
+
+	d.SetId(pool.UUID)
+
+	return resourcePoolDefaultSRRead(d, m)
+}
+
+func resourcePoolDefaultSRRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pool := &PoolDescriptor{}
+	if err := pool.Load(c); err != nil {
+		return err
+	}
+
+	srs := map[string]xenAPI.SRRef{
+		poolDefaultSRSchemaDefault:   pool.DefaultSR,
+		poolDefaultSRSchemaSuspend:   pool.SuspendSR,
+		poolDefaultSRSchemaCrashDump: pool.CrashDumpSR,
+	}
+
+	for key, srRef := range srs {
+		uuid, err := querySRUUID(c, srRef)
+		if err != nil {
+			return err
+		}
+
+		if err = d.Set(key, uuid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourcePoolDefaultSRUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	pool := &PoolDescriptor{}
+	if err := pool.Load(c); err != nil {
+		return err
+	}
+
+	if err := updatePoolDefaultSRs(c, pool, d); err != nil {
+		return err
+	}
+
+	return resourcePoolDefaultSRRead(d, m)
+}
+
+// The pool needs its default SRs, so they are left in place when the resource is destroyed
+func resourcePoolDefaultSRDelete(d *schema.ResourceData, m interface{}) error {
+	log.Printf("[DEBUG] Leaving default SRs of pool %s in place", d.Id())
+
+	d.SetId("")
+	return nil
+}
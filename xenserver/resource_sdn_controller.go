@@ -0,0 +1,180 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	sdnControllerSchemaProtocol = "protocol"
+	sdnControllerSchemaAddress  = "address"
+	sdnControllerSchemaPort     = "port"
+)
+
+// Default port of OpenFlow controllers
+const sdnControllerDefaultPort = 6632
+
+// Connects the Open vSwitch of all hosts in the pool to an external SDN controller.
+// A pool has at most one controller.
+func resourceSDNController() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceSDNControllerCreate,
+		Read:   resourceSDNControllerRead,
+		Delete: resourceSDNControllerDelete,
+		Exists: resourceSDNControllerExists,
+
+		Schema: map[string]*schema.Schema{
+			sdnControllerSchemaProtocol: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				Default:  string(xenAPI.SdnControllerProtocolSsl),
+				ValidateFunc: validation.StringInSlice([]string{
+					string(xenAPI.SdnControllerProtocolSsl),
+					string(xenAPI.SdnControllerProtocolPssl),
+				}, false),
+			},
+
+			// Passive SSL lets the controller connect to the hosts, so it takes no address
+			sdnControllerSchemaAddress: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateIPv4,
+			},
+
+			sdnControllerSchemaPort: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      sdnControllerDefaultPort,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+		},
+	}
+}
+
+func resourceSDNControllerCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	protocol := xenAPI.SdnControllerProtocol(d.Get(sdnControllerSchemaProtocol).(string))
+	address := d.Get(sdnControllerSchemaAddress).(string)
+	port := d.Get(sdnControllerSchemaPort).(int)
+
+	if protocol == xenAPI.SdnControllerProtocolSsl && address == "" {
+		return fmt.Errorf("%q is required for %s controllers", sdnControllerSchemaAddress, protocol)
+	}
+	if protocol == xenAPI.SdnControllerProtocolPssl && address != "" {
+		return fmt.Errorf("%q is not supported by %s controllers", sdnControllerSchemaAddress, protocol)
+	}
+
+	existing, err := c.client.SDNController.GetAll(c.session)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("pool is already connected to an SDN controller")
+	}
+
+	log.Printf("[DEBUG] Introducing %s SDN controller %s:%d", protocol, address, port)
+
+	controllerRef, err := c.client.SDNController.Introduce(c.session, protocol, address, port)
+	if err != nil {
+		log.Printf("[ERROR] Failed to introduce SDN controller - %s", err)
+		return err
+	}
+
+	controller, err := c.client.SDNController.GetRecord(c.session, controllerRef)
+	if err != nil {
+		return err
+	}
+
+	d.SetId(controller.UUID)
+
+	return resourceSDNControllerRead(d, m)
+}
+
+func resourceSDNControllerRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	controllerRef, err := c.client.SDNController.GetByUUID(c.session, d.Id())
+	if err != nil {
+		return err
+	}
+
+	controller, err := c.client.SDNController.GetRecord(c.session, controllerRef)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Set(sdnControllerSchemaProtocol, string(controller.Protocol)); err != nil {
+		return err
+	}
+
+	if err := d.Set(sdnControllerSchemaAddress, controller.Address); err != nil {
+		return err
+	}
+
+	if err := d.Set(sdnControllerSchemaPort, controller.Port); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Forgetting the controller detaches the switches of all hosts from it
+func resourceSDNControllerDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	controllerRef, err := c.client.SDNController.GetByUUID(c.session, d.Id())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Forgetting SDN controller %s", d.Id())
+	if err = c.client.SDNController.Forget(c.session, controllerRef); err != nil {
+		log.Printf("[ERROR] Failed to forget SDN controller %s - %s", d.Id(), err)
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceSDNControllerExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	if _, err := c.client.SDNController.GetByUUID(c.session, d.Id()); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -18,7 +18,1602 @@
  */
 package xenserver
 
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	srSchemaUUID        = "uuid"
+	srSchemaName        = "name_label"
+	srSchemaDescription = "description"
+	srSchemaContentType = "content_type"
+	srSchemaType        = "type"
+	srSchemaShared      = "shared"
+	srSchemaNFS         = "nfs"
+	srSchemaISCSI       = "iscsi"
+	srSchemaSMB         = "smb"
+	srSchemaLocal       = "local"
+	srSchemaGFS2        = "gfs2"
+	srSchemaHBA         = "hba"
+
+	srSchemaIntroduceExisting = "introduce_existing"
+	srSchemaDestroyMode       = "destroy_mode"
+	srSchemaPlugged           = "plugged"
+	srSchemaReplugOnRefresh   = "replug_on_refresh"
+	srSchemaTags              = "tags"
+	srSchemaOtherConfig       = "other_config"
+	srSchemaScanTrigger       = "scan_trigger"
+	srSchemaTrimTrigger       = "trim_trigger"
+
+	srSchemaPhysicalSize        = "physical_size"
+	srSchemaPhysicalUtilisation = "physical_utilisation"
+	srSchemaVirtualAllocation   = "virtual_allocation"
+)
+
+const (
+	srNFSSchemaServer     = "server"
+	srNFSSchemaServerPath = "server_path"
+	srNFSSchemaVersion    = "nfs_version"
+	srNFSSchemaOptions    = "options"
+)
+
+const (
+	srISCSISchemaTarget       = "target"
+	srISCSISchemaPort         = "port"
+	srISCSISchemaTargetIQN    = "target_iqn"
+	srISCSISchemaLUN          = "lun_id"
+	srISCSISchemaSCSIID       = "scsi_id"
+	srISCSISchemaChapUser     = "chap_user"
+	srISCSISchemaChapPassword = "chap_password"
+	srISCSISchemaMultipath    = "multipath"
+)
+
+const (
+	srSMBSchemaServer   = "server"
+	srSMBSchemaShare    = "share"
+	srSMBSchemaUsername = "username"
+	srSMBSchemaPassword = "password"
+)
+
+const (
+	srLocalSchemaHostUUID = "host_uuid"
+	srLocalSchemaDevice   = "device"
+	srLocalSchemaType     = "type"
+)
+
+const (
+	srGFS2SchemaProvider     = "provider"
+	srGFS2SchemaTarget       = "target"
+	srGFS2SchemaPort         = "port"
+	srGFS2SchemaTargetIQN    = "target_iqn"
+	srGFS2SchemaLUN          = "lun_id"
+	srGFS2SchemaSCSIID       = "scsi_id"
+	srGFS2SchemaChapUser     = "chap_user"
+	srGFS2SchemaChapPassword = "chap_password"
+)
+
+const (
+	srHBASchemaTransport = "transport"
+	srHBASchemaLUN       = "lun_id"
+	srHBASchemaSCSIID    = "scsi_id"
+	srHBASchemaMultipath = "multipath"
+)
+
+const (
+	srHBATransportFC   = "fc"
+	srHBATransportFCoE = "fcoe"
+)
+
+const (
+	srGFS2ProviderISCSI = "iscsi"
+	srGFS2ProviderHBA   = "hba"
+)
+
 const (
-	srSchemaUUID = "uuid"
-	srSchemaName = "name_label"
+	srTypeNFS   = "nfs"
+	srTypeISCSI = "lvmoiscsi"
+	srTypeSMB   = "smb"
+	srTypeEXT   = "ext"
+	srTypeLVM   = "lvm"
+	srTypeGFS2  = "gfs2"
+	srTypeHBA   = "lvmohba"
+	srTypeFCoE  = "lvmofcoe"
 )
+
+const (
+	srDestroyModeDestroy        = "destroy"
+	srDestroyModeForget         = "forget"
+	srDestroyModeForgetNonEmpty = "forget_if_not_empty"
+)
+
+// Blocks describing the storage of the SR, only one of them can be set
+var srStorageSchemas = []string{srSchemaNFS, srSchemaISCSI, srSchemaSMB, srSchemaLocal, srSchemaGFS2, srSchemaHBA}
+
+// device_config keys of NFS SRs
+const (
+	srDeviceConfigServer     = "server"
+	srDeviceConfigServerPath = "serverpath"
+	srDeviceConfigNFSVersion = "nfsversion"
+	srDeviceConfigOptions    = "options"
+)
+
+// device_config keys of iSCSI SRs
+const (
+	srDeviceConfigTarget             = "target"
+	srDeviceConfigPort               = "port"
+	srDeviceConfigTargetIQN          = "targetIQN"
+	srDeviceConfigSCSIID             = "SCSIid"
+	srDeviceConfigChapUser           = "chapuser"
+	srDeviceConfigChapPassword       = "chappassword"
+	srDeviceConfigChapPasswordSecret = "chappassword_secret"
+)
+
+// device_config keys of SMB SRs, the server key is shared with NFS
+const (
+	srDeviceConfigUsername       = "username"
+	srDeviceConfigPassword       = "password"
+	srDeviceConfigPasswordSecret = "password_secret"
+)
+
+// device_config key of local SRs
+const srDeviceConfigDevice = "device"
+
+// device_config key selecting the block storage of GFS2 SRs, the others are shared with iSCSI
+const srDeviceConfigProvider = "provider"
+
+// Host other_config keys enabling multipathed block storage
+const (
+	hostOtherConfigMultipathing    = "multipathing"
+	hostOtherConfigMultipathHandle = "multipathhandle"
+)
+
+// Key in SR's other_config listing the hosts the provider enabled multipathing on, together
+// with their previous setting, as comma separated uuid=value pairs
+const srOtherConfigMultipathHosts = "terraform_multipath_hosts"
+
+// device_config keys of passwords and the keys of the XAPI secrets replacing them
+var srDeviceConfigSecrets = map[string]string{
+	srDeviceConfigPassword:     srDeviceConfigPasswordSecret,
+	srDeviceConfigChapPassword: srDeviceConfigChapPasswordSecret,
+}
+
+func resourceSR() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceSRCreate,
+		Read:   resourceSRRead,
+		Delete: resourceSRDelete,
+		Update: resourceSRUpdate,
+		Exists: resourceSRExists,
+
+		Schema: map[string]*schema.Schema{
+			// UUID of the existing SR to introduce, assigned by XAPI otherwise
+			srSchemaUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
+
+			srSchemaIntroduceExisting: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+				Default:  false,
+			},
+
+			// Defaults to forget for introduced SRs, so shared data is never wiped
+			srSchemaDestroyMode: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{srDestroyModeDestroy, srDestroyModeForget, srDestroyModeForgetNonEmpty}, false),
+			},
+
+			// All PBDs of the SR are plugged, unplugged ones show up as drift
+			srSchemaPlugged: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+
+			srSchemaReplugOnRefresh: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			srSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			srSchemaDescription: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			srSchemaContentType: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				Default:  "user",
+			},
+
+			srSchemaTags: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+
+			srSchemaOtherConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			// Any change of the triggers runs the operation on apply
+			srSchemaScanTrigger: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			srSchemaTrimTrigger: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			srSchemaNFS: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaNFS),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srNFSSchemaServer: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srNFSSchemaServerPath: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srNFSSchemaVersion: &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      "3",
+							ValidateFunc: validation.StringInSlice([]string{"3", "4", "4.1"}, false),
+						},
+						// Extra mount options, e.g. "hard,timeo=600"
+						srNFSSchemaOptions: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+					},
+				},
+			},
+
+			srSchemaISCSI: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaISCSI),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srISCSISchemaTarget: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srISCSISchemaPort: &schema.Schema{
+							Type:     schema.TypeInt,
+							Optional: true,
+							ForceNew: true,
+							Default:  3260,
+						},
+						// Discovered on the target when it offers a single IQN
+						srISCSISchemaTargetIQN: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+						srISCSISchemaLUN: &schema.Schema{
+							Type:     schema.TypeInt,
+							Optional: true,
+							ForceNew: true,
+							Default:  -1,
+						},
+						// Discovered from the LUN, or the only LUN of the target
+						srISCSISchemaSCSIID: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+						srISCSISchemaChapUser: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+						srISCSISchemaChapPassword: &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							ForceNew:  true,
+							Sensitive: true,
+						},
+						srISCSISchemaMultipath: &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							ForceNew: true,
+							Default:  false,
+						},
+					},
+				},
+			},
+
+			srSchemaSMB: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaSMB),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srSMBSchemaServer: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srSMBSchemaShare: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srSMBSchemaUsername: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+						srSMBSchemaPassword: &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							ForceNew:  true,
+							Sensitive: true,
+						},
+					},
+				},
+			},
+
+			srSchemaLocal: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaLocal),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srLocalSchemaHostUUID: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srLocalSchemaDevice: &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						srLocalSchemaType: &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      srTypeEXT,
+							ValidateFunc: validation.StringInSlice([]string{srTypeEXT, srTypeLVM}, false),
+						},
+					},
+				},
+			},
+
+			srSchemaGFS2: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaGFS2),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srGFS2SchemaProvider: &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      srGFS2ProviderISCSI,
+							ValidateFunc: validation.StringInSlice([]string{srGFS2ProviderISCSI, srGFS2ProviderHBA}, false),
+						},
+						srGFS2SchemaTarget: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+						srGFS2SchemaPort: &schema.Schema{
+							Type:     schema.TypeInt,
+							Optional: true,
+							ForceNew: true,
+							Default:  3260,
+						},
+						srGFS2SchemaTargetIQN: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+						srGFS2SchemaLUN: &schema.Schema{
+							Type:     schema.TypeInt,
+							Optional: true,
+							ForceNew: true,
+							Default:  -1,
+						},
+						srGFS2SchemaSCSIID: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+						srGFS2SchemaChapUser: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+						},
+						srGFS2SchemaChapPassword: &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							ForceNew:  true,
+							Sensitive: true,
+						},
+					},
+				},
+			},
+
+			srSchemaHBA: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				ConflictsWith: srStorageConflicts(srSchemaHBA),
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						srHBASchemaTransport: &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ForceNew:     true,
+							Default:      srHBATransportFC,
+							ValidateFunc: validation.StringInSlice([]string{srHBATransportFC, srHBATransportFCoE}, false),
+						},
+						srHBASchemaLUN: &schema.Schema{
+							Type:     schema.TypeInt,
+							Optional: true,
+							ForceNew: true,
+							Default:  -1,
+						},
+						// Discovered from the LUN, or the only LUN visible to the host
+						srHBASchemaSCSIID: &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+							ForceNew: true,
+						},
+						srHBASchemaMultipath: &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							ForceNew: true,
+							Default:  false,
+						},
+					},
+				},
+			},
+
+			srSchemaType: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			srSchemaShared: &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			srSchemaPhysicalSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			srSchemaPhysicalUtilisation: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			// Sum of the virtual sizes of all disks, exceeds the physical size on thin provisioned SRs
+			srSchemaVirtualAllocation: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// Returns the storage blocks conflicting with the given one
+func srStorageConflicts(name string) []string {
+	conflicts := make([]string, 0, len(srStorageSchemas)-1)
+	for _, storage := range srStorageSchemas {
+		if storage != name {
+			conflicts = append(conflicts, storage)
+		}
+	}
+
+	return conflicts
+}
+
+// Returns the SR type and the device_config for the storage block of the configuration
+func readSRDeviceConfig(d *schema.ResourceData) (string, bool, map[string]string, error) {
+	deviceConfig := make(map[string]string)
+
+	if nfs, ok := d.GetOk(srSchemaNFS); ok {
+		data := nfs.([]interface{})[0].(map[string]interface{})
+
+		deviceConfig[srDeviceConfigServer] = data[srNFSSchemaServer].(string)
+		deviceConfig[srDeviceConfigServerPath] = data[srNFSSchemaServerPath].(string)
+		deviceConfig[srDeviceConfigNFSVersion] = data[srNFSSchemaVersion].(string)
+		if options := data[srNFSSchemaOptions].(string); options != "" {
+			deviceConfig[srDeviceConfigOptions] = options
+		}
+
+		return srTypeNFS, true, deviceConfig, nil
+	}
+
+	if iscsi, ok := d.GetOk(srSchemaISCSI); ok {
+		data := iscsi.([]interface{})[0].(map[string]interface{})
+
+		deviceConfig[srDeviceConfigTarget] = data[srISCSISchemaTarget].(string)
+		deviceConfig[srDeviceConfigPort] = strconv.Itoa(data[srISCSISchemaPort].(int))
+		if iqn := data[srISCSISchemaTargetIQN].(string); iqn != "" {
+			deviceConfig[srDeviceConfigTargetIQN] = iqn
+		}
+		if scsiID := data[srISCSISchemaSCSIID].(string); scsiID != "" {
+			deviceConfig[srDeviceConfigSCSIID] = scsiID
+		}
+		if user := data[srISCSISchemaChapUser].(string); user != "" {
+			deviceConfig[srDeviceConfigChapUser] = user
+			deviceConfig[srDeviceConfigChapPassword] = data[srISCSISchemaChapPassword].(string)
+		}
+
+		return srTypeISCSI, true, deviceConfig, nil
+	}
+
+	if smb, ok := d.GetOk(srSchemaSMB); ok {
+		data := smb.([]interface{})[0].(map[string]interface{})
+
+		deviceConfig[srDeviceConfigServer] = fmt.Sprintf("//%s/%s", data[srSMBSchemaServer].(string), strings.Trim(data[srSMBSchemaShare].(string), "/"))
+		if username := data[srSMBSchemaUsername].(string); username != "" {
+			deviceConfig[srDeviceConfigUsername] = username
+			deviceConfig[srDeviceConfigPassword] = data[srSMBSchemaPassword].(string)
+		}
+
+		return srTypeSMB, true, deviceConfig, nil
+	}
+
+	if local, ok := d.GetOk(srSchemaLocal); ok {
+		data := local.([]interface{})[0].(map[string]interface{})
+
+		deviceConfig[srDeviceConfigDevice] = data[srLocalSchemaDevice].(string)
+
+		return data[srLocalSchemaType].(string), false, deviceConfig, nil
+	}
+
+	if gfs2, ok := d.GetOk(srSchemaGFS2); ok {
+		data := gfs2.([]interface{})[0].(map[string]interface{})
+
+		provider := data[srGFS2SchemaProvider].(string)
+		deviceConfig[srDeviceConfigProvider] = provider
+		if scsiID := data[srGFS2SchemaSCSIID].(string); scsiID != "" {
+			deviceConfig[srDeviceConfigSCSIID] = scsiID
+		}
+
+		switch provider {
+		case srGFS2ProviderISCSI:
+			target := data[srGFS2SchemaTarget].(string)
+			if target == "" {
+				return "", false, nil, fmt.Errorf("%q is required for %q provider", srGFS2SchemaTarget, provider)
+			}
+
+			deviceConfig[srDeviceConfigTarget] = target
+			deviceConfig[srDeviceConfigPort] = strconv.Itoa(data[srGFS2SchemaPort].(int))
+			if iqn := data[srGFS2SchemaTargetIQN].(string); iqn != "" {
+				deviceConfig[srDeviceConfigTargetIQN] = iqn
+			}
+			if user := data[srGFS2SchemaChapUser].(string); user != "" {
+				deviceConfig[srDeviceConfigChapUser] = user
+				deviceConfig[srDeviceConfigChapPassword] = data[srGFS2SchemaChapPassword].(string)
+			}
+		case srGFS2ProviderHBA:
+			if _, ok := deviceConfig[srDeviceConfigSCSIID]; !ok {
+				return "", false, nil, fmt.Errorf("%q is required for %q provider", srGFS2SchemaSCSIID, provider)
+			}
+		}
+
+		return srTypeGFS2, true, deviceConfig, nil
+	}
+
+	if hba, ok := d.GetOk(srSchemaHBA); ok {
+		data := hba.([]interface{})[0].(map[string]interface{})
+
+		if scsiID := data[srHBASchemaSCSIID].(string); scsiID != "" {
+			deviceConfig[srDeviceConfigSCSIID] = scsiID
+		}
+
+		if data[srHBASchemaTransport].(string) == srHBATransportFCoE {
+			return srTypeFCoE, true, deviceConfig, nil
+		}
+		return srTypeHBA, true, deviceConfig, nil
+	}
+
+	return "", false, nil, fmt.Errorf("one of %q must be set", srStorageSchemas)
+}
+
+// Moves the passwords of the device_config into XAPI secrets, so they are not readable from the PBDs
+func storeSRSecrets(c *Connection, deviceConfig map[string]string) error {
+	for key, secretKey := range srDeviceConfigSecrets {
+		password, ok := deviceConfig[key]
+		if !ok {
+			continue
+		}
+
+		secretRef, err := c.client.Secret.Create(c.session, xenAPI.SecretRecord{
+			Value:       password,
+			OtherConfig: map[string]string{},
+		})
+		if err != nil {
+			return err
+		}
+
+		uuid, err := c.client.Secret.GetUUID(c.session, secretRef)
+		if err != nil {
+			return err
+		}
+
+		delete(deviceConfig, key)
+		deviceConfig[secretKey] = uuid
+	}
+
+	return nil
+}
+
+// Destroys the secrets referenced by the device_config, if any
+func destroySRSecrets(c *Connection, deviceConfig map[string]string) error {
+	for _, secretKey := range srDeviceConfigSecrets {
+		uuid, ok := deviceConfig[secretKey]
+		if !ok {
+			continue
+		}
+
+		secretRef, err := c.client.Secret.GetByUUID(c.session, uuid)
+		if err != nil {
+			if xenErr, ok := err.(*xenAPI.Error); ok && xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				continue
+			}
+			return err
+		}
+
+		log.Printf("[DEBUG] Destroying secret %s", uuid)
+		if err = c.client.Secret.Destroy(c.session, secretRef); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fills in the storage details the configuration leaves to discovery
+func discoverSRDeviceConfig(c *Connection, d *schema.ResourceData, host xenAPI.HostRef, srType string, deviceConfig map[string]string) error {
+	switch srType {
+	case srTypeISCSI:
+		data := d.Get(srSchemaISCSI).([]interface{})[0].(map[string]interface{})
+		return discoverISCSI(c, host, deviceConfig, data[srISCSISchemaLUN].(int))
+	case srTypeGFS2:
+		data := d.Get(srSchemaGFS2).([]interface{})[0].(map[string]interface{})
+		if deviceConfig[srDeviceConfigProvider] == srGFS2ProviderISCSI {
+			return discoverISCSI(c, host, deviceConfig, data[srGFS2SchemaLUN].(int))
+		}
+	case srTypeHBA, srTypeFCoE:
+		data := d.Get(srSchemaHBA).([]interface{})[0].(map[string]interface{})
+		return discoverHBA(c, host, srType, deviceConfig, data[srHBASchemaLUN].(int))
+	}
+
+	return nil
+}
+
+// Checks the pool can host GFS2 SRs, which need a licensed and clustered pool
+func checkGFS2Support(c *Connection, pool *PoolDescriptor) error {
+	if pool.Restrictions["restrict_corosync"] == "true" {
+		return fmt.Errorf("pool %q does not allow clustering required by %s SRs", pool.Name, srTypeGFS2)
+	}
+
+	clusters, err := c.client.Cluster.GetAll(c.session)
+	if err != nil {
+		return err
+	}
+
+	if len(clusters) == 0 {
+		return fmt.Errorf("pool %q must be clustered to create %s SRs", pool.Name, srTypeGFS2)
+	}
+
+	sms, err := c.client.SM.GetAllRecords(c.session)
+	if err != nil {
+		return err
+	}
+
+	for _, sm := range sms {
+		if sm.Type == srTypeGFS2 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("pool %q has no storage manager for %s SRs", pool.Name, srTypeGFS2)
+}
+
+// Returns whether the block storage of the configuration asks for multipathing
+func readSRMultipath(d *schema.ResourceData) bool {
+	if iscsi, ok := d.GetOk(srSchemaISCSI); ok {
+		return iscsi.([]interface{})[0].(map[string]interface{})[srISCSISchemaMultipath].(bool)
+	}
+
+	if hba, ok := d.GetOk(srSchemaHBA); ok {
+		return hba.([]interface{})[0].(map[string]interface{})[srHBASchemaMultipath].(bool)
+	}
+
+	return false
+}
+
+// Turns on multipathing of block storage on all hosts of the pool. Hosts only pick the setting up
+// for storage attached afterwards. Returns the changed hosts in the format of srOtherConfigMultipathHosts.
+func enableMultipathing(c *Connection) (string, error) {
+	hosts, err := c.client.Host.GetAllRecords(c.session)
+	if err != nil {
+		return "", err
+	}
+
+	changed := make([]string, 0)
+	for hostRef, host := range hosts {
+		if host.OtherConfig[hostOtherConfigMultipathing] == "true" {
+			continue
+		}
+
+		log.Printf("[DEBUG] Enabling multipathing on host %s", host.NameLabel)
+		for k, v := range map[string]string{hostOtherConfigMultipathing: "true", hostOtherConfigMultipathHandle: "dmp"} {
+			if _, ok := host.OtherConfig[k]; ok {
+				if err = c.client.Host.RemoveFromOtherConfig(c.session, hostRef, k); err != nil {
+					return strings.Join(changed, ","), err
+				}
+			}
+			if err = c.client.Host.AddToOtherConfig(c.session, hostRef, k, v); err != nil {
+				return strings.Join(changed, ","), err
+			}
+		}
+
+		changed = append(changed, fmt.Sprintf("%s=%s", host.UUID, host.OtherConfig[hostOtherConfigMultipathing]))
+	}
+
+	return strings.Join(changed, ","), nil
+}
+
+// Restores the multipathing setting of the hosts enabled by enableMultipathing
+func restoreMultipathing(c *Connection, hosts string) error {
+	for _, entry := range strings.Split(hosts, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		hostRef, err := c.client.Host.GetByUUID(c.session, parts[0])
+		if err != nil {
+			if xenErr, ok := err.(*xenAPI.Error); ok && xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				continue
+			}
+			return err
+		}
+
+		log.Printf("[DEBUG] Restoring multipathing on host %s", parts[0])
+		if err = c.client.Host.RemoveFromOtherConfig(c.session, hostRef, hostOtherConfigMultipathing); err != nil {
+			return err
+		}
+		if parts[1] != "" {
+			if err = c.client.Host.AddToOtherConfig(c.session, hostRef, hostOtherConfigMultipathing, parts[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Hands the hosts the removed SR enabled multipathing on over to another multipathed SR, or
+// restores them once the last one is gone
+func releaseMultipathing(c *Connection, sr *SRDescriptor, hosts string) error {
+	srs, err := c.client.SR.GetAllRecords(c.session)
+	if err != nil {
+		return err
+	}
+
+	for srRef, record := range srs {
+		others, ok := record.OtherConfig[srOtherConfigMultipathHosts]
+		if !ok || srRef == sr.SRRef {
+			continue
+		}
+
+		if hosts == "" {
+			return nil
+		}
+		if others != "" {
+			hosts = others + "," + hosts
+		}
+
+		log.Printf("[DEBUG] SR %s keeps multipathing enabled", record.UUID)
+		if err = c.client.SR.RemoveFromOtherConfig(c.session, srRef, srOtherConfigMultipathHosts); err != nil {
+			return err
+		}
+		return c.client.SR.AddToOtherConfig(c.session, srRef, srOtherConfigMultipathHosts, hosts)
+	}
+
+	return restoreMultipathing(c, hosts)
+}
+
+// Makes sure every given host has a plugged PBD for the SR, creating missing ones with the device_config
+func attachSR(c *Connection, sr *SRDescriptor, hosts []xenAPI.HostRef, deviceConfig map[string]string) error {
+	err := sr.Query(c)
+	if err != nil {
+		return err
+	}
+
+	pbds := make(map[xenAPI.HostRef]*PBDDescriptor)
+	for _, pbdRef := range sr.PBDs {
+		pbd := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err = pbd.Query(c); err != nil {
+			return err
+		}
+		pbds[pbd.Host] = pbd
+	}
+
+	for _, host := range hosts {
+		pbd, ok := pbds[host]
+		if !ok {
+			log.Printf("[DEBUG] Creating PBD of SR %s on host %s", sr.UUID, host)
+			pbdRef, err := c.client.PBD.Create(c.session, xenAPI.PBDRecord{
+				Host:         host,
+				SR:           sr.SRRef,
+				DeviceConfig: deviceConfig,
+			})
+			if err != nil {
+				return err
+			}
+
+			pbd = &PBDDescriptor{
+				PBDRef: pbdRef,
+			}
+			if err = pbd.Query(c); err != nil {
+				return err
+			}
+		}
+
+		if pbd.CurrentlyAttached {
+			continue
+		}
+
+		log.Printf("[DEBUG] Plugging PBD %s of SR %s", pbd.UUID, sr.UUID)
+		if err = c.client.PBD.Plug(c.session, pbd.PBDRef); err != nil {
+			return err
+		}
+	}
+
+	return sr.Query(c)
+}
+
+// Unplugs the PBDs of the SR on all hosts
+func detachSR(c *Connection, sr *SRDescriptor) error {
+	for _, pbdRef := range sr.PBDs {
+		pbd := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+
+		if !pbd.CurrentlyAttached {
+			continue
+		}
+
+		log.Printf("[DEBUG] Unplugging PBD %s of SR %s", pbd.UUID, sr.UUID)
+		if err := c.client.PBD.Unplug(c.session, pbd.PBDRef); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Plugs the existing PBDs of the SR on all hosts
+func plugSR(c *Connection, sr *SRDescriptor) error {
+	for _, pbdRef := range sr.PBDs {
+		pbd := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+
+		if err := setPBDPlugged(c, pbd, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rescans the SR, so disks placed on the storage outside of XAPI show up and sizes are updated
+func scanSR(c *Connection, sr *SRDescriptor) error {
+	log.Printf("[DEBUG] Scanning SR %s", sr.UUID)
+	return c.client.SR.Scan(c.session, sr.SRRef)
+}
+
+// Reclaims the space freed by destroyed disks on thin provisioned block storage.
+// The trim plugin runs on a host the SR is plugged on.
+func trimSR(c *Connection, sr *SRDescriptor) error {
+	for _, pbdRef := range sr.PBDs {
+		pbd := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+
+		if !pbd.CurrentlyAttached {
+			continue
+		}
+
+		log.Printf("[DEBUG] Trimming SR %s on host %s", sr.UUID, pbd.Host)
+		result, err := c.client.Host.CallPlugin(c.session, pbd.Host, "trim", "do_trim", map[string]string{"sr_uuid": sr.UUID})
+		if err != nil {
+			return err
+		}
+
+		// Failures are reported as XML describing the error
+		if result != "True" {
+			return fmt.Errorf("failed to trim SR %s - %s", sr.UUID, result)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("SR %s is not plugged on any host, it can not be trimmed", sr.UUID)
+}
+
+// Returns descriptions of the disks remaining on the SR and of those attached to running VMs,
+// which prevent unplugging the SR
+func querySRVDIs(c *Connection, sr *SRDescriptor) ([]string, []string, error) {
+	vdiRefs, err := c.client.SR.GetVDIs(c.session, sr.SRRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remaining := make([]string, 0, len(vdiRefs))
+	attached := make([]string, 0)
+	for _, vdiRef := range vdiRefs {
+		vdi, err := c.client.VDI.GetRecord(c.session, vdiRef)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		description := fmt.Sprintf("%q (%s)", vdi.NameLabel, vdi.UUID)
+		remaining = append(remaining, description)
+
+		vbdRefs, err := c.client.VDI.GetVBDs(c.session, vdiRef)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, vbdRef := range vbdRefs {
+			vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !vbd.CurrentlyAttached {
+				continue
+			}
+
+			vm, err := c.client.VM.GetRecord(c.session, vbd.VM)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			attached = append(attached, fmt.Sprintf("%s used by VM %q", description, vm.NameLabel))
+		}
+	}
+
+	return remaining, attached, nil
+}
+
+func resourceSRCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	srType, shared, deviceConfig, err := readSRDeviceConfig(d)
+	if err != nil {
+		return err
+	}
+
+	pool := &PoolDescriptor{}
+	if err = pool.Load(c); err != nil {
+		return err
+	}
+
+	if srType == srTypeGFS2 {
+		if err = checkGFS2Support(c, pool); err != nil {
+			return err
+		}
+	}
+
+	// Shared SRs are created from the master, local ones on the host owning the device
+	host := pool.Master
+	if local, ok := d.GetOk(srSchemaLocal); ok {
+		localHost := &HostDescriptor{
+			UUID: local.([]interface{})[0].(map[string]interface{})[srLocalSchemaHostUUID].(string),
+		}
+		if err = localHost.Load(c); err != nil {
+			return err
+		}
+		host = localHost.HostRef
+	}
+
+	if err = discoverSRDeviceConfig(c, d, host, srType, deviceConfig); err != nil {
+		return err
+	}
+
+	multipathHosts, multipath := "", readSRMultipath(d)
+	if multipath {
+		if multipathHosts, err = enableMultipathing(c); err != nil {
+			if restoreErr := restoreMultipathing(c, multipathHosts); restoreErr != nil {
+				log.Printf("[ERROR] Failed to restore multipathing - %s", restoreErr)
+			}
+			return err
+		}
+	}
+
+	if err = storeSRSecrets(c, deviceConfig); err != nil {
+		return err
+	}
+
+	name := d.Get(srSchemaName).(string)
+	introduce := d.Get(srSchemaIntroduceExisting).(bool)
+
+	var srRef xenAPI.SRRef
+	if introduce {
+		srRef, err = introduceSR(c, d, srType, shared)
+	} else {
+		log.Printf("[DEBUG] Creating %s SR %q", srType, name)
+
+		// XAPI creates and plugs the PBDs of shared SRs on all hosts of the pool
+		srRef, err = c.client.SR.Create(c.session, host, deviceConfig, 0, name,
+			d.Get(srSchemaDescription).(string), srType, d.Get(srSchemaContentType).(string), shared, map[string]string{})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to create SR %q - %s", name, err)
+		if secretErr := destroySRSecrets(c, deviceConfig); secretErr != nil {
+			log.Printf("[ERROR] Failed to destroy secret of SR %q - %s", name, secretErr)
+		}
+		if multipath {
+			if restoreErr := releaseMultipathing(c, &SRDescriptor{}, multipathHosts); restoreErr != nil {
+				log.Printf("[ERROR] Failed to restore multipathing - %s", restoreErr)
+			}
+		}
+		return err
+	}
+
+	sr := &SRDescriptor{
+		SRRef: srRef,
+	}
+	if err = sr.Query(c); err != nil {
+		return err
+	}
+
+	d.SetId(sr.UUID)
+
+	if _, ok := d.GetOk(srSchemaDestroyMode); !ok {
+		destroyMode := srDestroyModeDestroy
+		if introduce {
+			destroyMode = srDestroyModeForget
+		}
+		if err = d.Set(srSchemaDestroyMode, destroyMode); err != nil {
+			return err
+		}
+	}
+
+	// Introduced SRs have no PBDs yet
+	hosts := []xenAPI.HostRef{host}
+	if shared {
+		if hosts, err = c.client.Host.GetAll(c.session); err != nil {
+			return err
+		}
+	}
+
+	if shared || introduce {
+		if err = attachSR(c, sr, hosts, deviceConfig); err != nil {
+			return err
+		}
+	}
+
+	if !d.Get(srSchemaPlugged).(bool) {
+		if err = detachSR(c, sr); err != nil {
+			return err
+		}
+	}
+
+	if err = c.client.SR.SetTags(c.session, sr.SRRef, readStringSet(d.Get(srSchemaTags).(*schema.Set))); err != nil {
+		return err
+	}
+
+	if sr.OtherConfig == nil {
+		sr.OtherConfig = make(map[string]string)
+	}
+	mergeManagedMap(sr.OtherConfig, nil, d.Get(srSchemaOtherConfig).(map[string]interface{}))
+	if multipath {
+		sr.OtherConfig[srOtherConfigMultipathHosts] = multipathHosts
+	}
+	if err = c.client.SR.SetOtherConfig(c.session, sr.SRRef, sr.OtherConfig); err != nil {
+		return err
+	}
+
+	if _, ok := d.GetOk(srSchemaScanTrigger); ok {
+		if err = scanSR(c, sr); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := d.GetOk(srSchemaTrimTrigger); ok {
+		if err = trimSR(c, sr); err != nil {
+			return err
+		}
+	}
+
+	return resourceSRRead(d, m)
+}
+
+// Introduces the existing SR with the configured UUID, unless the pool already knows it
+func introduceSR(c *Connection, d *schema.ResourceData, srType string, shared bool) (xenAPI.SRRef, error) {
+	uuid := d.Get(srSchemaUUID).(string)
+	if uuid == "" {
+		return "", fmt.Errorf("%q is required to introduce an existing SR", srSchemaUUID)
+	}
+
+	srRef, err := c.client.SR.GetByUUID(c.session, uuid)
+	if err == nil {
+		log.Printf("[DEBUG] SR %s is already known to the pool", uuid)
+
+		if err = c.client.SR.SetNameLabel(c.session, srRef, d.Get(srSchemaName).(string)); err != nil {
+			return "", err
+		}
+		if err = c.client.SR.SetNameDescription(c.session, srRef, d.Get(srSchemaDescription).(string)); err != nil {
+			return "", err
+		}
+
+		return srRef, nil
+	}
+
+	if xenErr, ok := err.(*xenAPI.Error); !ok || xenErr.Code() != xenAPI.ERR_UUID_INVALID {
+		return "", err
+	}
+
+	log.Printf("[DEBUG] Introducing %s SR %s", srType, uuid)
+	return c.client.SR.Introduce(c.session, uuid, d.Get(srSchemaName).(string), d.Get(srSchemaDescription).(string),
+		srType, d.Get(srSchemaContentType).(string), shared, map[string]string{})
+}
+
+func resourceSRRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	sr := &SRDescriptor{
+		UUID: d.Id(),
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaUUID, sr.UUID); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaName, sr.Name); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaDescription, sr.Description); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaContentType, sr.ContentType); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaType, sr.Type); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaShared, sr.Shared); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaPhysicalSize, sr.PhysicalSize); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaPhysicalUtilisation, sr.PhysicalUtilisation); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaVirtualAllocation, sr.VirtualAllocation); err != nil {
+		return err
+	}
+
+	if err := d.Set(srSchemaTags, sr.Tags); err != nil {
+		return err
+	}
+
+	dOtherConfig := d.Get(srSchemaOtherConfig).(map[string]interface{})
+	if err := d.Set(srSchemaOtherConfig, filterManagedMap(sr.OtherConfig, dOtherConfig)); err != nil {
+		return err
+	}
+
+	// All PBDs of a shared SR use the same device_config
+	if len(sr.PBDs) > 0 {
+		pbd := &PBDDescriptor{
+			PBDRef: sr.PBDs[0],
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+
+		if err := setSchemaSRDeviceConfig(c, d, sr.Type, pbd); err != nil {
+			return err
+		}
+	}
+
+	// A dangling PBD breaks disk creation on its host, so it is plugged again right away if requested
+	replug := d.Get(srSchemaReplugOnRefresh).(bool) && d.Get(srSchemaPlugged).(bool)
+	plugged := true
+	for _, pbdRef := range sr.PBDs {
+		pbd := &PBDDescriptor{
+			PBDRef: pbdRef,
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+
+		if pbd.CurrentlyAttached {
+			continue
+		}
+
+		if replug {
+			log.Printf("[WARN] PBD %s of SR %s is unplugged, plugging it", pbd.UUID, sr.UUID)
+			err := setPBDPlugged(c, pbd, true)
+			if err == nil {
+				continue
+			}
+			log.Printf("[WARN] Failed to plug PBD %s of SR %s - %s", pbd.UUID, sr.UUID, err)
+		} else {
+			log.Printf("[WARN] PBD %s of SR %s is unplugged", pbd.UUID, sr.UUID)
+		}
+
+		plugged = false
+	}
+
+	if err := d.Set(srSchemaPlugged, plugged); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Sets the storage block of the SR type from the device_config of its PBD.
+// Secrets are not readable, so they are kept from the configuration.
+func setSchemaSRDeviceConfig(c *Connection, d *schema.ResourceData, srType string, pbd *PBDDescriptor) error {
+	deviceConfig := pbd.DeviceConfig
+
+	switch srType {
+	case srTypeNFS:
+		nfs := map[string]interface{}{
+			srNFSSchemaServer:     deviceConfig[srDeviceConfigServer],
+			srNFSSchemaServerPath: deviceConfig[srDeviceConfigServerPath],
+			srNFSSchemaVersion:    deviceConfig[srDeviceConfigNFSVersion],
+			srNFSSchemaOptions:    deviceConfig[srDeviceConfigOptions],
+		}
+		if nfs[srNFSSchemaVersion] == "" {
+			nfs[srNFSSchemaVersion] = "3"
+		}
+
+		return d.Set(srSchemaNFS, []interface{}{nfs})
+	case srTypeISCSI:
+		iscsi := map[string]interface{}{
+			srISCSISchemaTarget:    deviceConfig[srDeviceConfigTarget],
+			srISCSISchemaTargetIQN: deviceConfig[srDeviceConfigTargetIQN],
+			srISCSISchemaSCSIID:    deviceConfig[srDeviceConfigSCSIID],
+			srISCSISchemaChapUser:  deviceConfig[srDeviceConfigChapUser],
+			srISCSISchemaPort:      3260,
+			srISCSISchemaLUN:       -1,
+		}
+		if port, err := strconv.Atoi(deviceConfig[srDeviceConfigPort]); err == nil {
+			iscsi[srISCSISchemaPort] = port
+		}
+		if configured, ok := d.GetOk(srSchemaISCSI); ok {
+			data := configured.([]interface{})[0].(map[string]interface{})
+			iscsi[srISCSISchemaLUN] = data[srISCSISchemaLUN]
+			iscsi[srISCSISchemaChapPassword] = data[srISCSISchemaChapPassword]
+			iscsi[srISCSISchemaMultipath] = data[srISCSISchemaMultipath]
+		}
+
+		return d.Set(srSchemaISCSI, []interface{}{iscsi})
+	case srTypeSMB:
+		smb := map[string]interface{}{
+			srSMBSchemaUsername: deviceConfig[srDeviceConfigUsername],
+		}
+		// server is of the form //server/share
+		parts := strings.SplitN(strings.TrimPrefix(deviceConfig[srDeviceConfigServer], "//"), "/", 2)
+		smb[srSMBSchemaServer] = parts[0]
+		if len(parts) > 1 {
+			smb[srSMBSchemaShare] = parts[1]
+		}
+		if configured, ok := d.GetOk(srSchemaSMB); ok {
+			data := configured.([]interface{})[0].(map[string]interface{})
+			smb[srSMBSchemaPassword] = data[srSMBSchemaPassword]
+			// Keep the configured form of the share, e.g. with a leading slash
+			if strings.Trim(data[srSMBSchemaShare].(string), "/") == smb[srSMBSchemaShare] {
+				smb[srSMBSchemaShare] = data[srSMBSchemaShare]
+			}
+		}
+
+		return d.Set(srSchemaSMB, []interface{}{smb})
+	case srTypeEXT, srTypeLVM:
+		host := &HostDescriptor{
+			HostRef: pbd.Host,
+		}
+		if err := host.Query(c); err != nil {
+			return err
+		}
+
+		local := map[string]interface{}{
+			srLocalSchemaHostUUID: host.UUID,
+			srLocalSchemaDevice:   deviceConfig[srDeviceConfigDevice],
+			srLocalSchemaType:     srType,
+		}
+
+		return d.Set(srSchemaLocal, []interface{}{local})
+	case srTypeGFS2:
+		gfs2 := map[string]interface{}{
+			srGFS2SchemaProvider:  deviceConfig[srDeviceConfigProvider],
+			srGFS2SchemaTarget:    deviceConfig[srDeviceConfigTarget],
+			srGFS2SchemaTargetIQN: deviceConfig[srDeviceConfigTargetIQN],
+			srGFS2SchemaSCSIID:    deviceConfig[srDeviceConfigSCSIID],
+			srGFS2SchemaChapUser:  deviceConfig[srDeviceConfigChapUser],
+			srGFS2SchemaPort:      3260,
+			srGFS2SchemaLUN:       -1,
+		}
+		if port, err := strconv.Atoi(deviceConfig[srDeviceConfigPort]); err == nil {
+			gfs2[srGFS2SchemaPort] = port
+		}
+		if configured, ok := d.GetOk(srSchemaGFS2); ok {
+			data := configured.([]interface{})[0].(map[string]interface{})
+			gfs2[srGFS2SchemaLUN] = data[srGFS2SchemaLUN]
+			gfs2[srGFS2SchemaChapPassword] = data[srGFS2SchemaChapPassword]
+		}
+
+		return d.Set(srSchemaGFS2, []interface{}{gfs2})
+	case srTypeHBA, srTypeFCoE:
+		hba := map[string]interface{}{
+			srHBASchemaTransport: srHBATransportFC,
+			srHBASchemaSCSIID:    deviceConfig[srDeviceConfigSCSIID],
+			srHBASchemaLUN:       -1,
+		}
+		if srType == srTypeFCoE {
+			hba[srHBASchemaTransport] = srHBATransportFCoE
+		}
+		if configured, ok := d.GetOk(srSchemaHBA); ok {
+			data := configured.([]interface{})[0].(map[string]interface{})
+			hba[srHBASchemaLUN] = data[srHBASchemaLUN]
+			hba[srHBASchemaMultipath] = data[srHBASchemaMultipath]
+		}
+
+		return d.Set(srSchemaHBA, []interface{}{hba})
+	}
+
+	return nil
+}
+
+// Destroying the SR requires it to be empty, forgetting it keeps the disks on the storage
+func resourceSRDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	sr := &SRDescriptor{
+		UUID: d.Id(),
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	// Everything blocking the teardown is checked before any PBD is unplugged,
+	// so a failed destroy leaves the SR usable
+	remaining, attached, err := querySRVDIs(c, sr)
+	if err != nil {
+		return err
+	}
+
+	if len(attached) > 0 {
+		return fmt.Errorf("SR %s can not be detached, disks are in use: %s", sr.UUID, strings.Join(attached, ", "))
+	}
+
+	forget := false
+	switch d.Get(srSchemaDestroyMode).(string) {
+	case srDestroyModeForget:
+		forget = true
+	case srDestroyModeForgetNonEmpty:
+		forget = len(remaining) > 0
+	default:
+		if len(remaining) > 0 {
+			return fmt.Errorf("SR %s still has disks, destroy them or set %q to %q or %q: %s", sr.UUID,
+				srSchemaDestroyMode, srDestroyModeForget, srDestroyModeForgetNonEmpty, strings.Join(remaining, ", "))
+		}
+	}
+
+	// PBDs are gone together with the SR, so the secrets they reference are looked up first
+	deviceConfig := make(map[string]string)
+	if len(sr.PBDs) > 0 {
+		pbd := &PBDDescriptor{
+			PBDRef: sr.PBDs[0],
+		}
+		if err := pbd.Query(c); err != nil {
+			return err
+		}
+		deviceConfig = pbd.DeviceConfig
+	}
+
+	if err := detachSR(c, sr); err != nil {
+		return err
+	}
+
+	if forget {
+		// Leaves the data on the storage, the SR can be introduced again later
+		log.Printf("[DEBUG] Forgetting SR %s", sr.UUID)
+		if err := c.client.SR.Forget(c.session, sr.SRRef); err != nil {
+			log.Printf("[ERROR] Failed to forget SR %s - %s", sr.UUID, err)
+			return err
+		}
+	} else {
+		log.Printf("[DEBUG] Destroying SR %s", sr.UUID)
+		if err := c.client.SR.Destroy(c.session, sr.SRRef); err != nil {
+			log.Printf("[ERROR] Failed to destroy SR %s - %s", sr.UUID, err)
+			return err
+		}
+	}
+
+	if err := destroySRSecrets(c, deviceConfig); err != nil {
+		return err
+	}
+
+	if hosts, ok := sr.OtherConfig[srOtherConfigMultipathHosts]; ok {
+		if err := releaseMultipathing(c, sr, hosts); err != nil {
+			return err
+		}
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceSRUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	sr := &SRDescriptor{
+		UUID: d.Id(),
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	if d.HasChange(srSchemaName) {
+		_, n := d.GetChange(srSchemaName)
+
+		if err := c.client.SR.SetNameLabel(c.session, sr.SRRef, n.(string)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(srSchemaDescription) {
+		_, n := d.GetChange(srSchemaDescription)
+
+		if err := c.client.SR.SetNameDescription(c.session, sr.SRRef, n.(string)); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(srSchemaTags) {
+		if err := c.client.SR.SetTags(c.session, sr.SRRef, readStringSet(d.Get(srSchemaTags).(*schema.Set))); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(srSchemaOtherConfig) {
+		if sr.OtherConfig == nil {
+			sr.OtherConfig = make(map[string]string)
+		}
+		o, n := d.GetChange(srSchemaOtherConfig)
+		mergeManagedMap(sr.OtherConfig, o.(map[string]interface{}), n.(map[string]interface{}))
+
+		if err := c.client.SR.SetOtherConfig(c.session, sr.SRRef, sr.OtherConfig); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(srSchemaPlugged) {
+		if d.Get(srSchemaPlugged).(bool) {
+			if err := plugSR(c, sr); err != nil {
+				return err
+			}
+		} else {
+			if err := detachSR(c, sr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.HasChange(srSchemaScanTrigger) {
+		if err := scanSR(c, sr); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange(srSchemaTrimTrigger) {
+		if err := trimSR(c, sr); err != nil {
+			return err
+		}
+	}
+
+	return resourceSRRead(d, m)
+}
+
+func resourceSRExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	sr := &SRDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := sr.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,234 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	tunnelSchemaNetwork       = "network"
+	tunnelSchemaTransportPIFs = "transport_pifs"
+	tunnelSchemaProtocol      = "protocol"
+)
+
+// Manages the tunnels connecting a private network across hosts. Every host gets a tunnel from
+// the network to a transport PIF of the host, so the resource is identified by the network.
+func resourceTunnel() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceTunnelCreate,
+		Read:   resourceTunnelRead,
+		Delete: resourceTunnelDelete,
+		Exists: resourceTunnelExists,
+
+		Schema: map[string]*schema.Schema{
+			tunnelSchemaNetwork: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			tunnelSchemaTransportPIFs: &schema.Schema{
+				Type:     schema.TypeSet,
+				Required: true,
+				ForceNew: true,
+				MinItems: 1,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+
+			tunnelSchemaProtocol: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      string(xenAPI.TunnelProtocolGre),
+				ValidateFunc: validation.StringInSlice([]string{string(xenAPI.TunnelProtocolGre), string(xenAPI.TunnelProtocolVxlan)}, false),
+			},
+		},
+	}
+}
+
+func resourceTunnelCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Get(tunnelSchemaNetwork).(string),
+	}
+	if err := network.Load(c); err != nil {
+		return err
+	}
+
+	protocol := xenAPI.TunnelProtocol(d.Get(tunnelSchemaProtocol).(string))
+
+	created := make([]xenAPI.TunnelRef, 0)
+	for _, uuid := range readStringSet(d.Get(tunnelSchemaTransportPIFs).(*schema.Set)) {
+		pif := &PIFDescriptor{
+			UUID: uuid,
+		}
+		if err := pif.Load(c); err != nil {
+			return err
+		}
+
+		log.Printf("[DEBUG] Creating %s tunnel from network %s to PIF %s", protocol, network.UUID, pif.UUID)
+
+		tunnel, err := c.client.Tunnel.Create(c.session, pif.PIFRef, network.NetworkRef, protocol)
+		if err != nil {
+			log.Printf("[ERROR] Failed to create tunnel to PIF %s - %s", pif.UUID, err)
+			for _, ref := range created {
+				c.client.Tunnel.Destroy(c.session, ref)
+			}
+			return err
+		}
+
+		created = append(created, tunnel)
+	}
+
+	d.SetId(network.UUID)
+
+	return resourceTunnelRead(d, m)
+}
+
+func resourceTunnelRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Id(),
+	}
+	if err := network.Load(c); err != nil {
+		return err
+	}
+
+	tunnels, err := queryNetworkTunnels(c, network)
+	if err != nil {
+		return err
+	}
+
+	if len(tunnels) == 0 {
+		log.Printf("[DEBUG] Network %s has no tunnels anymore", network.UUID)
+		d.SetId("")
+		return nil
+	}
+
+	pifs := make([]string, 0, len(tunnels))
+	var protocol xenAPI.TunnelProtocol
+	for _, tunnel := range tunnels {
+		pif := &PIFDescriptor{
+			PIFRef: tunnel.TransportPIF,
+		}
+		if err = pif.Query(c); err != nil {
+			return err
+		}
+
+		pifs = append(pifs, pif.UUID)
+		protocol = tunnel.Protocol
+	}
+
+	if err = d.Set(tunnelSchemaNetwork, network.UUID); err != nil {
+		return err
+	}
+
+	if err = d.Set(tunnelSchemaTransportPIFs, pifs); err != nil {
+		return err
+	}
+
+	// Older XenServer releases only support GRE and leave the protocol empty
+	if protocol != "" {
+		if err = d.Set(tunnelSchemaProtocol, string(protocol)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resourceTunnelDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Id(),
+	}
+	if err := network.Load(c); err != nil {
+		return err
+	}
+
+	tunnels, err := queryNetworkTunnels(c, network)
+	if err != nil {
+		return err
+	}
+
+	for ref := range tunnels {
+		if err = c.client.Tunnel.Destroy(c.session, ref); err != nil {
+			log.Printf("[ERROR] Failed to destroy tunnel %s - %s", ref, err)
+			return err
+		}
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceTunnelExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	network := &NetworkDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := network.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Returns the tunnels whose access PIFs connect the network to the hosts
+func queryNetworkTunnels(c *Connection, network *NetworkDescriptor) (map[xenAPI.TunnelRef]xenAPI.TunnelRecord, error) {
+	pifs, err := c.client.Network.GetPIFs(c.session, network.NetworkRef)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := make(map[xenAPI.TunnelRef]xenAPI.TunnelRecord)
+	for _, pif := range pifs {
+		refs, err := c.client.PIF.GetTunnelAccessPIFOf(c.session, pif)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			tunnel, err := c.client.Tunnel.GetRecord(c.session, ref)
+			if err != nil {
+				return nil, err
+			}
+			tunnels[ref] = tunnel
+		}
+	}
+
+	return tunnels, nil
+}
@@ -22,22 +22,56 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/fiveai/go-xen-api-client"
 	"github.com/davecgh/go-spew/spew"
 )
 
 const (
-	vbdSchemaVdiUUID        = "vdi_uuid"
-	vbdSchemaBootable       = "bootable"
-	vbdSchemaMode           = "mode"
-	vbdSchemaUserDevice     = "user_device"
-	vbdSchemaTemplateDevice = "is_from_template"
+	vbdSchemaVdiUUID            = "vdi_uuid"
+	vbdSchemaBootable           = "bootable"
+	vbdSchemaMode               = "mode"
+	vbdSchemaUserDevice         = "user_device"
+	vbdSchemaTemplateDevice     = "is_from_template"
+	vbdSchemaSize               = "size"
+	vbdSchemaQoSAlgorithmType   = "qos_algorithm_type"
+	vbdSchemaQoSAlgorithmParams = "qos_algorithm_params"
+	vbdSchemaSRUUID             = "sr_uuid"
+	vbdSchemaProvisioning       = "provisioning"
+	vbdSchemaDevice             = "device"
+	vbdSchemaNameLabel          = "name_label"
+	vbdSchemaNameDescription    = "name_description"
+	vbdSchemaDetachOnly         = "detach_only"
+	vbdSchemaISOName            = "iso_name"
+	vbdSchemaOtherConfig        = "other_config"
+	vbdSchemaUnpluggable        = "unpluggable"
+	vbdSchemaOnBoot             = "on_boot"
+	vbdSchemaSourceVDIUUID      = "source_vdi_uuid"
 )
 
+const (
+	vdiOtherConfigInlineDisk = "terraform_inline_disk"
+	// Marks VDIs which are only detached when their VM is destroyed or the disk is removed
+	vdiOtherConfigDetachOnly = "terraform_detach_only"
+	// UUID of the VDI an inline disk was cloned from
+	vdiOtherConfigSourceVDI = "terraform_source_vdi"
+)
+
+// How long to keep asking the guest to release a disk before giving up
+const vbdUnplugTimeout = 2 * time.Minute
+
+// How long to wait for a freshly started VM to accept hot-plugged disks
+const vbdPlugTimeout = 2 * time.Minute
+
 func queryTemplateVBDs(c *Connection, vm *VMDescriptor) (vbds []*VBDDescriptor, err error) {
 	vbds = make([]*VBDDescriptor, 0)
 	var vmVBDRefs []xenAPI.VBDRef
@@ -102,7 +136,9 @@ func readTemplateVBDsToSchema(c *Connection, vm *VMDescriptor, s []interface{},
 				}
 
 				data[vbdSchemaUserDevice] = vbd.UserDevice
-				data[vbdSchemaVdiUUID] = vbd.VDI.UUID
+				if vbd.VDI != nil {
+					data[vbdSchemaVdiUUID] = vbd.VDI.UUID
+				}
 				data[vbdSchemaBootable] = vbd.Bootable
 				data[vbdSchemaMode] = vbd.Mode
 				data[vbdSchemaTemplateDevice] = true
@@ -129,6 +165,11 @@ func destroyTemplateVDIs(c *Connection, vbds []*VBDDescriptor) (err error) {
 			continue
 		}
 
+		if vbd.VDI.OtherConfig[vdiOtherConfigDetachOnly] == "true" {
+			log.Println("[DEBUG] Keeping VDI ", vbd.VDI.UUID)
+			continue
+		}
+
 		log.Println("[DEBUG] Destroy vbd ", vbd.UUID)
 		if err = c.client.VDI.Destroy(c.session, vbd.VDI.VDIRef); err != nil {
 			return err
@@ -148,7 +189,7 @@ func readVBDFromSchema(c *Connection, s map[string]interface{}) (*VBDDescriptor,
 
 	var vdi *VDIDescriptor = nil
 
-	if id, ok := s[vbdSchemaVdiUUID]; ok {
+	if id, ok := s[vbdSchemaVdiUUID]; ok && id.(string) != "" {
 		log.Println("[DEBUG] Try load VDI ", id)
 		vdi = &VDIDescriptor{}
 		vdi.UUID = id.(string)
@@ -198,15 +239,49 @@ func readVBDsFromSchema(c *Connection, s []interface{}) ([]*VBDDescriptor, error
 
 func fillVBDSchema(vbd VBDDescriptor) map[string]interface{} {
 	uuid := ""
+	size := 0
+	srUUID := ""
+	sourceUUID := ""
+	provisioning := ""
+	name := ""
+	description := ""
+	detachOnly := false
+	onBoot := ""
 	if vbd.VDI != nil {
 		uuid = vbd.VDI.UUID
+		size = vbd.VDI.Size
+		name = vbd.VDI.Name
+		description = vbd.VDI.Description
+		detachOnly = vbd.VDI.OtherConfig[vdiOtherConfigDetachOnly] == "true"
+		onBoot = string(vbd.VDI.OnBoot)
+		if vbd.VDI.OtherConfig[vdiOtherConfigInlineDisk] == "true" {
+			if source, ok := vbd.VDI.OtherConfig[vdiOtherConfigSourceVDI]; ok {
+				sourceUUID = source
+			} else {
+				srUUID = vbd.VDI.SR.UUID
+				provisioning = vbd.VDI.SMConfig[vdiSMConfigAllocation]
+			}
+		}
 	}
 	return map[string]interface{}{
-		vbdSchemaVdiUUID:        uuid,
-		vbdSchemaBootable:       vbd.Bootable,
-		vbdSchemaMode:           vbd.Mode,
-		vbdSchemaUserDevice:     vbd.UserDevice,
-		vbdSchemaTemplateDevice: vbd.IsTemplateDevice,
+		vbdSchemaVdiUUID:            uuid,
+		vbdSchemaSize:               size,
+		vbdSchemaSRUUID:             srUUID,
+		vbdSchemaSourceVDIUUID:      sourceUUID,
+		vbdSchemaProvisioning:       provisioning,
+		vbdSchemaDevice:             vbd.Device,
+		vbdSchemaNameLabel:          name,
+		vbdSchemaNameDescription:    description,
+		vbdSchemaDetachOnly:         detachOnly,
+		vbdSchemaOnBoot:             onBoot,
+		vbdSchemaOtherConfig:        vbd.OtherConfig,
+		vbdSchemaUnpluggable:        vbd.Unpluggable,
+		vbdSchemaQoSAlgorithmType:   vbd.QoSAlgorithmType,
+		vbdSchemaQoSAlgorithmParams: vbd.QoSAlgorithmParams,
+		vbdSchemaBootable:           vbd.Bootable,
+		vbdSchemaMode:               string(vbd.Mode),
+		vbdSchemaUserDevice:         vbd.UserDevice,
+		vbdSchemaTemplateDevice:     vbd.IsTemplateDevice,
 	}
 }
 
@@ -229,6 +304,16 @@ func readVBDs(c *Connection, vm *VMDescriptor) ([]map[string]interface{}, []map[
 			return nil, nil, err
 		}
 
+		// Config drive is managed by the cloud_init block
+		if vbd.OtherConfig[vbdOtherConfigConfigDrive] == "true" {
+			continue
+		}
+
+		// Disks attached by xenserver_vbd are managed by their own resource
+		if vbd.OtherConfig[vbdOtherConfigAttachment] == "true" {
+			continue
+		}
+
 		log.Println("[DEBUG] Found VBD", vbd.UUID)
 		vbdData := fillVBDSchema(vbd)
 		log.Println("[DEBUG] VBD: ", vbdData)
@@ -261,6 +346,45 @@ func setSchemaVBDs(c *Connection, vm *VMDescriptor, d *schema.ResourceData) erro
 	log.Printf("HDDs - %s", spew.Sdump(hdd))
 	log.Printf("CDs - %s", spew.Sdump(cdrom))
 
+	// ISO names are not stored by XenServer, keep them for drives whose ISO still has the configured name
+	isoNames := make([]string, 0)
+	for _, schm := range d.Get(vmSchemaCdRom).(*schema.Set).List() {
+		if name, _ := schm.(map[string]interface{})[vbdSchemaISOName].(string); name != "" {
+			isoNames = append(isoNames, name)
+		}
+	}
+	for _, data := range cdrom {
+		name := ""
+		if uuid := data[vbdSchemaVdiUUID].(string); uuid != "" {
+			vdi := &VDIDescriptor{
+				UUID: uuid,
+			}
+			if err = vdi.Load(c); err != nil {
+				return err
+			}
+			if containsString(isoNames, vdi.Name) {
+				name = vdi.Name
+			}
+		}
+		data[vbdSchemaISOName] = name
+	}
+
+	// Devices XenServer picked for CD drives are not tracked, as they are part of the drive's hash
+	configuredDevices := make([]string, 0)
+	for _, schm := range d.Get(vmSchemaCdRom).(*schema.Set).List() {
+		if userDevice, _ := schm.(map[string]interface{})[vbdSchemaUserDevice].(string); userDevice != "" {
+			configuredDevices = append(configuredDevices, strings.ToLower(userDevice))
+		}
+	}
+	for _, data := range cdrom {
+		if !containsString(configuredDevices, strings.ToLower(data[vbdSchemaUserDevice].(string))) {
+			data[vbdSchemaUserDevice] = ""
+		}
+	}
+
+	filterVBDsOtherConfig(hdd, d.Get(vmSchemaHardDrive).(*schema.Set), vbdHash)
+	filterVBDsOtherConfig(cdrom, d.Get(vmSchemaCdRom).(*schema.Set), cdromHash)
+
 	log.Printf("Current - %s", spew.Sdump(d.Get(vmSchemaHardDrive)))
 	err = d.Set(vmSchemaHardDrive, hdd)
 	if err != nil {
@@ -276,6 +400,23 @@ func setSchemaVBDs(c *Connection, vm *VMDescriptor, d *schema.ResourceData) erro
 	return nil
 }
 
+// Reduces other_config of the VBDs read from XAPI to the keys configured for the same drive,
+// as XAPI and the provider keep their own keys there
+func filterVBDsOtherConfig(vbds []map[string]interface{}, configured *schema.Set, hash schema.SchemaSetFunc) {
+	for _, data := range vbds {
+		managed := make(map[string]interface{})
+		dataHash := hash(data)
+		for _, schm := range configured.List() {
+			if hash(schm) == dataHash {
+				managed, _ = schm.(map[string]interface{})[vbdSchemaOtherConfig].(map[string]interface{})
+				break
+			}
+		}
+
+		data[vbdSchemaOtherConfig] = filterManagedMap(data[vbdSchemaOtherConfig].(map[string]string), managed)
+	}
+}
+
 func createVBD(c *Connection, vbd *VBDDescriptor) (*VBDDescriptor, error) {
 	log.Println(fmt.Sprintf("[DEBUG] Creating VBD for VM %q", vbd.VM.Name))
 
@@ -293,12 +434,25 @@ func createVBD(c *Connection, vbd *VBDDescriptor) (*VBDDescriptor, error) {
 			return nil, fmt.Errorf("No available devices to attach to")
 		}
 		vbdObject.Userdevice = devices[0]
+		if vbd.UserDevice != "" {
+			// Platform limits the devices, e.g. HVM guests without PV drivers only get IDE devices 0-3
+			if !containsString(devices, vbd.UserDevice) {
+				return nil, fmt.Errorf("device %q is not available on VM %q, allowed devices are %s", vbd.UserDevice, vbd.VM.Name, strings.Join(devices, ", "))
+			}
+			vbdObject.Userdevice = vbd.UserDevice
+		}
 		log.Println("[DEBUG] Selected device for VBD: ", vbdObject.Userdevice)
 	} else {
 		return nil, err
 	}
 
 	if vbd.VDI != nil {
+		if vbd.Type == xenAPI.VbdTypeDisk && vbd.Mode == xenAPI.VbdModeRW && !vbd.VDI.IsShared {
+			if err := checkVDINotAttached(c, vbd.VDI, vbd.VM); err != nil {
+				return nil, err
+			}
+		}
+
 		vbdObject.VDI = vbd.VDI.VDIRef
 	}
 
@@ -318,7 +472,7 @@ func createVBD(c *Connection, vbd *VBDDescriptor) (*VBDDescriptor, error) {
 	log.Println(fmt.Sprintf("[DEBUG] VBD  UUID %q", vbd.UUID))
 
 	if vbd.VM.PowerState == xenAPI.VMPowerStateRunning {
-		err = c.client.VBD.Plug(c.session, vbdRef)
+		err = plugVBD(c, vbdRef, vbdPlugTimeout)
 		if err != nil {
 			return nil, err
 		}
@@ -340,11 +494,24 @@ func vbdHash(v interface{}) int {
 	mode := m[vbdSchemaMode].(string)
 	bootable := m[vbdSchemaBootable].(bool)
 	vdiUUID := m[vbdSchemaVdiUUID].(string)
+	srUUID, _ := m[vbdSchemaSRUUID].(string)
+	isoName, _ := m[vbdSchemaISOName].(string)
+	sourceUUID, _ := m[vbdSchemaSourceVDIUUID].(string)
 
 	log.Println("[DEBUG] Calculating hash for ", v)
 
 	if !isTemplateDevice {
-		b, _ = buf.WriteString(fmt.Sprintf("-%s", vdiUUID))
+		if srUUID != "" {
+			// VDI of an inline disk is only known once it is created
+			b, _ = buf.WriteString(fmt.Sprintf("-%s-%s", srUUID, strings.ToLower(userDevice)))
+		} else if sourceUUID != "" {
+			b, _ = buf.WriteString(fmt.Sprintf("-clone-%s-%s", sourceUUID, strings.ToLower(userDevice)))
+		} else if isoName != "" {
+			// VDI of an ISO selected by name is only known once it is resolved
+			b, _ = buf.WriteString(fmt.Sprintf("-iso-%s", isoName))
+		} else {
+			b, _ = buf.WriteString(fmt.Sprintf("-%s", vdiUUID))
+		}
 		count += b
 
 		if mode != "" {
@@ -364,6 +531,28 @@ func vbdHash(v interface{}) int {
 	return hashcode.String(buf.String())
 }
 
+// CD drives may hold the same ISO or be empty, so they are told apart by their device
+func cdromHash(v interface{}) int {
+	userDevice, _ := v.(map[string]interface{})[vbdSchemaUserDevice].(string)
+
+	return hashcode.String(fmt.Sprintf("%d-%s", vbdHash(v), strings.ToLower(userDevice)))
+}
+
+// Orders drives with a configured user_device first, so that drives taking the first free
+// device can not occupy the device another drive is configured for
+func orderByUserDevice(s []interface{}) []interface{} {
+	ordered := make([]interface{}, 0, len(s))
+	for _, configured := range []bool{true, false} {
+		for _, schm := range s {
+			userDevice, _ := schm.(map[string]interface{})[vbdSchemaUserDevice].(string)
+			if (userDevice != "") == configured {
+				ordered = append(ordered, schm)
+			}
+		}
+	}
+	return ordered
+}
+
 func createVBDs(c *Connection, s []interface{}, vbdType xenAPI.VbdType, vm *VMDescriptor) (err error) {
 	log.Printf("[TRACE] createVBDs")
 	if err := readTemplateVBDsToSchema(c, vm, s, vbdType); err != nil {
@@ -372,7 +561,7 @@ func createVBDs(c *Connection, s []interface{}, vbdType xenAPI.VbdType, vm *VMDe
 
 	log.Printf("[TRACE] Creating %d VBDS of type %s",len(s), vbdType)
 
-	for _, schm := range s {
+	for _, schm := range orderByUserDevice(s) {
 		data := schm.(map[string]interface{})
 		log.Printf("[TRACE] Creating VBD for %s", spew.Sdump(data))
 
@@ -400,7 +589,9 @@ func createVBDs(c *Connection, s []interface{}, vbdType xenAPI.VbdType, vm *VMDe
 		}
 
 		data[vbdSchemaUserDevice] = vbd.UserDevice
-		data[vbdSchemaVdiUUID] = vbd.VDI.UUID
+		if vbd.VDI != nil {
+			data[vbdSchemaVdiUUID] = vbd.VDI.UUID
+		}
 		data[vbdSchemaBootable] = vbd.Bootable
 		data[vbdSchemaMode] = vbd.Mode
 	}
@@ -408,6 +599,720 @@ func createVBDs(c *Connection, s []interface{}, vbdType xenAPI.VbdType, vm *VMDe
 	return nil
 }
 
+// Ejects the ISO from the CD drive described by the from schema and inserts the one of the to schema,
+// keeping the drive attached to the VM. An empty vdi_uuid leaves the drive empty.
+func changeCDROMMedia(c *Connection, vm *VMDescriptor, from, to map[string]interface{}) error {
+	userDevice, _ := from[vbdSchemaUserDevice].(string)
+
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		if vbd.Type != xenAPI.VbdTypeCD || !strings.EqualFold(vbd.Userdevice, userDevice) {
+			continue
+		}
+
+		if !vbd.Empty {
+			log.Printf("[DEBUG] Ejecting CD from drive %s of VM %s", vbd.Userdevice, vm.UUID)
+			if err = c.client.VBD.Eject(c.session, vbdRef); err != nil {
+				return err
+			}
+		}
+
+		if uuid, _ := to[vbdSchemaVdiUUID].(string); uuid != "" {
+			vdi := &VDIDescriptor{
+				UUID: uuid,
+			}
+			if err = vdi.Load(c); err != nil {
+				return err
+			}
+
+			log.Printf("[DEBUG] Inserting VDI %s into drive %s of VM %s", vdi.UUID, vbd.Userdevice, vm.UUID)
+			if err = c.client.VBD.Insert(c.session, vbdRef, vdi.VDIRef); err != nil {
+				return err
+			}
+		}
+
+		to[vbdSchemaUserDevice] = vbd.Userdevice
+		return nil
+	}
+
+	return fmt.Errorf("CD drive %q of VM %s not found", userDevice, vm.UUID)
+}
+
+// Pairs removed and added CD drives whose media can be swapped in place. Added drives with a
+// configured user_device take the drive at that position, the others take the remaining drives
+// in the order of their positions. Unpaired drives are returned to be destroyed and created.
+func pairCDROMChanges(removed, added []interface{}) (pairs [][2]map[string]interface{}, remove, create []interface{}) {
+	remove = make([]interface{}, 0, len(removed))
+	for _, schm := range removed {
+		remove = append(remove, schm)
+	}
+	sort.SliceStable(remove, func(i, j int) bool {
+		return compareUserDevices(remove[i].(map[string]interface{})[vbdSchemaUserDevice].(string), remove[j].(map[string]interface{})[vbdSchemaUserDevice].(string))
+	})
+
+	take := func(match func(userDevice string) bool) map[string]interface{} {
+		for i, schm := range remove {
+			if match(schm.(map[string]interface{})[vbdSchemaUserDevice].(string)) {
+				remove = append(remove[:i], remove[i+1:]...)
+				return schm.(map[string]interface{})
+			}
+		}
+		return nil
+	}
+
+	create = make([]interface{}, 0, len(added))
+	unplaced := make([]interface{}, 0, len(added))
+	for _, schm := range added {
+		to := schm.(map[string]interface{})
+		userDevice, _ := to[vbdSchemaUserDevice].(string)
+		if userDevice == "" {
+			unplaced = append(unplaced, schm)
+			continue
+		}
+
+		if from := take(func(d string) bool { return strings.EqualFold(d, userDevice) }); from != nil {
+			pairs = append(pairs, [2]map[string]interface{}{from, to})
+		} else {
+			create = append(create, schm)
+		}
+	}
+
+	// Drives at a position claimed by another added drive are replaced, not reused
+	claimed := func(d string) bool {
+		for _, schm := range create {
+			if strings.EqualFold(schm.(map[string]interface{})[vbdSchemaUserDevice].(string), d) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, schm := range unplaced {
+		if from := take(func(d string) bool { return !claimed(d) }); from != nil {
+			pairs = append(pairs, [2]map[string]interface{}{from, schm.(map[string]interface{})})
+		} else {
+			create = append(create, schm)
+		}
+	}
+
+	return pairs, remove, create
+}
+
+// Orders user devices by their numeric position, falling back to their names
+func compareUserDevices(a, b string) bool {
+	i, errA := strconv.Atoi(a)
+	j, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return i < j
+	}
+	return a < b
+}
+
+// Resolves ISOs selected by name to the UUID of the VDI on an ISO SR
+func resolveISONames(c *Connection, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		name, _ := data[vbdSchemaISOName].(string)
+		if name == "" {
+			continue
+		}
+
+		vdiRefs, err := c.client.VDI.GetByNameLabel(c.session, name)
+		if err != nil {
+			return err
+		}
+
+		uuid := ""
+		for _, vdiRef := range vdiRefs {
+			vdi := &VDIDescriptor{
+				VDIRef: vdiRef,
+			}
+			if err = vdi.Query(c); err != nil {
+				return err
+			}
+
+			if vdi.SR.ContentType != "iso" {
+				continue
+			}
+
+			if uuid != "" {
+				return fmt.Errorf("ISO name %q is ambiguous, it matches %s and %s", name, uuid, vdi.UUID)
+			}
+			uuid = vdi.UUID
+		}
+
+		if uuid == "" {
+			return fmt.Errorf("ISO %q not found on any ISO SR", name)
+		}
+
+		log.Printf("[DEBUG] Resolved ISO %q to VDI %s", name, uuid)
+		data[vbdSchemaVdiUUID] = uuid
+	}
+
+	return nil
+}
+
+// Creates the VDIs of inline disks, which specify an SR and size or a VDI to clone instead of
+// an existing VDI. The VDIs are marked so they are destroyed together with the VM or when the
+// disk is removed. The created VDIs are returned even on error, so they can be cleaned up.
+func createInlineVDIs(c *Connection, vm *VMDescriptor, s []interface{}) ([]xenAPI.VDIRef, error) {
+	created := make([]xenAPI.VDIRef, 0)
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		srUUID, _ := data[vbdSchemaSRUUID].(string)
+		sourceUUID, _ := data[vbdSchemaSourceVDIUUID].(string)
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if (srUUID == "" && sourceUUID == "") || uuid != "" {
+			continue
+		}
+
+		if srUUID != "" && sourceUUID != "" {
+			return created, fmt.Errorf("only one of %q and %q can be set, clones are created on the SR of their source", vbdSchemaSRUUID, vbdSchemaSourceVDIUUID)
+		}
+
+		userDevice, _ := data[vbdSchemaUserDevice].(string)
+		if userDevice == "" {
+			return created, fmt.Errorf("%q is required for disks created by terraform", vbdSchemaUserDevice)
+		}
+
+		name, _ := data[vbdSchemaNameLabel].(string)
+		if name == "" {
+			name = fmt.Sprintf("%s disk %s", vm.Name, userDevice)
+		}
+
+		description, _ := data[vbdSchemaNameDescription].(string)
+		if description == "" {
+			description = "Created by terraform"
+		}
+
+		if sourceUUID != "" {
+			source := &VDIDescriptor{
+				UUID: sourceUUID,
+			}
+			if err := source.Load(c); err != nil {
+				return created, err
+			}
+
+			// Size is grown to the configured one together with the other disks
+			vdi, err := cloneVDI(c, source, name, description, map[string]string{
+				vdiOtherConfigInlineDisk: "true",
+				vdiOtherConfigSourceVDI:  source.UUID,
+			})
+			if err != nil {
+				return created, err
+			}
+			created = append(created, vdi.VDIRef)
+
+			log.Printf("[DEBUG] Cloned VDI %s from %s", vdi.UUID, source.UUID)
+
+			data[vbdSchemaVdiUUID] = vdi.UUID
+			continue
+		}
+
+		size, _ := data[vbdSchemaSize].(int)
+		if size <= 0 {
+			return created, fmt.Errorf("%q is required for disks created on SR %s", vbdSchemaSize, srUUID)
+		}
+
+		sr := &SRDescriptor{
+			UUID: srUUID,
+		}
+		if err := sr.Load(c); err != nil {
+			return created, err
+		}
+
+		provisioning, _ := data[vbdSchemaProvisioning].(string)
+
+		vdiRef, err := c.client.VDI.Create(c.session, xenAPI.VDIRecord{
+			NameLabel:       name,
+			NameDescription: description,
+			VirtualSize:     size,
+			SR:              sr.SRRef,
+			Type:            xenAPI.VdiTypeUser,
+			SmConfig:        readVDISMConfig(provisioning, nil),
+			OtherConfig: map[string]string{
+				vdiOtherConfigInlineDisk: "true",
+			},
+		})
+		if err != nil {
+			return created, err
+		}
+		created = append(created, vdiRef)
+
+		vdi := &VDIDescriptor{
+			VDIRef: vdiRef,
+		}
+		if err = vdi.Query(c); err != nil {
+			return created, err
+		}
+
+		log.Printf("[DEBUG] Created VDI %s of %d bytes on SR %s", vdi.UUID, size, sr.UUID)
+
+		data[vbdSchemaVdiUUID] = vdi.UUID
+	}
+
+	return created, nil
+}
+
+// SRs round the size of disks up, e.g. to whole extents, so disks at least as large as
+// configured are in sync. Disks can not be shrunk anyway.
+func vbdSizeDiffSuppressFunc(k, old, new string, d *schema.ResourceData) bool {
+	oldSize, err := strconv.Atoi(old)
+	if err != nil {
+		return false
+	}
+
+	newSize, err := strconv.Atoi(new)
+	if err != nil {
+		return false
+	}
+
+	return newSize <= oldSize
+}
+
+// Returns VDIs of the inline disks attached to the VM
+func queryInlineVDIs(c *Connection, vm *VMDescriptor) ([]xenAPI.VDIRef, error) {
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return nil, err
+	}
+
+	vdis := make([]xenAPI.VDIRef, 0)
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return nil, err
+		}
+
+		if vbd.Empty || vbd.Type != xenAPI.VbdTypeDisk {
+			continue
+		}
+
+		otherConfig, err := c.client.VDI.GetOtherConfig(c.session, vbd.VDI)
+		if err != nil {
+			return nil, err
+		}
+
+		if otherConfig[vdiOtherConfigInlineDisk] == "true" && otherConfig[vdiOtherConfigDetachOnly] != "true" {
+			vdis = append(vdis, vbd.VDI)
+		}
+	}
+
+	return vdis, nil
+}
+
+// Grows the disks whose configured size exceeds the virtual size of their VDI.
+// Running VMs are resized online, falling back to resizing a detached disk if the SR can not do it.
+func resizeVBDs(c *Connection, vm *VMDescriptor, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		size, _ := data[vbdSchemaSize].(int)
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if size == 0 || uuid == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		// SRs round the size up, so a disk at least as large as configured is in sync
+		if size <= vdi.Size {
+			continue
+		}
+
+		log.Printf("[DEBUG] Resizing VDI %s from %d to %d bytes", vdi.UUID, vdi.Size, size)
+
+		if vm.PowerState != xenAPI.VMPowerStateRunning {
+			if err := c.client.VDI.Resize(c.session, vdi.VDIRef, size); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := c.client.VDI.ResizeOnline(c.session, vdi.VDIRef, size)
+		if err == nil {
+			continue
+		}
+		log.Printf("[WARN] Online resize of VDI %s failed, resizing it detached - %s", vdi.UUID, err)
+
+		vbd, err := queryVMVBD(c, vm, vdi)
+		if err != nil {
+			return err
+		}
+
+		if err = unplugVBD(c, vbd, vbdUnplugTimeout); err != nil {
+			return err
+		}
+
+		if err = c.client.VDI.Resize(c.session, vdi.VDIRef, size); err != nil {
+			return err
+		}
+
+		if err = plugVBD(c, vbd, vbdPlugTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies the QoS settings of the disks, e.g. ionice scheduling class, to their VBDs
+func updateVBDsQoS(c *Connection, vm *VMDescriptor, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if uuid == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		vbdRef, err := queryVMVBD(c, vm, vdi)
+		if err != nil {
+			return err
+		}
+
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		algorithmType, _ := data[vbdSchemaQoSAlgorithmType].(string)
+		if algorithmType != vbd.QosAlgorithmType {
+			log.Printf("[DEBUG] Setting QoS algorithm of VBD %s to %q", vbd.UUID, algorithmType)
+			if err = c.client.VBD.SetQosAlgorithmType(c.session, vbdRef, algorithmType); err != nil {
+				return err
+			}
+		}
+
+		algorithmParams := make(map[string]string)
+		if params, ok := data[vbdSchemaQoSAlgorithmParams].(map[string]interface{}); ok {
+			for k, v := range params {
+				algorithmParams[k] = v.(string)
+			}
+		}
+		if !reflect.DeepEqual(algorithmParams, vbd.QosAlgorithmParams) {
+			log.Printf("[DEBUG] Setting QoS parameters of VBD %s", vbd.UUID)
+			if err = c.client.VBD.SetQosAlgorithmParams(c.session, vbdRef, algorithmParams); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Hot-unplugs the VBD from a running VM. The guest may refuse to release a device which is in use,
+// and XAPI refuses while another operation on the VM is in progress, so both are retried until the timeout.
+func unplugVBD(c *Connection, vbd xenAPI.VBDRef, timeout time.Duration) error {
+	return resource.Retry(timeout, func() *resource.RetryError {
+		err := c.client.VBD.Unplug(c.session, vbd)
+		if err == nil {
+			return nil
+		}
+
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			switch xenErr.Code() {
+			case xenAPI.ERR_DEVICE_ALREADY_DETACHED:
+				return nil
+			case xenAPI.ERR_DEVICE_DETACH_REJECTED, xenAPI.ERR_OPERATION_NOT_ALLOWED:
+				log.Printf("[DEBUG] Unplugging VBD %s was refused, retrying - %s", vbd, err)
+				return resource.RetryableError(err)
+			}
+		}
+
+		return resource.NonRetryableError(err)
+	})
+}
+
+// Hot-plugs the VBD into its running VM. Until a freshly started guest is ready, XAPI does not
+// allow plugging, so this waits for plug to show up in the allowed operations of the VBD.
+func plugVBD(c *Connection, vbd xenAPI.VBDRef, timeout time.Duration) error {
+	return resource.Retry(timeout, func() *resource.RetryError {
+		operations, err := c.client.VBD.GetAllowedOperations(c.session, vbd)
+		if err != nil {
+			return resource.NonRetryableError(err)
+		}
+
+		allowed := false
+		for _, operation := range operations {
+			if operation == xenAPI.VbdOperationsPlug {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			log.Printf("[DEBUG] Plugging VBD %s is not allowed yet, waiting", vbd)
+			return resource.RetryableError(fmt.Errorf("plugging VBD %s is not allowed, allowed operations are %v", vbd, operations))
+		}
+
+		err = c.client.VBD.Plug(c.session, vbd)
+		if err == nil {
+			return nil
+		}
+
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			switch xenErr.Code() {
+			case xenAPI.ERR_DEVICE_ALREADY_ATTACHED:
+				return nil
+			case xenAPI.ERR_OPERATION_NOT_ALLOWED:
+				log.Printf("[DEBUG] Plugging VBD %s was refused, retrying - %s", vbd, err)
+				return resource.RetryableError(err)
+			}
+		}
+
+		return resource.NonRetryableError(err)
+	})
+}
+
+// Fails when a VDI which is not sharable is already attached to another VM
+func checkVDINotAttached(c *Connection, vdi *VDIDescriptor, vm *VMDescriptor) error {
+	vbdRefs, err := c.client.VDI.GetVBDs(c.session, vdi.VDIRef)
+	if err != nil {
+		return err
+	}
+
+	for _, vbdRef := range vbdRefs {
+		other, err := c.client.VBD.GetVM(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		if other != vm.VMRef {
+			return fmt.Errorf("VDI %s is already attached to VM %s, it has to be shared to attach it to several VMs", vdi.UUID, other)
+		}
+	}
+
+	return nil
+}
+
+// Renames the VDIs of the disks whose configured name or description differs,
+// e.g. disks cloned from the template which XenServer names after the provisioner
+func updateVDINames(c *Connection, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if uuid == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		if name, _ := data[vbdSchemaNameLabel].(string); name != "" && name != vdi.Name {
+			log.Printf("[DEBUG] Renaming VDI %s to %q", vdi.UUID, name)
+			if err := c.client.VDI.SetNameLabel(c.session, vdi.VDIRef, name); err != nil {
+				return err
+			}
+		}
+
+		if description, _ := data[vbdSchemaNameDescription].(string); description != "" && description != vdi.Description {
+			if err := c.client.VDI.SetNameDescription(c.session, vdi.VDIRef, description); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Marks the VDIs of the disks to keep when they are removed or their VM is destroyed
+func updateVDIsDetachOnly(c *Connection, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if uuid == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		detachOnly, _ := data[vbdSchemaDetachOnly].(bool)
+		if detachOnly == (vdi.OtherConfig[vdiOtherConfigDetachOnly] == "true") {
+			continue
+		}
+
+		var err error
+		if detachOnly {
+			err = c.client.VDI.AddToOtherConfig(c.session, vdi.VDIRef, vdiOtherConfigDetachOnly, "true")
+		} else {
+			err = c.client.VDI.RemoveFromOtherConfig(c.session, vdi.VDIRef, vdiOtherConfigDetachOnly)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sets whether the VDIs of the disks keep or discard their changes when the VM boots
+func updateVDIsOnBoot(c *Connection, s []interface{}) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		onBoot, _ := data[vbdSchemaOnBoot].(string)
+		if uuid == "" || onBoot == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		if xenAPI.OnBoot(onBoot) == vdi.OnBoot {
+			continue
+		}
+
+		log.Printf("[DEBUG] Setting on_boot of VDI %s to %s", vdi.UUID, onBoot)
+		if err := updateVDICaching(c, vdi, vdi.AllowCaching, onBoot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies unpluggable and other_config of the drives to their VBDs. Keys of other_config
+// which were configured for the same drive before but are gone now are removed.
+func updateVBDsOptions(c *Connection, vm *VMDescriptor, old, s []interface{}, hash schema.SchemaSetFunc) error {
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		uuid, _ := data[vbdSchemaVdiUUID].(string)
+		if uuid == "" {
+			continue
+		}
+
+		vdi := &VDIDescriptor{
+			UUID: uuid,
+		}
+		if err := vdi.Load(c); err != nil {
+			return err
+		}
+
+		vbdRef, err := queryVMVBD(c, vm, vdi)
+		if err != nil {
+			return err
+		}
+
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		if unpluggable, ok := data[vbdSchemaUnpluggable].(bool); ok && unpluggable != vbd.Unpluggable {
+			log.Printf("[DEBUG] Setting unpluggable of VBD %s to %t", vbd.UUID, unpluggable)
+			if err = c.client.VBD.SetUnpluggable(c.session, vbdRef, unpluggable); err != nil {
+				return err
+			}
+		}
+
+		otherConfig, _ := data[vbdSchemaOtherConfig].(map[string]interface{})
+		for k, v := range otherConfig {
+			if vbd.OtherConfig[k] == v.(string) {
+				continue
+			}
+			if _, ok := vbd.OtherConfig[k]; ok {
+				if err = c.client.VBD.RemoveFromOtherConfig(c.session, vbdRef, k); err != nil {
+					return err
+				}
+			}
+			if err = c.client.VBD.AddToOtherConfig(c.session, vbdRef, k, v.(string)); err != nil {
+				return err
+			}
+		}
+
+		dataHash := hash(data)
+		for _, previous := range old {
+			if hash(previous) != dataHash {
+				continue
+			}
+
+			oldOtherConfig, _ := previous.(map[string]interface{})[vbdSchemaOtherConfig].(map[string]interface{})
+			for k := range oldOtherConfig {
+				if _, ok := otherConfig[k]; ok {
+					continue
+				}
+				if err = c.client.VBD.RemoveFromOtherConfig(c.session, vbdRef, k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the VBD attaching the VDI to the VM
+func queryVMVBD(c *Connection, vm *VMDescriptor, vdi *VDIDescriptor) (xenAPI.VBDRef, error) {
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return "", err
+	}
+
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return "", err
+		}
+
+		if vbd.VDI == vdi.VDIRef {
+			return vbdRef, nil
+		}
+	}
+
+	return "", fmt.Errorf("VDI %s is not attached to VM %s", vdi.UUID, vm.UUID)
+}
+
+// Returns the schema for the cdrom blocks. Unlike disks, the ISO of a drive is inserted and ejected in place.
+func resourceCDROM() *schema.Resource {
+	r := resourceVBD()
+	r.Schema[vbdSchemaVdiUUID].ForceNew = false
+	r.Schema[vbdSchemaISOName] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+	}
+	return r
+}
+
 // Returns the schema for the vbd resource
 func resourceVBD() *schema.Resource {
 	return &schema.Resource{
@@ -444,6 +1349,69 @@ func resourceVBD() *schema.Resource {
 				Computed:      true,
 				ConflictsWith: []string{"hard_drive.0.is_from_template", "cdrom.0.is_from_template"},
 			},
+			vbdSchemaSize: &schema.Schema{
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Computed:         true,
+				DiffSuppressFunc: vbdSizeDiffSuppressFunc,
+			},
+			vbdSchemaSRUUID: &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"hard_drive.0.is_from_template", "cdrom.0.is_from_template"},
+			},
+			vbdSchemaSourceVDIUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			vbdSchemaProvisioning: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"", vdiProvisioningThin, vdiProvisioningThick}, false),
+			},
+			vbdSchemaDevice: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			vbdSchemaNameLabel: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			vbdSchemaNameDescription: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			vbdSchemaDetachOnly: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			vbdSchemaOnBoot: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{string(xenAPI.OnBootPersist), string(xenAPI.OnBootReset)}, false),
+			},
+			vbdSchemaOtherConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+			vbdSchemaUnpluggable: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			vbdSchemaQoSAlgorithmType: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"", "ionice"}, false),
+			},
+			vbdSchemaQoSAlgorithmParams: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
 		},
 	}
 }
\ No newline at end of file
@@ -0,0 +1,267 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	vbdAttachmentSchemaVMUUID      = "vm_uuid"
+	vbdAttachmentSchemaVDIUUID     = "vdi_uuid"
+	vbdAttachmentSchemaUserDevice  = "user_device"
+	vbdAttachmentSchemaMode        = "mode"
+	vbdAttachmentSchemaBootable    = "bootable"
+	vbdAttachmentSchemaUnpluggable = "unpluggable"
+	vbdAttachmentSchemaDevice      = "device"
+)
+
+// Marks VBDs managed by xenserver_vbd, so the drive blocks of xenserver_vm leave them alone
+const vbdOtherConfigAttachment = "terraform_vbd_attachment"
+
+func resourceVBDAttachment() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVBDAttachmentCreate,
+		Read:   resourceVBDAttachmentRead,
+		Update: resourceVBDAttachmentUpdate,
+		Delete: resourceVBDAttachmentDelete,
+		Exists: resourceVBDAttachmentExists,
+
+		Schema: map[string]*schema.Schema{
+			vbdAttachmentSchemaVMUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vbdAttachmentSchemaVDIUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vbdAttachmentSchemaUserDevice: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
+
+			vbdAttachmentSchemaMode: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      string(xenAPI.VbdModeRW),
+				ValidateFunc: validation.StringInSlice([]string{string(xenAPI.VbdModeRW), string(xenAPI.VbdModeRO)}, false),
+			},
+
+			vbdAttachmentSchemaBootable: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vbdAttachmentSchemaUnpluggable: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+
+			vbdAttachmentSchemaDevice: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceVBDAttachmentCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vm := &VMDescriptor{
+		UUID: d.Get(vbdAttachmentSchemaVMUUID).(string),
+	}
+	if err := vm.Load(c); err != nil {
+		return err
+	}
+
+	vdi := &VDIDescriptor{
+		UUID: d.Get(vbdAttachmentSchemaVDIUUID).(string),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Attaching VDI %s to VM %s", vdi.UUID, vm.UUID)
+
+	// Running VMs get the disk hot-plugged
+	vbd, err := createVBD(c, &VBDDescriptor{
+		VM:         vm,
+		VDI:        vdi,
+		Type:       xenAPI.VbdTypeDisk,
+		Mode:       xenAPI.VbdMode(d.Get(vbdAttachmentSchemaMode).(string)),
+		Bootable:   d.Get(vbdAttachmentSchemaBootable).(bool),
+		UserDevice: d.Get(vbdAttachmentSchemaUserDevice).(string),
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to attach VDI %s to VM %s - %s", vdi.UUID, vm.UUID, err)
+		return err
+	}
+
+	d.SetId(vbd.UUID)
+
+	if err = c.client.VBD.AddToOtherConfig(c.session, vbd.VBDRef, vbdOtherConfigAttachment, "true"); err != nil {
+		return err
+	}
+
+	if unpluggable := d.Get(vbdAttachmentSchemaUnpluggable).(bool); unpluggable != vbd.Unpluggable {
+		if err = c.client.VBD.SetUnpluggable(c.session, vbd.VBDRef, unpluggable); err != nil {
+			return err
+		}
+	}
+
+	return resourceVBDAttachmentRead(d, m)
+}
+
+func resourceVBDAttachmentRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vbd := &VBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vbd.Load(c); err != nil {
+		return err
+	}
+
+	if err := d.Set(vbdAttachmentSchemaVMUUID, vbd.VM.UUID); err != nil {
+		return err
+	}
+
+	if vbd.VDI != nil {
+		if err := d.Set(vbdAttachmentSchemaVDIUUID, vbd.VDI.UUID); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Set(vbdAttachmentSchemaUserDevice, vbd.UserDevice); err != nil {
+		return err
+	}
+
+	if err := d.Set(vbdAttachmentSchemaMode, string(vbd.Mode)); err != nil {
+		return err
+	}
+
+	if err := d.Set(vbdAttachmentSchemaBootable, vbd.Bootable); err != nil {
+		return err
+	}
+
+	if err := d.Set(vbdAttachmentSchemaUnpluggable, vbd.Unpluggable); err != nil {
+		return err
+	}
+
+	if err := d.Set(vbdAttachmentSchemaDevice, vbd.Device); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceVBDAttachmentUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vbd := &VBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vbd.Load(c); err != nil {
+		return err
+	}
+
+	d.Partial(true)
+
+	if d.HasChange(vbdAttachmentSchemaBootable) {
+		if err := c.client.VBD.SetBootable(c.session, vbd.VBDRef, d.Get(vbdAttachmentSchemaBootable).(bool)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vbdAttachmentSchemaBootable)
+	}
+
+	if d.HasChange(vbdAttachmentSchemaUnpluggable) {
+		if err := c.client.VBD.SetUnpluggable(c.session, vbd.VBDRef, d.Get(vbdAttachmentSchemaUnpluggable).(bool)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vbdAttachmentSchemaUnpluggable)
+	}
+
+	d.Partial(false)
+
+	return resourceVBDAttachmentRead(d, m)
+}
+
+// Detaches the VDI, hot-unplugging it from running VMs. The VDI itself is kept.
+func resourceVBDAttachmentDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vbd := &VBDDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vbd.Load(c); err != nil {
+		return err
+	}
+
+	if vbd.CurrentlyAttached {
+		log.Printf("[DEBUG] Unplugging VBD %s from VM %s", vbd.UUID, vbd.VM.UUID)
+		if err := unplugVBD(c, vbd.VBDRef, vbdUnplugTimeout); err != nil {
+			return err
+		}
+	}
+
+	if err := c.client.VBD.Destroy(c.session, vbd.VBDRef); err != nil {
+		log.Printf("[ERROR] Failed to destroy VBD %s - %s", vbd.UUID, err)
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceVBDAttachmentExists(d *schema.ResourceData, m interface{}) (bool, error) {
+	c := m.(*Connection)
+
+	vbd := &VBDDescriptor{
+		UUID: d.Id(),
+	}
+
+	if err := vbd.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			if xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -19,20 +19,51 @@
 package xenserver
 
 import (
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/fiveai/go-xen-api-client"
 )
 
 const (
-	vdiSchemaUUID   = "sr_uuid"
-	vdiSchemaName   = "name_label"
-	vdiSchemaShared = "shared"
-	vdiSchemaRO     = "read_only"
-	vdiSchemaSize   = "size"
+	vdiSchemaUUID         = "sr_uuid"
+	vdiSchemaName         = "name_label"
+	vdiSchemaShared       = "shared"
+	vdiSchemaRO           = "read_only"
+	vdiSchemaSize         = "size"
+	vdiSchemaImportSource = "import_source"
+	vdiSchemaImportFormat = "import_format"
+	vdiSchemaProvisioning = "provisioning"
+	vdiSchemaSMConfig     = "sm_config"
+	vdiSchemaAllowCaching = "allow_caching"
+	vdiSchemaOnBoot       = "on_boot"
+	vdiSchemaCbtEnabled   = "cbt_enabled"
+	vdiSchemaOnDestroy    = "on_destroy"
+
+	vdiSchemaSensitiveSMConfig = "sensitive_sm_config"
+	vdiSchemaSourceVDIUUID     = "source_vdi_uuid"
 )
 
+const (
+	vdiProvisioningThin  = "thin"
+	vdiProvisioningThick = "thick"
+
+	vdiOnDestroyDestroy = "destroy"
+	// Removes the VDI from the XAPI database only, the data stays on the SR
+	vdiOnDestroyForget = "forget"
+
+	// Key of sm_config selecting the allocation of the VDI on SRs supporting thin provisioning
+	vdiSMConfigAllocation = "allocation"
+	// Key of sm_config selecting the format of the VDI, VHD unless set to raw
+	vdiSMConfigType = "type"
+)
+
+// SR types which can attach a VDI to several VMs at once. They require raw volumes instead of VHD.
+var vdiSharableSRTypes = []string{"lvm", "lvmoiscsi", "lvmohba", "lvmofcoe"}
+
 func resourceVDI() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceVDICreate,
@@ -69,6 +100,78 @@ func resourceVDI() *schema.Resource {
 				Type:     schema.TypeInt,
 				Required: true,
 			},
+
+			vdiSchemaImportSource: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+
+			vdiSchemaImportFormat: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      vdiFormatRaw,
+				ValidateFunc: validation.StringInSlice([]string{vdiFormatRaw, vdiFormatVHD}, false),
+			},
+
+			vdiSchemaProvisioning: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice([]string{vdiProvisioningThin, vdiProvisioningThick}, false),
+			},
+
+			vdiSchemaAllowCaching: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vdiSchemaOnBoot: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      string(xenAPI.OnBootPersist),
+				ValidateFunc: validation.StringInSlice([]string{string(xenAPI.OnBootPersist), string(xenAPI.OnBootReset)}, false),
+			},
+
+			// Changed block tracking, used by incremental backup tools
+			vdiSchemaCbtEnabled: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			// Only used by the provider, so it can be changed without touching the VDI
+			vdiSchemaOnDestroy: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      vdiOnDestroyDestroy,
+				ValidateFunc: validation.StringInSlice([]string{vdiOnDestroyDestroy, vdiOnDestroyForget}, false),
+			},
+
+			// Not read back, the SM backend adds and rewrites keys of sm_config on its own
+			vdiSchemaSMConfig: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: true,
+			},
+
+			// Key material for SR drivers encrypting VDIs, kept out of the plan output
+			vdiSchemaSensitiveSMConfig: &schema.Schema{
+				Type:      schema.TypeMap,
+				Optional:  true,
+				ForceNew:  true,
+				Sensitive: true,
+			},
+
+			// Fast clone of an existing VDI instead of an empty disk
+			vdiSchemaSourceVDIUUID: &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{vdiSchemaImportSource, vdiSchemaProvisioning, vdiSchemaSMConfig, vdiSchemaSensitiveSMConfig},
+			},
 		},
 	}
 }
@@ -87,17 +190,46 @@ func resourceVDICreate(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	shared := d.Get(vdiSchemaShared).(bool)
+	if shared {
+		if err := validateSharableSR(sr); err != nil {
+			return err
+		}
+	}
+
 	vdiRecord := xenAPI.VDIRecord{
 		NameLabel:   d.Get(vdiSchemaName).(string),
 		VirtualSize: d.Get(vdiSchemaSize).(int),
-		Sharable:    d.Get(vdiSchemaShared).(bool),
+		Sharable:    shared,
 		ReadOnly:    d.Get(vdiSchemaRO).(bool),
 		SR:          sr.SRRef,
 		Type:        xenAPI.VdiTypeUser,
+		SmConfig:    readVDISMConfig(d.Get(vdiSchemaProvisioning).(string), d.Get(vdiSchemaSMConfig).(map[string]interface{})),
+	}
+
+	if shared {
+		vdiRecord.SmConfig[vdiSMConfigType] = "raw"
 	}
 
 	log.Println("Object to send: ", vdiRecord)
-	if vdiRef, err := c.client.VDI.Create(c.session, vdiRecord); err == nil {
+
+	// Merged after logging to keep the key material out of the logs
+	for k, v := range d.Get(vdiSchemaSensitiveSMConfig).(map[string]interface{}) {
+		if _, ok := vdiRecord.SmConfig[k]; ok {
+			return fmt.Errorf("key %q is set in both %q and %q", k, vdiSchemaSMConfig, vdiSchemaSensitiveSMConfig)
+		}
+		vdiRecord.SmConfig[k] = v.(string)
+	}
+
+	var vdiRef xenAPI.VDIRef
+	var err error
+	if sourceUUID := d.Get(vdiSchemaSourceVDIUUID).(string); sourceUUID != "" {
+		vdiRef, err = cloneVDIFromRecord(c, sourceUUID, sr, vdiRecord)
+	} else {
+		vdiRef, err = c.client.VDI.Create(c.session, vdiRecord)
+	}
+
+	if err == nil {
 		log.Println("VDI Created")
 		vdi := &VDIDescriptor{
 			VDIRef: vdiRef,
@@ -107,7 +239,24 @@ func resourceVDICreate(d *schema.ResourceData, m interface{}) error {
 			return err
 		}
 		log.Println("UUID is ", vdi.UUID)
+
+		if source := d.Get(vdiSchemaImportSource).(string); source != "" {
+			if err := importVDISource(c, vdiRef, d.Get(vdiSchemaImportFormat).(string), source); err != nil {
+				c.client.VDI.Destroy(c.session, vdiRef)
+				return err
+			}
+		}
+
 		d.SetId(vdi.UUID)
+
+		// Caching flags can not be passed to VDI.create
+		if err := updateVDICaching(c, vdi, d.Get(vdiSchemaAllowCaching).(bool), d.Get(vdiSchemaOnBoot).(string)); err != nil {
+			return err
+		}
+
+		if err := updateVDICbt(c, vdi, d.Get(vdiSchemaCbtEnabled).(bool)); err != nil {
+			return err
+		}
 	} else {
 		log.Println("VDI not created!")
 		return err
@@ -144,6 +293,18 @@ func resourceVDIRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	if err := d.Set(vdiSchemaAllowCaching, vdi.AllowCaching); err != nil {
+		return err
+	}
+
+	if err := d.Set(vdiSchemaOnBoot, string(vdi.OnBoot)); err != nil {
+		return err
+	}
+
+	if err := d.Set(vdiSchemaCbtEnabled, vdi.CbtEnabled); err != nil {
+		return err
+	}
+
 	return nil
 }
 func resourceVDIUpdate(d *schema.ResourceData, m interface{}) error {
@@ -180,6 +341,16 @@ func resourceVDIUpdate(d *schema.ResourceData, m interface{}) error {
 	if d.HasChange(vdiSchemaShared) {
 		_, n := d.GetChange(vdiSchemaShared)
 
+		if n.(bool) {
+			if err := validateSharableSR(vdi.SR); err != nil {
+				return err
+			}
+
+			if vdi.SMConfig[vdiSMConfigType] != "raw" {
+				return fmt.Errorf("VDI %s is not a raw volume and can not be shared, it has to be recreated with %q set", vdi.UUID, vdiSchemaShared)
+			}
+		}
+
 		if err := c.client.VDI.SetSharable(c.session, vdi.VDIRef, n.(bool)); err != nil {
 			return err
 		}
@@ -187,6 +358,23 @@ func resourceVDIUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetPartial(vdiSchemaShared)
 	}
 
+	if d.HasChange(vdiSchemaAllowCaching) || d.HasChange(vdiSchemaOnBoot) {
+		if err := updateVDICaching(c, vdi, d.Get(vdiSchemaAllowCaching).(bool), d.Get(vdiSchemaOnBoot).(string)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vdiSchemaAllowCaching)
+		d.SetPartial(vdiSchemaOnBoot)
+	}
+
+	if d.HasChange(vdiSchemaCbtEnabled) {
+		if err := updateVDICbt(c, vdi, d.Get(vdiSchemaCbtEnabled).(bool)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vdiSchemaCbtEnabled)
+	}
+
 	if d.HasChange(vdiSchemaRO) {
 		_, n := d.GetChange(vdiSchemaRO)
 
@@ -251,6 +439,11 @@ func resourceVDIDelete(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
+	if d.Get(vdiSchemaOnDestroy).(string) == vdiOnDestroyForget {
+		log.Printf("[DEBUG] Forgetting VDI %s, its data is kept on SR %s", vdi.UUID, vdi.SR.UUID)
+		return c.client.VDI.Forget(c.session, vdi.VDIRef)
+	}
+
 	log.Printf("[TRACE] Trying to destroy VDI")
 	if err := c.client.VDI.Destroy(c.session, vdi.VDIRef); err != nil {
 		return err
@@ -278,3 +471,156 @@ func resourceVDIExists(d *schema.ResourceData, m interface{}) (bool, error) {
 
 	return true, nil
 }
+
+// Builds sm_config of a new VDI from the configured keys and provisioning type
+func readVDISMConfig(provisioning string, smConfig map[string]interface{}) map[string]string {
+	result := make(map[string]string)
+	for k, v := range smConfig {
+		result[k] = v.(string)
+	}
+
+	if provisioning != "" {
+		result[vdiSMConfigAllocation] = provisioning
+	}
+
+	return result
+}
+
+// Checks that the SR can hold VDIs attached to several VMs at once
+func validateSharableSR(sr *SRDescriptor) error {
+	if !containsString(vdiSharableSRTypes, sr.Type) {
+		return fmt.Errorf("SR %q of type %s does not support sharable VDIs, supported types are %s", sr.Name, sr.Type, strings.Join(vdiSharableSRTypes, ", "))
+	}
+
+	return nil
+}
+
+// Sets whether the VDI may be cached on local storage of the host (IntelliCache) and whether
+// it is reset to its state at attach time on every boot of its VM
+func updateVDICaching(c *Connection, vdi *VDIDescriptor, allowCaching bool, onBoot string) error {
+	if allowCaching != vdi.AllowCaching {
+		if err := c.client.VDI.SetAllowCaching(c.session, vdi.VDIRef, allowCaching); err != nil {
+			return err
+		}
+	}
+
+	if xenAPI.OnBoot(onBoot) != vdi.OnBoot {
+		if err := c.client.VDI.SetOnBoot(c.session, vdi.VDIRef, xenAPI.OnBoot(onBoot)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enables or disables changed block tracking of the VDI. Disabling it discards the
+// metadata of earlier snapshots, so the next backup of the VDI has to be a full one.
+func updateVDICbt(c *Connection, vdi *VDIDescriptor, enabled bool) error {
+	if enabled == vdi.CbtEnabled {
+		return nil
+	}
+
+	log.Printf("[DEBUG] Setting changed block tracking of VDI %s to %t", vdi.UUID, enabled)
+
+	if enabled {
+		return c.client.VDI.EnableCbt(c.session, vdi.VDIRef)
+	}
+
+	return c.client.VDI.DisableCbt(c.session, vdi.VDIRef)
+}
+
+// Creates a fast clone of the source VDI and applies name, size and flags of the record to it.
+// Clones share their blocks with the source and are always created on the SR of the source.
+func cloneVDIFromRecord(c *Connection, sourceUUID string, sr *SRDescriptor, record xenAPI.VDIRecord) (xenAPI.VDIRef, error) {
+	source := &VDIDescriptor{
+		UUID: sourceUUID,
+	}
+	if err := source.Load(c); err != nil {
+		return "", err
+	}
+
+	if source.SR.UUID != sr.UUID {
+		return "", fmt.Errorf("VDI %s can only be cloned on its own SR %s, use xenserver_vdi_copy to copy it to SR %s", source.UUID, source.SR.UUID, sr.UUID)
+	}
+
+	if record.VirtualSize < source.Size {
+		return "", fmt.Errorf("size of the clone must be at least the size of VDI %s, %d bytes", source.UUID, source.Size)
+	}
+
+	if record.Sharable && source.SMConfig[vdiSMConfigType] != "raw" {
+		return "", fmt.Errorf("VDI %s is not a raw volume, its clones can not be shared", source.UUID)
+	}
+
+	clone, err := cloneVDI(c, source, record.NameLabel, record.NameDescription, record.OtherConfig)
+	if err != nil {
+		return "", err
+	}
+
+	err = func() error {
+		if record.VirtualSize > clone.Size {
+			if err := c.client.VDI.Resize(c.session, clone.VDIRef, record.VirtualSize); err != nil {
+				return err
+			}
+		}
+
+		if err := c.client.VDI.SetSharable(c.session, clone.VDIRef, record.Sharable); err != nil {
+			return err
+		}
+
+		return c.client.VDI.SetReadOnly(c.session, clone.VDIRef, record.ReadOnly)
+	}()
+	if err != nil {
+		c.client.VDI.Destroy(c.session, clone.VDIRef)
+		return "", err
+	}
+
+	return clone.VDIRef, nil
+}
+
+// Creates a fast clone of the VDI. Markers of the provider are not inherited from the source,
+// the given other_config entries are set instead.
+func cloneVDI(c *Connection, source *VDIDescriptor, name, description string, otherConfig map[string]string) (*VDIDescriptor, error) {
+	log.Printf("[DEBUG] Cloning VDI %s as %q", source.UUID, name)
+
+	vdiRef, err := c.client.VDI.Clone(c.session, source.VDIRef, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		if err := c.client.VDI.SetNameLabel(c.session, vdiRef, name); err != nil {
+			return err
+		}
+
+		if err := c.client.VDI.SetNameDescription(c.session, vdiRef, description); err != nil {
+			return err
+		}
+
+		for _, key := range []string{vdiOtherConfigInlineDisk, vdiOtherConfigDetachOnly, vdiOtherConfigSourceVDI, vdiOtherConfigTerraformSnapshot, vdiOtherConfigSnapshotReleased} {
+			if err := c.client.VDI.RemoveFromOtherConfig(c.session, vdiRef, key); err != nil {
+				return err
+			}
+		}
+
+		for key, value := range otherConfig {
+			if err := c.client.VDI.AddToOtherConfig(c.session, vdiRef, key, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}()
+	if err != nil {
+		c.client.VDI.Destroy(c.session, vdiRef)
+		return nil, err
+	}
+
+	vdi := &VDIDescriptor{
+		VDIRef: vdiRef,
+	}
+	if err = vdi.Query(c); err != nil {
+		return nil, err
+	}
+
+	return vdi, nil
+}
@@ -0,0 +1,170 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	vdiCopySchemaSourceVDIUUID = "source_vdi_uuid"
+	vdiCopySchemaSRUUID        = "sr_uuid"
+	vdiCopySchemaName          = "name_label"
+	vdiCopySchemaSize          = "size"
+)
+
+func resourceVDICopy() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVDICopyCreate,
+		Read:   resourceVDICopyRead,
+		Update: resourceVDICopyUpdate,
+		Delete: resourceVDICopyDelete,
+		Exists: resourceVDIExists,
+
+		Schema: map[string]*schema.Schema{
+			vdiCopySchemaSourceVDIUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vdiCopySchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vdiCopySchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+
+			vdiCopySchemaSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceVDICopyCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	source := &VDIDescriptor{
+		UUID: d.Get(vdiCopySchemaSourceVDIUUID).(string),
+	}
+	if err := source.Load(c); err != nil {
+		return err
+	}
+
+	sr := &SRDescriptor{
+		UUID: d.Get(vdiCopySchemaSRUUID).(string),
+	}
+	if err := sr.Load(c); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Copying VDI %s to SR %s", source.UUID, sr.UUID)
+
+	vdiRef, err := c.client.VDI.Copy(c.session, source.VDIRef, sr.SRRef, nullRef, nullRef)
+	if err != nil {
+		log.Printf("[ERROR] Failed to copy VDI %s - %s", source.UUID, err)
+		return err
+	}
+
+	vdi := &VDIDescriptor{
+		VDIRef: vdiRef,
+	}
+	if err = vdi.Query(c); err != nil {
+		return err
+	}
+
+	d.SetId(vdi.UUID)
+
+	if name := d.Get(vdiCopySchemaName).(string); name != "" {
+		if err = c.client.VDI.SetNameLabel(c.session, vdiRef, name); err != nil {
+			return err
+		}
+	}
+
+	return resourceVDICopyRead(d, m)
+}
+
+func resourceVDICopyRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vdi := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	if err := d.Set(vdiCopySchemaName, vdi.Name); err != nil {
+		return err
+	}
+
+	if err := d.Set(vdiCopySchemaSize, vdi.Size); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceVDICopyUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vdi := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	if d.HasChange(vdiCopySchemaName) {
+		if err := c.client.VDI.SetNameLabel(c.session, vdi.VDIRef, d.Get(vdiCopySchemaName).(string)); err != nil {
+			return err
+		}
+	}
+
+	return resourceVDICopyRead(d, m)
+}
+
+// Copies attached to VMs are not detached, XenServer refuses to destroy them
+func resourceVDICopyDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vdi := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	if err := c.client.VDI.Destroy(c.session, vdi.VDIRef); err != nil {
+		log.Printf("[ERROR] Failed to destroy VDI %s - %s", vdi.UUID, err)
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+	"os"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	vdiExportSchemaVDIUUID     = "vdi_uuid"
+	vdiExportSchemaDestination = "destination"
+	vdiExportSchemaFormat      = "format"
+	vdiExportSchemaSize        = "size"
+)
+
+func resourceVDIExport() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVDIExportCreate,
+		Read:   resourceVDIExportRead,
+		Delete: resourceVDIExportDelete,
+
+		Schema: map[string]*schema.Schema{
+			vdiExportSchemaVDIUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vdiExportSchemaDestination: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vdiExportSchemaFormat: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      vdiFormatVHD,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice([]string{vdiFormatRaw, vdiFormatVHD}, false),
+			},
+
+			vdiExportSchemaSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceVDIExportCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vdi := &VDIDescriptor{
+		UUID: d.Get(vdiExportSchemaVDIUUID).(string),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	destination := d.Get(vdiExportSchemaDestination).(string)
+
+	size, err := exportRawVDI(c, vdi, d.Get(vdiExportSchemaFormat).(string), destination)
+	if err != nil {
+		log.Printf("[ERROR] Failed to export VDI %s - %s", vdi.UUID, err)
+		return err
+	}
+
+	d.SetId(destination)
+
+	return d.Set(vdiExportSchemaSize, int(size))
+}
+
+func resourceVDIExportRead(d *schema.ResourceData, m interface{}) error {
+	destination := d.Get(vdiExportSchemaDestination).(string)
+
+	// Remote destinations can not be inspected, assume the image is still there
+	if isRemoteLocation(destination) {
+		return nil
+	}
+
+	info, err := os.Stat(destination)
+	if os.IsNotExist(err) {
+		log.Printf("[DEBUG] Exported image %s is gone", destination)
+		d.SetId("")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.Set(vdiExportSchemaSize, int(info.Size()))
+}
+
+// Exported images outlive the resource, destroying it only removes it from the state
+func resourceVDIExportDelete(d *schema.ResourceData, m interface{}) error {
+	d.SetId("")
+	return nil
+}
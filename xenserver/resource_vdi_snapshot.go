@@ -0,0 +1,251 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	vdiSnapshotSchemaVDIUUID      = "vdi_uuid"
+	vdiSnapshotSchemaName         = "name_label"
+	vdiSnapshotSchemaRetention    = "retention"
+	vdiSnapshotSchemaGroup        = "retention_group"
+	vdiSnapshotSchemaSize         = "size"
+	vdiSnapshotSchemaSnapshotTime = "snapshot_time"
+)
+
+func resourceVDISnapshot() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVDISnapshotCreate,
+		Read:   resourceVDISnapshotRead,
+		Update: resourceVDISnapshotUpdate,
+		Delete: resourceVDISnapshotDelete,
+		Exists: resourceVDIExists,
+
+		Schema: map[string]*schema.Schema{
+			vdiSnapshotSchemaVDIUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vdiSnapshotSchemaName: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+
+			vdiSnapshotSchemaRetention: &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+
+			// Snapshots of the same disk and group are counted towards the retention
+			vdiSnapshotSchemaGroup: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			vdiSnapshotSchemaSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			vdiSnapshotSchemaSnapshotTime: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// Destroys the oldest snapshots of the resource's retention group beyond the retention
+func pruneVDISnapshotGroup(c *Connection, d *schema.ResourceData) error {
+	retention := d.Get(vdiSnapshotSchemaRetention).(int)
+	if retention == 0 {
+		return nil
+	}
+
+	vdi := &VDIDescriptor{
+		UUID: d.Get(vdiSnapshotSchemaVDIUUID).(string),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	return pruneVDISnapshots(c, vdi, d.Get(vdiSnapshotSchemaGroup).(string), retention)
+}
+
+func resourceVDISnapshotCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	group := d.Get(vdiSnapshotSchemaGroup).(string)
+	if d.Get(vdiSnapshotSchemaRetention).(int) > 0 && group == "" {
+		return fmt.Errorf("%q requires %q to be set", vdiSnapshotSchemaRetention, vdiSnapshotSchemaGroup)
+	}
+
+	vdi := &VDIDescriptor{
+		UUID: d.Get(vdiSnapshotSchemaVDIUUID).(string),
+	}
+	if err := vdi.Load(c); err != nil {
+		return err
+	}
+
+	name := d.Get(vdiSnapshotSchemaName).(string)
+	if name == "" {
+		name = fmt.Sprintf("%s snapshot %s", vdi.Name, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	snapshotRef, err := snapshotVDI(c, vdi, name, group)
+	if err != nil {
+		log.Printf("[ERROR] Failed to snapshot VDI %s - %s", vdi.UUID, err)
+		return err
+	}
+
+	snapshot := &VDIDescriptor{
+		VDIRef: snapshotRef,
+	}
+	if err = snapshot.Query(c); err != nil {
+		return err
+	}
+
+	d.SetId(snapshot.UUID)
+
+	if err = pruneVDISnapshotGroup(c, d); err != nil {
+		return err
+	}
+
+	return resourceVDISnapshotRead(d, m)
+}
+
+func resourceVDISnapshotRead(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	snapshot := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := snapshot.Load(c); err != nil {
+		if xenErr, ok := err.(*xenAPI.Error); ok && xenErr.Code() == xenAPI.ERR_UUID_INVALID {
+			log.Printf("[WARN] Snapshot %s is gone", d.Id())
+			d.SetId("")
+			return nil
+		}
+		return err
+	}
+
+	record, err := c.client.VDI.GetRecord(c.session, snapshot.VDIRef)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Set(vdiSnapshotSchemaName, record.NameLabel); err != nil {
+		return err
+	}
+
+	if err = d.Set(vdiSnapshotSchemaSize, record.VirtualSize); err != nil {
+		return err
+	}
+
+	return d.Set(vdiSnapshotSchemaSnapshotTime, record.SnapshotTime.UTC().Format(time.RFC3339))
+}
+
+func resourceVDISnapshotUpdate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	snapshot := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := snapshot.Load(c); err != nil {
+		return err
+	}
+
+	if d.HasChange(vdiSnapshotSchemaName) {
+		if err := c.client.VDI.SetNameLabel(c.session, snapshot.VDIRef, d.Get(vdiSnapshotSchemaName).(string)); err != nil {
+			return err
+		}
+	}
+
+	group := d.Get(vdiSnapshotSchemaGroup).(string)
+	if d.Get(vdiSnapshotSchemaRetention).(int) > 0 && group == "" {
+		return fmt.Errorf("%q requires %q to be set", vdiSnapshotSchemaRetention, vdiSnapshotSchemaGroup)
+	}
+
+	if d.HasChange(vdiSnapshotSchemaGroup) {
+		if group == "" {
+			group = vdiSnapshotNoGroup
+		}
+
+		if err := c.client.VDI.RemoveFromOtherConfig(c.session, snapshot.VDIRef, vdiOtherConfigTerraformSnapshot); err != nil {
+			return err
+		}
+		if err := c.client.VDI.AddToOtherConfig(c.session, snapshot.VDIRef, vdiOtherConfigTerraformSnapshot, group); err != nil {
+			return err
+		}
+	}
+
+	// Lowered retention is applied right away instead of on the next snapshot
+	if d.HasChange(vdiSnapshotSchemaRetention) || d.HasChange(vdiSnapshotSchemaGroup) {
+		if err := pruneVDISnapshotGroup(c, d); err != nil {
+			return err
+		}
+	}
+
+	return resourceVDISnapshotRead(d, m)
+}
+
+func resourceVDISnapshotDelete(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	snapshot := &VDIDescriptor{
+		UUID: d.Id(),
+	}
+	if err := snapshot.Load(c); err != nil {
+		return err
+	}
+
+	// With retention the snapshot is kept until newer snapshots of its group expire it
+	if d.Get(vdiSnapshotSchemaRetention).(int) > 0 {
+		log.Printf("[DEBUG] Releasing snapshot %s to its retention group", snapshot.UUID)
+		if err := c.client.VDI.AddToOtherConfig(c.session, snapshot.VDIRef, vdiOtherConfigSnapshotReleased, "true"); err != nil {
+			return err
+		}
+
+		if err := pruneVDISnapshotGroup(c, d); err != nil {
+			return err
+		}
+
+		d.SetId("")
+		return nil
+	}
+
+	if err := c.client.VDI.Destroy(c.session, snapshot.VDIRef); err != nil {
+		log.Printf("[ERROR] Failed to destroy snapshot %s - %s", snapshot.UUID, err)
+		return err
+	}
+
+	d.SetId("")
+	return nil
+}
@@ -23,12 +23,15 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"sort"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/fiveai/go-xen-api-client"
 )
 
@@ -38,8 +41,24 @@ const (
 	vifSchemaMtu         = "mtu"
 	vifSchemaDevice      = "device"
 	vifSchemaOtherConfig = "other_config"
+	vifSchemaMacAddress  = "mac_address"
+	vifSchemaLockingMode = "locking_mode"
+	vifSchemaIPv4Allowed = "ipv4_allowed"
+	vifSchemaIPv6Allowed = "ipv6_allowed"
+	vifSchemaIPv4Address = "ipv4_address"
+	vifSchemaIPv4Gateway = "ipv4_gateway"
+	vifSchemaPromiscuous = "promiscuous"
+	vifSchemaIPv6Address = "ipv6_address"
+	vifSchemaIPv6Gateway = "ipv6_gateway"
+	vifSchemaIPAddresses = "ip_addresses"
 )
 
+// other_config key switching the backend of the VIF to promiscuous mode
+const vifOtherConfigPromiscuous = "promiscuous"
+
+// How long to keep asking the guest to release or accept a network interface before giving up
+const vifPlugTimeout = 2 * time.Minute
+
 func readVIFsFromSchema(c *Connection, s []interface{}) ([]*VIFDescriptor, error) {
 	vifs := make([]*VIFDescriptor, 0, len(s))
 
@@ -54,6 +73,9 @@ func readVIFsFromSchema(c *Connection, s []interface{}) ([]*VIFDescriptor, error
 			return nil, err
 		}
 		mtu := data[vifSchemaMtu].(int)
+		if mtu > network.MTU {
+			return nil, fmt.Errorf("MTU %d of the interface exceeds MTU %d of network %q", mtu, network.MTU, network.Name)
+		}
 		device := data[vifSchemaDevice].(int)
 		var mac string = data[vifSchemaMac].(string)
 		mac_autogenerated := true
@@ -67,6 +89,13 @@ func readVIFsFromSchema(c *Connection, s []interface{}) ([]*VIFDescriptor, error
 			other_config[k] = v.(string)
 		}
 
+		if promiscuous, ok := data[vifSchemaPromiscuous].(bool); ok && promiscuous {
+			if _, ok := other_config[vifOtherConfigPromiscuous]; ok {
+				return nil, fmt.Errorf("%q conflicts with %q in %q", vifSchemaPromiscuous, vifOtherConfigPromiscuous, vifSchemaOtherConfig)
+			}
+			other_config[vifOtherConfigPromiscuous] = "on"
+		}
+
 		vif := &VIFDescriptor{
 			Network:            network,
 			MAC:                mac,
@@ -74,6 +103,13 @@ func readVIFsFromSchema(c *Connection, s []interface{}) ([]*VIFDescriptor, error
 			DeviceOrder:        device,
 			MTU:                mtu,
 			OtherConfig:        other_config,
+			LockingMode:        xenAPI.VifLockingMode(data[vifSchemaLockingMode].(string)),
+			IPv4Allowed:        readStringSet(data[vifSchemaIPv4Allowed].(*schema.Set)),
+			IPv6Allowed:        readStringSet(data[vifSchemaIPv6Allowed].(*schema.Set)),
+			IPv4Address:        data[vifSchemaIPv4Address].(string),
+			IPv4Gateway:        data[vifSchemaIPv4Gateway].(string),
+			IPv6Address:        data[vifSchemaIPv6Address].(string),
+			IPv6Gateway:        data[vifSchemaIPv6Gateway].(string),
 		}
 
 		vifs = append(vifs, vif)
@@ -91,9 +127,18 @@ func fillVIFSchema(vif VIFDescriptor) map[string]interface{} {
 	return map[string]interface{}{
 		vifSchemaNetworkUUID: vif.Network.UUID,
 		vifSchemaMac:         mac,
+		vifSchemaMacAddress:  vif.MAC,
 		vifSchemaMtu:         vif.MTU,
 		vifSchemaDevice:      vif.DeviceOrder,
 		vifSchemaOtherConfig: vif.OtherConfig,
+		vifSchemaLockingMode: string(vif.LockingMode),
+		vifSchemaIPv4Allowed: vif.IPv4Allowed,
+		vifSchemaIPv6Allowed: vif.IPv6Allowed,
+		vifSchemaIPv4Address: vif.IPv4Address,
+		vifSchemaIPv4Gateway: vif.IPv4Gateway,
+		vifSchemaIPv6Address: vif.IPv6Address,
+		vifSchemaIPv6Gateway: vif.IPv6Gateway,
+		vifSchemaPromiscuous: vif.OtherConfig[vifOtherConfigPromiscuous] == "on",
 	}
 }
 
@@ -112,7 +157,13 @@ func createVIF(c *Connection, vif *VIFDescriptor) (*VIFDescriptor, error) {
 		MAC:              vif.MAC,
 		Device:           strconv.Itoa(vif.DeviceOrder),
 		OtherConfig:      vif.OtherConfig,
-		LockingMode:      xenAPI.VifLockingModeNetworkDefault,
+		LockingMode:      vif.LockingMode,
+		Ipv4Allowed:      vif.IPv4Allowed,
+		Ipv6Allowed:      vif.IPv6Allowed,
+	}
+
+	if vifObject.LockingMode == "" {
+		vifObject.LockingMode = xenAPI.VifLockingModeNetworkDefault
 	}
 
 	vifRef, err := c.client.VIF.Create(c.session, vifObject)
@@ -122,6 +173,18 @@ func createVIF(c *Connection, vif *VIFDescriptor) (*VIFDescriptor, error) {
 
 	log.Println(fmt.Sprintf("[DEBUG] Created VIF"))
 
+	if vif.IPv4Address != "" || vif.IPv4Gateway != "" {
+		if err = configureVIFIPv4(c, vifRef, vif.IPv4Address, vif.IPv4Gateway); err != nil {
+			return nil, err
+		}
+	}
+
+	if vif.IPv6Address != "" || vif.IPv6Gateway != "" {
+		if err = configureVIFIPv6(c, vifRef, vif.IPv6Address, vif.IPv6Gateway); err != nil {
+			return nil, err
+		}
+	}
+
 	vif.VIFRef = vifRef
 	err = vif.Query(c)
 	if err != nil {
@@ -131,7 +194,7 @@ func createVIF(c *Connection, vif *VIFDescriptor) (*VIFDescriptor, error) {
 	log.Println(fmt.Sprintf("[DEBUG] VIF  UUID %q", vif.UUID))
 
 	if vif.VM.PowerState == xenAPI.VMPowerStateRunning {
-		err = c.client.VIF.Plug(c.session, vif.VIFRef)
+		err = plugVIF(c, vif.VIFRef, vifPlugTimeout)
 		if err != nil {
 			return nil, err
 		}
@@ -142,6 +205,258 @@ func createVIF(c *Connection, vif *VIFDescriptor) (*VIFDescriptor, error) {
 	return vif, nil
 }
 
+// Hot-plugs the VIF into its running VM. Guests which are still booting refuse the operation,
+// so it is retried until the timeout.
+func plugVIF(c *Connection, vif xenAPI.VIFRef, timeout time.Duration) error {
+	return resource.Retry(timeout, func() *resource.RetryError {
+		err := c.client.VIF.Plug(c.session, vif)
+		if err == nil {
+			return nil
+		}
+
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			switch xenErr.Code() {
+			case xenAPI.ERR_DEVICE_ALREADY_ATTACHED:
+				return nil
+			case xenAPI.ERR_OPERATION_NOT_ALLOWED:
+				log.Printf("[DEBUG] Plugging VIF %s was refused, retrying - %s", vif, err)
+				return resource.RetryableError(err)
+			}
+		}
+
+		return resource.NonRetryableError(err)
+	})
+}
+
+// Hot-unplugs the VIF from its running VM, retrying while the guest refuses to release it
+func unplugVIF(c *Connection, vif xenAPI.VIFRef, timeout time.Duration) error {
+	return resource.Retry(timeout, func() *resource.RetryError {
+		err := c.client.VIF.Unplug(c.session, vif)
+		if err == nil {
+			return nil
+		}
+
+		if xenErr, ok := err.(*xenAPI.Error); ok {
+			switch xenErr.Code() {
+			case xenAPI.ERR_DEVICE_ALREADY_DETACHED:
+				return nil
+			case xenAPI.ERR_DEVICE_DETACH_REJECTED, xenAPI.ERR_OPERATION_NOT_ALLOWED:
+				log.Printf("[DEBUG] Unplugging VIF %s was refused, retrying - %s", vif, err)
+				return resource.RetryableError(err)
+			}
+		}
+
+		return resource.NonRetryableError(err)
+	})
+}
+
+// Assigns the static IPv4 address to the VIF through the guest agent, empty address removes it
+func configureVIFIPv4(c *Connection, vifRef xenAPI.VIFRef, address, gateway string) error {
+	if address == "" && gateway != "" {
+		return fmt.Errorf("%q requires %q to be set", vifSchemaIPv4Gateway, vifSchemaIPv4Address)
+	}
+
+	mode := xenAPI.VifIpv4ConfigurationModeStatic
+	if address == "" {
+		mode = xenAPI.VifIpv4ConfigurationModeNone
+	}
+
+	log.Printf("[DEBUG] Configuring IPv4 of VIF %s: %s %q via %q", vifRef, mode, address, gateway)
+
+	return c.client.VIF.ConfigureIpv4(c.session, vifRef, mode, address, gateway)
+}
+
+// Assigns the static IPv6 address to the VIF through the guest agent, empty address removes it
+func configureVIFIPv6(c *Connection, vifRef xenAPI.VIFRef, address, gateway string) error {
+	if address == "" && gateway != "" {
+		return fmt.Errorf("%q requires %q to be set", vifSchemaIPv6Gateway, vifSchemaIPv6Address)
+	}
+
+	mode := xenAPI.VifIpv6ConfigurationModeStatic
+	if address == "" {
+		mode = xenAPI.VifIpv6ConfigurationModeNone
+	}
+
+	log.Printf("[DEBUG] Configuring IPv6 of VIF %s: %s %q via %q", vifRef, mode, address, gateway)
+
+	return c.client.VIF.ConfigureIpv6(c.session, vifRef, mode, address, gateway)
+}
+
+// Applies locking mode, allowed IPs, static addressing and other_config of the interfaces to the VIFs of the VM in place.
+// Running VMs pick up locking changes immediately, other_config is read by the backend on the next plug.
+func updateVIFs(c *Connection, vm *VMDescriptor, s []interface{}, old []interface{}) error {
+	vifRefs, err := c.client.VM.GetVIFs(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	vifs := make(map[int]*VIFDescriptor)
+	for _, vifRef := range vifRefs {
+		vif := &VIFDescriptor{
+			VIFRef: vifRef,
+			VM:     vm,
+		}
+		if err = vif.Query(c); err != nil {
+			return err
+		}
+		vifs[vif.DeviceOrder] = vif
+	}
+
+	for _, schm := range s {
+		data := schm.(map[string]interface{})
+
+		vif, ok := vifs[data[vifSchemaDevice].(int)]
+		if !ok {
+			continue
+		}
+
+		lockingMode := xenAPI.VifLockingMode(data[vifSchemaLockingMode].(string))
+		if lockingMode != vif.LockingMode {
+			log.Printf("[DEBUG] Setting locking mode of VIF %s to %s", vif.UUID, lockingMode)
+			if err = c.client.VIF.SetLockingMode(c.session, vif.VIFRef, lockingMode); err != nil {
+				return err
+			}
+		}
+
+		ipv4Allowed := readStringSet(data[vifSchemaIPv4Allowed].(*schema.Set))
+		if !sameStrings(ipv4Allowed, vif.IPv4Allowed) {
+			if err = c.client.VIF.SetIpv4Allowed(c.session, vif.VIFRef, ipv4Allowed); err != nil {
+				return err
+			}
+		}
+
+		ipv6Allowed := readStringSet(data[vifSchemaIPv6Allowed].(*schema.Set))
+		if !sameStrings(ipv6Allowed, vif.IPv6Allowed) {
+			if err = c.client.VIF.SetIpv6Allowed(c.session, vif.VIFRef, ipv6Allowed); err != nil {
+				return err
+			}
+		}
+
+		ipv4Address := data[vifSchemaIPv4Address].(string)
+		ipv4Gateway := data[vifSchemaIPv4Gateway].(string)
+		if ipv4Address != vif.IPv4Address || ipv4Gateway != vif.IPv4Gateway {
+			if err = configureVIFIPv4(c, vif.VIFRef, ipv4Address, ipv4Gateway); err != nil {
+				return err
+			}
+		}
+
+		ipv6Address := data[vifSchemaIPv6Address].(string)
+		ipv6Gateway := data[vifSchemaIPv6Gateway].(string)
+		if ipv6Address != vif.IPv6Address || ipv6Gateway != vif.IPv6Gateway {
+			if err = configureVIFIPv6(c, vif.VIFRef, ipv6Address, ipv6Gateway); err != nil {
+				return err
+			}
+		}
+
+		otherConfig, _ := data[vifSchemaOtherConfig].(map[string]interface{})
+		for k, v := range otherConfig {
+			if vif.OtherConfig[k] == v.(string) {
+				continue
+			}
+			if _, ok := vif.OtherConfig[k]; ok {
+				if err = c.client.VIF.RemoveFromOtherConfig(c.session, vif.VIFRef, k); err != nil {
+					return err
+				}
+			}
+			log.Printf("[DEBUG] Setting other_config %s of VIF %s", k, vif.UUID)
+			if err = c.client.VIF.AddToOtherConfig(c.session, vif.VIFRef, k, v.(string)); err != nil {
+				return err
+			}
+		}
+
+		promiscuous := data[vifSchemaPromiscuous].(bool)
+		if promiscuous != (vif.OtherConfig[vifOtherConfigPromiscuous] == "on") {
+			if err = updateVIFPromiscuous(c, vif, promiscuous); err != nil {
+				return err
+			}
+		}
+
+		hash := vifHash(data)
+		for _, previous := range old {
+			if vifHash(previous) != hash {
+				continue
+			}
+
+			oldOtherConfig, _ := previous.(map[string]interface{})[vifSchemaOtherConfig].(map[string]interface{})
+			for k := range oldOtherConfig {
+				if _, ok := otherConfig[k]; ok {
+					continue
+				}
+				if k == vifOtherConfigPromiscuous && promiscuous {
+					continue
+				}
+				if _, ok := vif.OtherConfig[k]; !ok {
+					continue
+				}
+				if err = c.client.VIF.RemoveFromOtherConfig(c.session, vif.VIFRef, k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Switches promiscuous mode of the VIF. The backend only reads the flag when the VIF is plugged,
+// so VIFs of running VMs are plugged again.
+func updateVIFPromiscuous(c *Connection, vif *VIFDescriptor, promiscuous bool) error {
+	log.Printf("[DEBUG] Setting promiscuous mode of VIF %s to %t", vif.UUID, promiscuous)
+
+	if _, ok := vif.OtherConfig[vifOtherConfigPromiscuous]; ok {
+		if err := c.client.VIF.RemoveFromOtherConfig(c.session, vif.VIFRef, vifOtherConfigPromiscuous); err != nil {
+			return err
+		}
+	}
+	if promiscuous {
+		if err := c.client.VIF.AddToOtherConfig(c.session, vif.VIFRef, vifOtherConfigPromiscuous, "on"); err != nil {
+			return err
+		}
+	}
+
+	if !vif.CurrentlyAttached {
+		return nil
+	}
+
+	if err := unplugVIF(c, vif.VIFRef, vifPlugTimeout); err != nil {
+		return err
+	}
+
+	return plugVIF(c, vif.VIFRef, vifPlugTimeout)
+}
+
+// Reduces other_config of the VIFs read from XAPI to the keys configured for the same interface,
+// as XAPI and guest tools keep their own keys there
+func filterVIFsOtherConfig(vifs []map[string]interface{}, configured *schema.Set) {
+	for _, data := range vifs {
+		managed := make(map[string]interface{})
+		hash := vifHash(data)
+		for _, schm := range configured.List() {
+			if vifHash(schm) == hash {
+				managed, _ = schm.(map[string]interface{})[vifSchemaOtherConfig].(map[string]interface{})
+				break
+			}
+		}
+
+		data[vifSchemaOtherConfig] = filterManagedMap(data[vifSchemaOtherConfig].(map[string]string), managed)
+	}
+}
+
+// Returns true if both slices hold the same strings, regardless of their order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, v := range a {
+		if !containsString(b, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func vifHash(v interface{}) int {
 	var buf bytes.Buffer
 	m := v.(map[string]interface{})
@@ -152,28 +467,7 @@ func vifHash(v interface{}) int {
 	b, _ = buf.WriteString(fmt.Sprintf("%s-",
 		strings.ToLower(m["mac"].(string))))
 
-	if _otherConfig, ok := m[vifSchemaOtherConfig]; ok {
-		var otherConfig = make(map[string]string)
-
-		for k, v := range _otherConfig.(map[string]interface{}) {
-			otherConfig[k] = v.(string)
-		}
-
-		// Sort keys to guarantee order
-		var keys []string
-		for k, _ := range otherConfig {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		b, _ = buf.WriteRune('>')
-		for _, k := range keys {
-			b, _ = buf.WriteString(k)
-			b, _ = buf.WriteString(":")
-			b, _ = buf.WriteString(otherConfig[k])
-			b, _ = buf.WriteString(";")
-		}
-		b, _ = buf.WriteRune('<')
-	}
+	// other_config is left out of the hash, so it can be changed without replacing the interface
 
 	count += b
 	log.Println("Consumed total ", count, " bytes to generate hash")
@@ -190,8 +484,15 @@ func resourceVIF() *schema.Resource {
 				Optional: true,
 			},
 			vifSchemaMac: &schema.Schema{
+				Type:             schema.TypeString,
+				Optional:         true,
+				ValidateFunc:     validateMAC,
+				DiffSuppressFunc: ignoreCaseDiffSuppressFunc,
+			},
+			// MAC of the VIF, including MACs generated by XenServer
+			vifSchemaMacAddress: &schema.Schema{
 				Type:     schema.TypeString,
-				Optional: true,
+				Computed: true,
 			},
 			vifSchemaMtu: &schema.Schema{
 				Type:     schema.TypeInt,
@@ -206,6 +507,120 @@ func resourceVIF() *schema.Resource {
 				Type:     schema.TypeMap,
 				Optional: true,
 			},
+			vifSchemaLockingMode: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  string(xenAPI.VifLockingModeNetworkDefault),
+				ValidateFunc: validation.StringInSlice([]string{
+					string(xenAPI.VifLockingModeNetworkDefault),
+					string(xenAPI.VifLockingModeLocked),
+					string(xenAPI.VifLockingModeUnlocked),
+					string(xenAPI.VifLockingModeDisabled),
+				}, false),
+			},
+			vifSchemaIPv4Allowed: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+			vifSchemaIPv6Allowed: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+			vifSchemaPromiscuous: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			vifSchemaIPv4Address: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateIPv4CIDR,
+			},
+			vifSchemaIPv4Gateway: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateIPv4,
+			},
+			// Addresses reported by the guest agent for the device
+			vifSchemaIPAddresses: &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			vifSchemaIPv6Address: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateIPv6CIDR,
+			},
+			vifSchemaIPv6Gateway: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateIPv6,
+			},
 		},
 	}
 }
+
+func validateMAC(v interface{}, k string) (ws []string, errors []error) {
+	mac := v.(string)
+	if mac == "" {
+		return
+	}
+
+	if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+		errors = append(errors, fmt.Errorf("%q must be a MAC address like 02:00:00:00:00:01, got %q", k, mac))
+	}
+	return
+}
+
+func validateIPv4CIDR(v interface{}, k string) (ws []string, errors []error) {
+	address := v.(string)
+	if address == "" {
+		return
+	}
+
+	if ip, _, err := net.ParseCIDR(address); err != nil || ip.To4() == nil {
+		errors = append(errors, fmt.Errorf("%q must be an IPv4 address with prefix length like 192.168.0.10/24, got %q", k, address))
+	}
+	return
+}
+
+func validateIPv4(v interface{}, k string) (ws []string, errors []error) {
+	address := v.(string)
+	if address == "" {
+		return
+	}
+
+	if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+		errors = append(errors, fmt.Errorf("%q must be an IPv4 address like 192.168.0.1, got %q", k, address))
+	}
+	return
+}
+
+func validateIPv6CIDR(v interface{}, k string) (ws []string, errors []error) {
+	address := v.(string)
+	if address == "" {
+		return
+	}
+
+	if ip, _, err := net.ParseCIDR(address); err != nil || ip.To4() != nil {
+		errors = append(errors, fmt.Errorf("%q must be an IPv6 address with prefix length like 2001:db8::10/64, got %q", k, address))
+	}
+	return
+}
+
+func validateIPv6(v interface{}, k string) (ws []string, errors []error) {
+	address := v.(string)
+	if address == "" {
+		return
+	}
+
+	if ip := net.ParseIP(address); ip == nil || ip.To4() != nil {
+		errors = append(errors, fmt.Errorf("%q must be an IPv6 address like 2001:db8::1, got %q", k, address))
+	}
+	return
+}
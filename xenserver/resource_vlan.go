@@ -19,6 +19,7 @@
 package xenserver
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/hashicorp/terraform/helper/schema"
@@ -32,8 +33,12 @@ const (
 	vlanSchemaPIF         = "pif"
 	vlanSchemaOtherConfig = "other_config"
 	vlanSchemaNetwork     = "network"
+	vlanSchemaNetworkName = "network_name_label"
 )
 
+// Marks networks created together with a VLAN, so they are destroyed with it
+const networkOtherConfigVLAN = "terraform_vlan_network"
+
 func resourceVLAN() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceVLANCreate,
@@ -58,7 +63,15 @@ func resourceVLAN() *schema.Resource {
 			vlanSchemaNetwork: &schema.Schema{
 				ForceNew: true,
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+				Computed: true,
+			},
+
+			vlanSchemaNetworkName: &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{vlanSchemaNetwork},
 			},
 
 			vlanSchemaOtherConfig: &schema.Schema{
@@ -80,16 +93,23 @@ func resourceVLANCreate(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
-	network := NetworkDescriptor{
+	tag := d.Get(vlanSchemaTag).(int)
+
+	network := &NetworkDescriptor{
 		UUID: d.Get(vlanSchemaNetwork).(string),
 	}
 
-	if err := network.Load(c); err != nil {
-		return err
+	if network.UUID != "" {
+		if err := network.Load(c); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if network, err = createVLANNetwork(c, d.Get(vlanSchemaNetworkName).(string), tag); err != nil {
+			return err
+		}
 	}
 
-	tag := d.Get(vlanSchemaTag).(int)
-
 	if vlanRef, err := c.client.VLAN.Create(c.session, pif.PIFRef, tag, network.NetworkRef); err == nil {
 		log.Println("VLAN Created")
 		vlan := &VLANDescriptor{
@@ -103,19 +123,52 @@ func resourceVLANCreate(d *schema.ResourceData, m interface{}) error {
 		d.SetId(vlan.UUID)
 
 		if _otherConfig, ok := d.GetOk(vlanSchemaOtherConfig); ok {
-			otherConfig := _otherConfig.(map[string]string)
+			otherConfig := _otherConfig.(map[string]interface{})
 			for k, v := range otherConfig {
-				if err := c.client.VLAN.AddToOtherConfig(c.session, vlan.VLANRef, k, v); err != nil {
+				if err := c.client.VLAN.AddToOtherConfig(c.session, vlan.VLANRef, k, v.(string)); err != nil {
 					return err
 				}
 			}
 		}
 	} else {
 		log.Println("VLAN not created!")
+		if network.OtherConfig[networkOtherConfigVLAN] == "true" {
+			c.client.Network.Destroy(c.session, network.NetworkRef)
+		}
 		return err
 	}
 
-	return nil
+	return resourceVLANRead(d, m)
+}
+
+// Creates the network carrying the traffic of a new VLAN
+func createVLANNetwork(c *Connection, name string, tag int) (*NetworkDescriptor, error) {
+	if name == "" {
+		name = fmt.Sprintf("VLAN %d", tag)
+	}
+
+	networkRef, err := c.client.Network.Create(c.session, xenAPI.NetworkRecord{
+		NameLabel:       name,
+		NameDescription: "Created by terraform",
+		MTU:             networkDefaultMTU,
+		OtherConfig: map[string]string{
+			networkOtherConfigVLAN: "true",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	network := &NetworkDescriptor{
+		NetworkRef: networkRef,
+	}
+	if err = network.Query(c); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DEBUG] Created network %s for VLAN %d", network.UUID, tag)
+
+	return network, nil
 }
 
 func resourceVLANRead(d *schema.ResourceData, m interface{}) error {
@@ -134,11 +187,24 @@ func resourceVLANRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
-	if err := d.Set(vlanSchemaOtherConfig, vlan.OtherConfig); err != nil {
+	dOtherConfig := d.Get(vlanSchemaOtherConfig).(map[string]interface{})
+	if err := d.Set(vlanSchemaOtherConfig, filterManagedMap(vlan.OtherConfig, dOtherConfig)); err != nil {
+		return err
+	}
+
+	// VLAN tags traffic of the untagged PIF it creates and sends it through the physical, tagged PIF
+	if err := d.Set(vlanSchemaPIF, vlan.TaggedPIF.UUID); err != nil {
+		return err
+	}
+
+	network := &NetworkDescriptor{
+		NetworkRef: vlan.UntaggedPIF.Network,
+	}
+	if err := network.Query(c); err != nil {
 		return err
 	}
 
-	if err := d.Set(vlanSchemaPIF, vlan.UntaggedPIF); err != nil {
+	if err := d.Set(vlanSchemaNetwork, network.UUID); err != nil {
 		return err
 	}
 
@@ -156,14 +222,10 @@ func resourceVLANUpdate(d *schema.ResourceData, m interface{}) error {
 	}
 
 	if d.HasChange(vlanSchemaOtherConfig) {
-		_, n := d.GetChange(vlanSchemaOtherConfig)
-		otherConfig := make(map[string]string)
-
-		for k, v := range n.(map[string]interface{}) {
-			otherConfig[k] = v.(string)
-		}
+		o, n := d.GetChange(vlanSchemaOtherConfig)
+		mergeManagedMap(vlan.OtherConfig, o.(map[string]interface{}), n.(map[string]interface{}))
 
-		if err := c.client.VLAN.SetOtherConfig(c.session, vlan.VLANRef, otherConfig); err != nil {
+		if err := c.client.VLAN.SetOtherConfig(c.session, vlan.VLANRef, vlan.OtherConfig); err != nil {
 			return err
 		}
 
@@ -183,10 +245,24 @@ func resourceVLANDelete(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	network := &NetworkDescriptor{
+		NetworkRef: vlan.UntaggedPIF.Network,
+	}
+	if err := network.Query(c); err != nil {
+		return err
+	}
+
 	if err := c.client.VLAN.Destroy(c.session, vlan.VLANRef); err != nil {
 		return err
 	}
 
+	if network.OtherConfig[networkOtherConfigVLAN] == "true" {
+		log.Printf("[DEBUG] Destroying network %s of VLAN %d", network.UUID, vlan.Tag)
+		if err := c.client.Network.Destroy(c.session, network.NetworkRef); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 func resourceVLANExists(d *schema.ResourceData, m interface{}) (bool, error) {
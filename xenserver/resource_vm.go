@@ -22,16 +22,25 @@ package xenserver
 import (
 	"fmt"
 	"log"
+	"net"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/fiveai/go-xen-api-client"
 	"github.com/davecgh/go-spew/spew"
 )
 
 const (
 	vmSchemaNameLabel                 = "name_label"
+	vmSchemaNameDescription           = "name_description"
 	vmSchemaBaseTemplateName          = "base_template_name"
+	vmSchemaImportXVA                 = "import_xva"
 	vmSchemaStaticMemoryMin           = "static_mem_min"
 	vmSchemaStaticMemoryMax           = "static_mem_max"
 	vmSchemaDynamicMemoryMin          = "dynamic_mem_min"
@@ -44,8 +53,65 @@ const (
 	vmSchemaInstallationMediaType     = "installation_media_type"
 	vmSchemaInstallationMediaLocation = "installation_media_location"
 	vmSchemaVcpus                     = "vcpus"
+	vmSchemaVcpusMax                  = "vcpus_max"
+	vmSchemaVcpusAtStartup            = "vcpus_at_startup"
 	vmSchemaCoresPerSocket            = "cores_per_socket"
 	vmSchemaXenstoreData              = "xenstore_data"
+	vmSchemaCloudInit                 = "cloud_init"
+	vmSchemaWindowsUnattend           = "windows_unattend"
+	vmSchemaWaitForIP                 = "wait_for_ip"
+	vmSchemaWaitForTools              = "wait_for_tools"
+	vmSchemaIPAddress                 = "ip_address"
+	vmSchemaIPAddresses               = "ip_addresses"
+	vmSchemaAffinityHost              = "affinity_host"
+	vmSchemaResidentOn                = "resident_on"
+	vmSchemaPlacementStrategy         = "placement_strategy"
+	vmSchemaHARestartPriority         = "ha_restart_priority"
+	vmSchemaHAAlwaysRun               = "ha_always_run"
+	vmSchemaOrder                     = "order"
+	vmSchemaStartDelay                = "start_delay"
+	vmSchemaShutdownDelay             = "shutdown_delay"
+	vmSchemaFirmware                  = "firmware"
+	vmSchemaSecureBoot                = "secure_boot"
+	vmSchemaPlatform                  = "platform"
+	vmSchemaOtherConfig               = "other_config"
+	vmSchemaTags                      = "tags"
+	vmSchemaBlockedOperations         = "blocked_operations"
+	vmSchemaDestroyProtection         = "destroy_protection"
+	vmSchemaPowerState                = "power_state"
+	vmSchemaForcePowerTransitions     = "force_power_transitions"
+	vmSchemaShutdownTimeout           = "shutdown_timeout"
+	vmSchemaMigrationSRUUID           = "migration_sr_uuid"
+	vmSchemaOnDestroy                 = "on_destroy"
+	vmSchemaSnapshotBeforeUpdate      = "snapshot_before_update"
+	vmSchemaSnapshotBeforeDestroy     = "snapshot_before_destroy"
+	vmSchemaSnapshotRetention         = "snapshot_retention"
+	vmSchemaAllowRestart              = "allow_restart"
+	vmSchemaCPUFeatures               = "cpu_features"
+	vmSchemaVCPUParams                = "vcpu_params"
+	vmSchemaVGA                       = "vga"
+	vmSchemaVideoRAM                  = "videoram"
+	vmSchemaGuestType                 = "guest_type"
+	vmSchemaBIOSStrings               = "bios_strings"
+	vmSchemaBIOSStringsHost           = "bios_strings_host"
+	vmSchemaNVRAM                     = "nvram"
+	vmSchemaNVRAMContents             = "nvram_contents"
+	vmSchemaGenerationID              = "generation_id"
+
+	vmFirmwareBIOS = "bios"
+	vmFirmwareUEFI = "uefi"
+
+	// Platform key holding the CPUID featureset exposed to the guest
+	vmPlatformFeatureset = "featureset"
+
+	vmVGAStd    = "std"
+	vmVGACirrus = "cirrus"
+
+	vmGuestTypeWindows = "windows"
+	vmGuestTypeLinux   = "linux"
+
+	vmOnDestroyDestroy           = "destroy"
+	vmOnDestroyConvertToTemplate = "convert_to_template"
 )
 
 // Returns the schema for the VM resource
@@ -57,22 +123,45 @@ func resourceVM() *schema.Resource {
 		Delete: resourceVMDelete,
 		Exists: resourceVMExists,
 
+		CustomizeDiff: resourceVMCustomizeDiff,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(10 * time.Minute),
+		},
+
 		Schema: map[string]*schema.Schema{
 			vmSchemaNameLabel: &schema.Schema{
 				Type:     schema.TypeString,
 				Required: true,
 			},
 
-			vmSchemaBaseTemplateName: &schema.Schema{
+			vmSchemaNameDescription: &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+				Computed: true,
+			},
+
+			vmSchemaBaseTemplateName: &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{vmSchemaImportXVA},
+			},
+
+			vmSchemaImportXVA: &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ForceNew:      true,
+				MaxItems:      1,
+				Elem:          resourceXVAImport(),
+				ConflictsWith: []string{vmSchemaBaseTemplateName},
 			},
 
 			vmSchemaXenstoreData: &schema.Schema{
-				Type:     schema.TypeMap,
-				Optional: true,
-				Default:  nil,
-				Computed: true,
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Default:      nil,
+				Computed:     true,
+				ValidateFunc: validateXenstoreData,
 			},
 
 			vmSchemaStaticMemoryMin: &schema.Schema{
@@ -100,6 +189,7 @@ func resourceVM() *schema.Resource {
 				Optional:         true,
 				Default:          "dc",
 				DiffSuppressFunc: ignoreCaseDiffSuppressFunc,
+				ValidateFunc:     validateBootOrder,
 			},
 
 			vmSchemaNetworkInterfaces: &schema.Schema{
@@ -119,8 +209,8 @@ func resourceVM() *schema.Resource {
 			vmSchemaCdRom: &schema.Schema{
 				Type:     schema.TypeSet,
 				Optional: true,
-				Elem:     resourceVBD(),
-				Set:      vbdHash,
+				Elem:     resourceCDROM(),
+				Set:      cdromHash,
 			},
 
 			vmSchemaBootParameters: &schema.Schema{
@@ -139,19 +229,425 @@ func resourceVM() *schema.Resource {
 			},
 
 			vmSchemaVcpus: &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Computed:      true,
+				ConflictsWith: []string{vmSchemaVcpusMax, vmSchemaVcpusAtStartup},
+			},
+
+			vmSchemaVcpusMax: &schema.Schema{
 				Type:     schema.TypeInt,
-				Required: true,
+				Optional: true,
+				Computed: true,
+			},
+
+			vmSchemaVcpusAtStartup: &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Computed: true,
 			},
 
 			vmSchemaCoresPerSocket: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+
+			vmSchemaCPUFeatures: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateCPUFeatures,
+			},
+
+			vmSchemaBIOSStrings: &schema.Schema{
+				Type:          schema.TypeMap,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{vmSchemaBIOSStringsHost},
+				ValidateFunc:  validateBIOSStrings,
+			},
+
+			vmSchemaBIOSStringsHost: &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{vmSchemaBIOSStrings},
+			},
+
+			vmSchemaNVRAM: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			vmSchemaNVRAMContents: &schema.Schema{
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+
+			vmSchemaGenerationID: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			vmSchemaGuestType: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{vmGuestTypeWindows, vmGuestTypeLinux}, false),
+			},
+
+			vmSchemaVGA: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{vmVGAStd, vmVGACirrus}, false),
+			},
+
+			vmSchemaVideoRAM: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntBetween(1, 16),
+			},
+
+			vmSchemaVCPUParams: &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem:     resourceVCPUParams(),
+			},
+
+			vmSchemaCloudInit: &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: true,
+				MaxItems: 1,
+				Elem:     resourceCloudInit(),
+			},
+
+			vmSchemaWindowsUnattend: &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: true,
+				MaxItems: 1,
+				Elem:     resourceWindowsUnattend(),
+			},
+
+			vmSchemaWaitForIP: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaWaitForTools: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaIPAddress: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			vmSchemaIPAddresses: &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			vmSchemaAffinityHost: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			vmSchemaResidentOn: &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			vmSchemaPlacementStrategy: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      placementStrategyDefault,
+				ValidateFunc: validation.StringInSlice(placementStrategies, false),
+			},
+
+			vmSchemaHARestartPriority: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "",
+				ValidateFunc: validation.StringInSlice([]string{"", "restart", "best-effort"}, false),
+			},
+
+			vmSchemaHAAlwaysRun: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaOrder: &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+
+			vmSchemaStartDelay: &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+
+			vmSchemaShutdownDelay: &schema.Schema{
 				Type:     schema.TypeInt,
 				Optional: true,
+				Default:  0,
+			},
+
+			vmSchemaFirmware: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice([]string{vmFirmwareBIOS, vmFirmwareUEFI}, false),
+			},
+
+			vmSchemaSecureBoot: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
 				Computed: true,
 			},
+
+			vmSchemaPlatform: &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			vmSchemaOtherConfig: &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				ValidateFunc: validateVMOtherConfig,
+			},
+
+			vmSchemaTags: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Set:      schema.HashString,
+			},
+
+			vmSchemaBlockedOperations: &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringInSlice(vmBlockableOperations, false),
+				},
+				Set: schema.HashString,
+			},
+
+			vmSchemaDestroyProtection: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaPowerState: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      powerStateRunning,
+				ValidateFunc: validation.StringInSlice(powerStates, false),
+			},
+
+			vmSchemaForcePowerTransitions: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaShutdownTimeout: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      120,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+
+			vmSchemaMigrationSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			vmSchemaOnDestroy: &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      vmOnDestroyDestroy,
+				ValidateFunc: validation.StringInSlice([]string{vmOnDestroyDestroy, vmOnDestroyConvertToTemplate}, false),
+			},
+
+			vmSchemaSnapshotBeforeUpdate: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaSnapshotBeforeDestroy: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			vmSchemaSnapshotRetention: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+
+			vmSchemaAllowRestart: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 		},
 	}
 }
 
+// Validates HVM boot order: any combination of c (disk), d (CD) and n (network)
+func validateBootOrder(v interface{}, k string) (ws []string, errors []error) {
+	order := strings.ToLower(v.(string))
+
+	for _, device := range order {
+		if !strings.ContainsRune("cdn", device) {
+			errors = append(errors, fmt.Errorf("%q contains unknown boot device %q, expected any of c, d and n", k, device))
+		}
+	}
+
+	if strings.Count(order, "c") > 1 || strings.Count(order, "d") > 1 || strings.Count(order, "n") > 1 {
+		errors = append(errors, fmt.Errorf("%q lists a boot device more than once", k))
+	}
+
+	return
+}
+
+// BIOS strings which XAPI allows to override
+var vmBIOSStringKeys = []string{
+	"bios-vendor",
+	"bios-version",
+	"system-manufacturer",
+	"system-product-name",
+	"system-version",
+	"system-serial-number",
+	"baseboard-manufacturer",
+	"baseboard-product-name",
+	"baseboard-version",
+	"baseboard-serial-number",
+	"baseboard-asset-tag",
+	"baseboard-location-in-chassis",
+	"enclosure-asset-tag",
+}
+
+func validateBIOSStrings(v interface{}, k string) (ws []string, errors []error) {
+	for key := range v.(map[string]interface{}) {
+		if !containsString(vmBIOSStringKeys, key) {
+			errors = append(errors, fmt.Errorf("%q key %q can not be overridden, expected one of %s", k, key, strings.Join(vmBIOSStringKeys, ", ")))
+		}
+	}
+
+	return
+}
+
+var cpuFeaturesRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{8})*$`)
+
+// Validates the featureset is in the format XAPI uses for CPU features of hosts and pools
+func validateCPUFeatures(v interface{}, k string) (ws []string, errors []error) {
+	if !cpuFeaturesRegexp.MatchString(v.(string)) {
+		errors = append(errors, fmt.Errorf("%q must be hexadecimal words separated by dashes, e.g. \"1fcbfbff-f7fa3223-2d93fbff-00000023\"", k))
+	}
+
+	return
+}
+
+// Validates that all xenstore keys live under vm-data, as XAPI refuses anything else
+func validateXenstoreData(v interface{}, k string) (ws []string, errors []error) {
+	for key := range v.(map[string]interface{}) {
+		if key != "vm-data" && !strings.HasPrefix(key, "vm-data/") {
+			errors = append(errors, fmt.Errorf("%q key %q must start with \"vm-data/\"", k, key))
+		}
+	}
+
+	return
+}
+
+// Validates that other_config does not override keys maintained by the provider
+func validateVMOtherConfig(v interface{}, k string) (ws []string, errors []error) {
+	if _, ok := v.(map[string]interface{})["base_template_name"]; ok {
+		errors = append(errors, fmt.Errorf("%q must not contain %q, it is maintained by the provider", k, "base_template_name"))
+	}
+
+	for key := range v.(map[string]interface{}) {
+		if strings.HasPrefix(key, vmOtherConfigGuestTypePresetPrefix) {
+			errors = append(errors, fmt.Errorf("%q must not contain %q, it is maintained by the provider", k, key))
+		}
+	}
+
+	return
+}
+
+const vmOperationDestroy = "destroy"
+
+// Operations which may be blocked through blocked_operations
+var vmBlockableOperations = []string{
+	vmOperationDestroy,
+	"start",
+	"start_on",
+	"clean_shutdown",
+	"hard_shutdown",
+	"shutdown",
+	"clean_reboot",
+	"hard_reboot",
+	"suspend",
+	"resume",
+	"pause",
+	"unpause",
+	"pool_migrate",
+	"migrate_send",
+	"snapshot",
+	"checkpoint",
+	"revert",
+	"clone",
+	"copy",
+	"export",
+	"make_into_template",
+	"changing_memory_live",
+	"changing_dynamic_range",
+	"changing_static_range",
+	"changing_VCPUs",
+	"changing_VCPUs_live",
+}
+
+// Requires new VMs to come from either a template or an XVA, the schema only rejects both
+func resourceVMCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	if d.Id() != "" {
+		return nil
+	}
+
+	_, templateOk := d.GetOk(vmSchemaBaseTemplateName)
+	_, xvaOk := d.GetOk(vmSchemaImportXVA)
+	if !templateOk && !xvaOk {
+		return fmt.Errorf("one of %q or %q must be set", vmSchemaBaseTemplateName, vmSchemaImportXVA)
+	}
+
+	return nil
+}
+
+// Checks that VCPUs can be split evenly into sockets
+func validateCoresPerSocket(vcpus, coresPerSocket int) error {
+	if coresPerSocket < 1 || vcpus%coresPerSocket != 0 {
+		return fmt.Errorf("%d cores could not fit to %d cores-per-socket topology", vcpus, coresPerSocket)
+	}
+	return nil
+}
+
 func filterVMTemplates(c *Connection, vms []xenAPI.VMRef) ([]xenAPI.VMRef, error) {
 	var templates []xenAPI.VMRef
 	for _, vm := range vms {
@@ -166,57 +662,140 @@ func filterVMTemplates(c *Connection, vms []xenAPI.VMRef) ([]xenAPI.VMRef, error
 	return templates, nil
 }
 
-func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
+func resourceVMCreate(d *schema.ResourceData, m interface{}) (err error) {
 	log.Printf("[TRACE] resourceVMCreate - %s", d.Id())
 
 	c := m.(*Connection)
 
+	dNameLabel := d.Get(vmSchemaNameLabel).(string)
 	dBaseTemplateName := d.Get(vmSchemaBaseTemplateName).(string)
+	dImportXVA := d.Get(vmSchemaImportXVA).([]interface{})
 
-	log.Printf("[TRACE] Creating VM with base template name %s", dBaseTemplateName)
+	// Validate the topology against the configured VCPUs before anything is created.
+	// VCPUs inherited from the template are validated once the VM is cloned.
+	if _coresPerSocket, ok := d.GetOk(vmSchemaCoresPerSocket); ok {
+		vcpus, ok := d.GetOk(vmSchemaVcpusMax)
+		if !ok {
+			vcpus, ok = d.GetOk(vmSchemaVcpus)
+		}
 
-	xenBaseTemplates, err := c.client.VM.GetByNameLabel(c.session, dBaseTemplateName)
-	if err != nil {
-		log.Printf("[ERROR] Failed to find template with name %s - %s", dBaseTemplateName, err)
-		return err
+		if ok {
+			if err = validateCoresPerSocket(vcpus.(int), _coresPerSocket.(int)); err != nil {
+				return err
+			}
+		}
 	}
 
-	xenBaseTemplates, err = filterVMTemplates(c, xenBaseTemplates)
-	if err != nil {
-		log.Printf("[ERROR] Error filtering templates - %s", err)
-		return err
+	if len(dImportXVA) == 0 && dBaseTemplateName == "" {
+		return fmt.Errorf("one of %q or %q must be set", vmSchemaBaseTemplateName, vmSchemaImportXVA)
 	}
 
-	if len(xenBaseTemplates) == 0 {
-		return fmt.Errorf("no VM template with label %q has been found", dBaseTemplateName)
-	}
+	var xenVM xenAPI.VMRef
 
-	if len(xenBaseTemplates) > 1 {
-		return fmt.Errorf("more than one VM template with label %q has been found", dBaseTemplateName)
-	}
+	if len(dImportXVA) > 0 {
+		data := dImportXVA[0].(map[string]interface{})
 
-	xenBaseTemplate := xenBaseTemplates[0]
+		sr := &SRDescriptor{
+			UUID: data[xvaImportSchemaSRUUID].(string),
+		}
+		if err = sr.Load(c); err != nil {
+			return err
+		}
 
-	dNameLabel := d.Get(vmSchemaNameLabel).(string)
+		log.Printf("[TRACE] Creating VM from XVA %s", data[xvaImportSchemaSource].(string))
 
-	xenVM, err := c.client.VM.Clone(c.session, xenBaseTemplate, dNameLabel)
-	if err != nil {
-		log.Printf("[ERROR] Failed to clone template - %s", err)
-		return err
+		xenVM, err = importXVA(c, data[xvaImportSchemaSource].(string), sr, d.Timeout(schema.TimeoutCreate))
+		if err != nil {
+			log.Printf("[ERROR] Failed to import XVA - %s", err)
+			return err
+		}
+	} else {
+		log.Printf("[TRACE] Creating VM with base template name %s", dBaseTemplateName)
+
+		var xenBaseTemplates []xenAPI.VMRef
+		xenBaseTemplates, err = c.client.VM.GetByNameLabel(c.session, dBaseTemplateName)
+		if err != nil {
+			log.Printf("[ERROR] Failed to find template with name %s - %s", dBaseTemplateName, err)
+			return err
+		}
+
+		xenBaseTemplates, err = filterVMTemplates(c, xenBaseTemplates)
+		if err != nil {
+			log.Printf("[ERROR] Error filtering templates - %s", err)
+			return err
+		}
+
+		if len(xenBaseTemplates) == 0 {
+			return fmt.Errorf("no VM template with label %q has been found", dBaseTemplateName)
+		}
+
+		if len(xenBaseTemplates) > 1 {
+			return fmt.Errorf("more than one VM template with label %q has been found", dBaseTemplateName)
+		}
+
+		xenBaseTemplate := xenBaseTemplates[0]
+
+		xenVM, err = c.client.VM.Clone(c.session, xenBaseTemplate, dNameLabel)
+		if err != nil {
+			log.Printf("[ERROR] Failed to clone template - %s", err)
+			return err
+		}
 	}
 
 	vm := &VMDescriptor{
 		VMRef: xenVM,
 	}
 
+	// VDIs created for inline disks, which may not be attached yet when creation fails
+	var inlineVDIs []xenAPI.VDIRef
+
+	// Set once the VM is fully provisioned and started. Later failures keep the VM, so that
+	// Terraform marks it as tainted instead of a slow guest losing its disks.
+	provisioned := false
+
+	// Do not leave half-configured clones and their disks behind
+	defer func() {
+		if err == nil || provisioned {
+			return
+		}
+
+		log.Printf("[DEBUG] Rolling back creation of VM %s", xenVM)
+		if rollbackErr := rollbackVMCreate(c, vm, readConfiguredVDIUUIDs(d), inlineVDIs); rollbackErr != nil {
+			log.Printf("[ERROR] Error rolling back creation of VM %s - %s", xenVM, rollbackErr)
+			// Keep the ID, so that Terraform marks the VM as tainted and destroys it later
+			err = fmt.Errorf("%s; VM %s could not be cleaned up: %s", err, vm.UUID, rollbackErr)
+			return
+		}
+
+		d.SetId("")
+	}()
+
+	// Imported VMs keep the name of the exported VM, clones are named on creation
+	if len(dImportXVA) > 0 {
+		if err = c.client.VM.SetNameLabel(c.session, xenVM, dNameLabel); err != nil {
+			return err
+		}
+	}
+
 	if err = vm.Query(c); err != nil {
 		log.Printf("[ERROR] Failed retrieve configuration of newly created VM - %s", err)
 		return err
 	}
 
+	if description, ok := d.GetOk(vmSchemaNameDescription); ok {
+		if err = c.client.VM.SetNameDescription(c.session, vm.VMRef, description.(string)); err != nil {
+			return err
+		}
+	}
+
 	// Reset base template name
 	otherConfig := vm.OtherConfig
-	otherConfig["base_template_name"] = dBaseTemplateName
+	if dBaseTemplateName != "" {
+		otherConfig["base_template_name"] = dBaseTemplateName
+	} else {
+		delete(otherConfig, "base_template_name")
+	}
+	mergeManagedMap(otherConfig, nil, d.Get(vmSchemaOtherConfig).(map[string]interface{}))
 	if err = c.client.VM.SetOtherConfig(c.session, vm.VMRef, otherConfig); err != nil {
 		return err
 	}
@@ -254,12 +833,28 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 
 	// Set VCPUs number
 	log.Printf("[TRACE] Setting Number of VCPUs")
-	vm.VCPUCount = d.Get(vmSchemaVcpus).(int)
+	if vcpus, ok := d.GetOk(vmSchemaVcpus); ok {
+		vm.VCPUCount = vcpus.(int)
+		vm.VCPUsAtStartup = vcpus.(int)
+	}
+	if vcpus, ok := d.GetOk(vmSchemaVcpusMax); ok {
+		vm.VCPUCount = vcpus.(int)
+	}
+	if vcpus, ok := d.GetOk(vmSchemaVcpusAtStartup); ok {
+		vm.VCPUsAtStartup = vcpus.(int)
+	}
 	if err = vm.UpdateVCPUs(c); err != nil {
 		log.Printf("[ERROR] Error setting number of VCPUs - %s", err)
 		return err
 	}
 
+	if params, ok := d.GetOk(vmSchemaVCPUParams); ok {
+		if err = updateVMVCPUParams(c, vm, readVCPUParamsChange(nil, params.([]interface{}))); err != nil {
+			log.Printf("[ERROR] Error setting VCPU parameters - %s", err)
+			return err
+		}
+	}
+
 	//TODO: Why is this only set here? Surely it should be set at the start?
 	log.Printf("[TRACE] Setting the VM's UUID")
 	d.SetId(vm.UUID)
@@ -314,29 +909,118 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 	}
 
 	log.Printf("[TRACE] Creating CDs")
-	if err = createVBDs(c, d.Get(vmSchemaCdRom).(*schema.Set).List(), xenAPI.VbdTypeCD, vm); err != nil {
-		log.Printf("[ERROR] Error creating CDs - %s", err)
+	cdRoms := d.Get(vmSchemaCdRom).(*schema.Set).List()
+	if err = resolveISONames(c, cdRoms); err != nil {
+		log.Printf("[ERROR] Error resolving ISOs - %s", err)
 		return err
 	}
 
-	log.Printf("[TRACE] Creating HDDs")
-	if err = createVBDs(c, d.Get(vmSchemaHardDrive).(*schema.Set).List(), xenAPI.VbdTypeDisk, vm); err != nil {
+	if err = createVBDs(c, cdRoms, xenAPI.VbdTypeCD, vm); err != nil {
+		log.Printf("[ERROR] Error creating CDs - %s", err)
+		return err
+	}
+
+	if err = updateVBDsQoS(c, vm, cdRoms); err != nil {
+		log.Printf("[ERROR] Error setting QoS of CDs - %s", err)
+		return err
+	}
+
+	if err = updateVBDsOptions(c, vm, nil, cdRoms, cdromHash); err != nil {
+		log.Printf("[ERROR] Error setting options of CDs - %s", err)
+		return err
+	}
+
+	log.Printf("[TRACE] Creating HDDs")
+	hardDrives := d.Get(vmSchemaHardDrive).(*schema.Set).List()
+	if inlineVDIs, err = createInlineVDIs(c, vm, hardDrives); err != nil {
+		log.Printf("[ERROR] Error creating VDIs - %s", err)
+		return err
+	}
+
+	if err = createVBDs(c, hardDrives, xenAPI.VbdTypeDisk, vm); err != nil {
 		log.Printf("[ERROR] Error creating HDDs - %s", err)
 		return err
 	}
 
+	if err = resizeVBDs(c, vm, hardDrives); err != nil {
+		log.Printf("[ERROR] Error resizing HDDs - %s", err)
+		return err
+	}
+
+	if err = updateVBDsQoS(c, vm, hardDrives); err != nil {
+		log.Printf("[ERROR] Error setting QoS of HDDs - %s", err)
+		return err
+	}
+
+	if err = updateVBDsOptions(c, vm, nil, hardDrives, vbdHash); err != nil {
+		log.Printf("[ERROR] Error setting options of HDDs - %s", err)
+		return err
+	}
+
+	if err = updateVDINames(c, hardDrives); err != nil {
+		log.Printf("[ERROR] Error naming HDDs - %s", err)
+		return err
+	}
+
+	if err = updateVDIsDetachOnly(c, hardDrives); err != nil {
+		log.Printf("[ERROR] Error marking detach only HDDs - %s", err)
+		return err
+	}
+
+	if err = updateVDIsOnBoot(c, hardDrives); err != nil {
+		log.Printf("[ERROR] Error setting on_boot of HDDs - %s", err)
+		return err
+	}
+
+	if _cloudInit, ok := d.GetOk(vmSchemaCloudInit); ok {
+		log.Printf("[TRACE] Creating cloud-init config drive")
+		if err = createConfigDrive(c, vm, _cloudInit.([]interface{})[0].(map[string]interface{})); err != nil {
+			log.Printf("[ERROR] Error creating cloud-init config drive - %s", err)
+			return err
+		}
+	}
+
+	if _unattend, ok := d.GetOk(vmSchemaWindowsUnattend); ok {
+		log.Printf("[TRACE] Creating unattend drive")
+		if err = createUnattendDrive(c, vm, _unattend.([]interface{})[0].(map[string]interface{})); err != nil {
+			log.Printf("[ERROR] Error creating unattend drive - %s", err)
+			return err
+		}
+	}
+
 	log.Printf("[TRACE] Setting Schema's VBDs")
-	if setSchemaVBDs(c, vm, d) != nil {
+	if err = setSchemaVBDs(c, vm, d); err != nil {
 		log.Printf("[ERROR] Error setting Schema's VBDs - %s", err)
 		return err
 	}
 
 	log.Printf("[TRACE] Setting Boot Order")
 	if _order, ok := d.GetOk(vmSchemaBootOrder); ok {
-		order := _order.(string)
+		order := strings.ToLower(_order.(string))
 		vm.HVMBootParameters["order"] = order
 	}
 
+	// Firmware and Secure Boot of the template are kept unless configured
+	_firmware, firmwareOk := d.GetOk(vmSchemaFirmware)
+	_secureBoot, secureBootOk := d.GetOk(vmSchemaSecureBoot)
+	if firmwareOk || secureBootOk {
+		log.Printf("[TRACE] Setting Firmware")
+		firmware := vmFirmware(vm)
+		if firmwareOk {
+			firmware = _firmware.(string)
+		}
+
+		secureBoot := vmSecureBoot(vm) && firmware == vmFirmwareUEFI
+		if secureBootOk {
+			secureBoot = _secureBoot.(bool)
+		}
+
+		if err = setVMFirmware(c, vm, firmware, secureBoot); err != nil {
+			log.Printf("[ERROR] Error setting Firmware - %s", err)
+			return err
+		}
+	}
+
 	log.Printf("[TRACE] Committing Boot Order")
 	if err = c.client.VM.SetHVMBootParams(c.session, vm.VMRef, vm.HVMBootParameters); err != nil {
 		log.Printf("[ERROR] Error Committing Boot Order - %s", err)
@@ -347,8 +1031,8 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 	if _coresPerSocket, ok := d.GetOk(vmSchemaCoresPerSocket); ok {
 		coresPerSocket := _coresPerSocket.(int)
 
-		if vm.VCPUCount%coresPerSocket != 0 {
-			return fmt.Errorf("%d cores could not fit to %d cores-per-socket topology", vm.VCPUCount, coresPerSocket)
+		if err = validateCoresPerSocket(vm.VCPUCount, coresPerSocket); err != nil {
+			return err
 		}
 
 		vm.Platform["cores-per-socket"] = strconv.Itoa(coresPerSocket)
@@ -360,19 +1044,94 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 		}
 
 		var coresPerSocket int
-		if coresPerSocket, err = strconv.Atoi(_coresPerSocket.(string)); err != nil {
+		if coresPerSocket, err = strconv.Atoi(_coresPerSocket.(string)); err == nil {
 			if err = d.Set(vmSchemaCoresPerSocket, coresPerSocket); err != nil {
 				return err
 			}
 		}
 	}
 
+	if cpuFeatures, ok := d.GetOk(vmSchemaCPUFeatures); ok {
+		vm.Platform[vmPlatformFeatureset] = cpuFeatures.(string)
+	}
+
+	if vga, ok := d.GetOk(vmSchemaVGA); ok {
+		vm.Platform["vga"] = vga.(string)
+	}
+
+	if videoRAM, ok := d.GetOk(vmSchemaVideoRAM); ok {
+		vm.Platform["videoram"] = strconv.Itoa(videoRAM.(int))
+	}
+
+	log.Printf("[TRACE] Merging Platform flags")
+	applyGuestTypePreset(vm.Platform, vm.OtherConfig, "", d.Get(vmSchemaGuestType).(string))
+	mergeManagedMap(vm.Platform, nil, d.Get(vmSchemaPlatform).(map[string]interface{}))
+
 	log.Printf("[TRACE] Committing VM Platform Settings")
 	if err = c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
 		log.Printf("[ERROR] Committing VM Platform Setting - %s", err)
 		return err
 	}
 
+	if err = c.client.VM.SetOtherConfig(c.session, vm.VMRef, vm.OtherConfig); err != nil {
+		return err
+	}
+
+	if nvram, ok := d.GetOk(vmSchemaNVRAM); ok {
+		log.Printf("[TRACE] Setting NVRAM")
+		mergeManagedMap(vm.NVRAM, nil, nvram.(map[string]interface{}))
+		if err = c.client.VM.SetNVRAM(c.session, vm.VMRef, vm.NVRAM); err != nil {
+			log.Printf("[ERROR] Error setting NVRAM - %s", err)
+			return err
+		}
+	}
+
+	// BIOS strings can only be set once, before the first start
+	if hostUUID, ok := d.GetOk(vmSchemaBIOSStringsHost); ok {
+		host := &HostDescriptor{
+			UUID: hostUUID.(string),
+		}
+		if err = host.Load(c); err != nil {
+			return err
+		}
+
+		log.Printf("[TRACE] Copying BIOS strings from host %s", host.UUID)
+		if err = c.client.VM.CopyBiosStrings(c.session, vm.VMRef, host.HostRef); err != nil {
+			log.Printf("[ERROR] Error copying BIOS strings - %s", err)
+			return err
+		}
+	} else if biosStrings, ok := d.GetOk(vmSchemaBIOSStrings); ok {
+		values := make(map[string]string)
+		for k, v := range biosStrings.(map[string]interface{}) {
+			values[k] = v.(string)
+		}
+
+		log.Printf("[TRACE] Setting BIOS strings")
+		if err = c.client.VM.SetBiosStrings(c.session, vm.VMRef, values); err != nil {
+			log.Printf("[ERROR] Error setting BIOS strings - %s", err)
+			return err
+		}
+	}
+
+	log.Printf("[TRACE] Setting Affinity Host")
+	if err = updateVMAffinity(c, vm, d.Get(vmSchemaAffinityHost).(string)); err != nil {
+		log.Printf("[ERROR] Error setting Affinity Host - %s", err)
+		return err
+	}
+
+	// Clones inherit tags of the template, replace them with the configured ones
+	log.Printf("[TRACE] Setting Tags")
+	if err = c.client.VM.SetTags(c.session, vm.VMRef, readStringSet(d.Get(vmSchemaTags).(*schema.Set))); err != nil {
+		log.Printf("[ERROR] Error setting Tags - %s", err)
+		return err
+	}
+
+	log.Printf("[TRACE] Setting HA options")
+	if err = updateVMHAOptions(c, vm, d); err != nil {
+		log.Printf("[ERROR] Error setting HA options - %s", err)
+		return err
+	}
+
 	log.Printf("[TRACE] Querying other config")
 	other_config, err := c.client.VM.GetOtherConfig(c.session, xenVM)
 	if err != nil {
@@ -389,11 +1148,14 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	log.Printf("[TRACE] Provisioning VM")
-	err = c.client.VM.Provision(c.session, xenVM)
-	if err != nil {
-		log.Printf("[ERROR] Error provisioning VM - %s", err)
-		return err
+	// Imported VMs come with their disks and need no provisioning
+	if vm.IsATemplate {
+		log.Printf("[TRACE] Provisioning VM")
+		err = c.client.VM.Provision(c.session, xenVM)
+		if err != nil {
+			log.Printf("[ERROR] Error provisioning VM - %s", err)
+			return err
+		}
 	}
 
 	// reset template flag
@@ -404,10 +1166,42 @@ func resourceVMCreate(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	log.Println("[TRACE] Starting VM")
-	err = c.client.VM.Start(c.session, xenVM, false, false)
+	log.Println("[TRACE] Setting VM power state")
+	err = setVMPowerState(c, vm, d.Get(vmSchemaPowerState).(string),
+		d.Get(vmSchemaForcePowerTransitions).(bool),
+		d.Get(vmSchemaPlacementStrategy).(string))
 	if err != nil {
-		log.Printf("[ERROR] Error starting VM - %s", err)
+		log.Printf("[ERROR] Error setting VM power state - %s", err)
+		return err
+	}
+
+	// Blocked last, so that provisioning operations are still allowed
+	log.Printf("[TRACE] Setting Blocked Operations")
+	if err = updateVMBlockedOperations(c, vm, readVMBlockedOperations(d)); err != nil {
+		log.Printf("[ERROR] Error setting Blocked Operations - %s", err)
+		return err
+	}
+
+	provisioned = true
+
+	if d.Get(vmSchemaWaitForTools).(bool) && vm.PowerState == xenAPI.VMPowerStateRunning {
+		log.Println("[TRACE] Waiting for guest tools")
+		if err = waitForVMTools(c, vm, d.Timeout(schema.TimeoutCreate)); err != nil {
+			log.Printf("[ERROR] Error waiting for guest tools - %s", err)
+			return err
+		}
+	}
+
+	if d.Get(vmSchemaWaitForIP).(bool) && vm.PowerState == xenAPI.VMPowerStateRunning {
+		log.Println("[TRACE] Waiting for guest IP address")
+		if err = waitForVMIPAddress(c, vm, d.Timeout(schema.TimeoutCreate)); err != nil {
+			log.Printf("[ERROR] Error waiting for guest IP address - %s", err)
+			return err
+		}
+	}
+
+	if err = setSchemaIPAddresses(c, vm, d); err != nil {
+		log.Printf("[ERROR] Error setting Schema's IP addresses - %s", err)
 		return err
 	}
 	log.Println("[TRACE] Done")
@@ -440,6 +1234,10 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	if err = d.Set(vmSchemaNameDescription, vm.Description); err != nil {
+		return err
+	}
+
 	vmBaseTemplateName, ok := vm.OtherConfig["base_template_name"]
 	if ok {
 		err = d.Set(vmSchemaBaseTemplateName, vmBaseTemplateName)
@@ -453,7 +1251,17 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
-	err = d.Set(vmSchemaVcpus, vm.VCPUCount)
+	err = d.Set(vmSchemaVcpus, vm.VCPUsAtStartup)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set(vmSchemaVcpusMax, vm.VCPUCount)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set(vmSchemaVcpusAtStartup, vm.VCPUsAtStartup)
 	if err != nil {
 		return err
 	}
@@ -486,6 +1294,11 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 	vifs := make([]map[string]interface{}, 0, len(vmVifs))
 	log.Println(fmt.Sprintf("[DEBUG] Got %d VIFs", len(vmVifs)))
 
+	guestNetworks, err := vm.QueryGuestNetworks(c)
+	if err != nil {
+		return err
+	}
+
 	for _, _vif := range vmVifs {
 		vif := VIFDescriptor{
 			VIFRef: _vif,
@@ -499,10 +1312,12 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 
 		log.Println("[TRACE] Found VIF", vif.UUID)
 		vifData := fillVIFSchema(vif)
+		vifData[vifSchemaIPAddresses] = guestNetworks[vif.DeviceOrder]
 		log.Println("[TRACE] VIF: ", vifData)
 
 		vifs = append(vifs, vifData)
 	}
+	filterVIFsOtherConfig(vifs, d.Get(vmSchemaNetworkInterfaces).(*schema.Set))
 	err = d.Set(vmSchemaNetworkInterfaces, vifs)
 	if err != nil {
 		log.Println("[ERROR] ", err)
@@ -510,7 +1325,7 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 	}
 
 	log.Printf("[TRACE] Setting Schema VBDs")
-	if setSchemaVBDs(c, vm, d) != nil {
+	if err = setSchemaVBDs(c, vm, d); err != nil {
 		log.Println("[ERROR] ", err)
 		return err
 	}
@@ -529,6 +1344,134 @@ func resourceVMRead(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
+	if vga, ok := vm.Platform["vga"]; ok {
+		if err := d.Set(vmSchemaVGA, vga); err != nil {
+			return err
+		}
+	}
+
+	if _videoRAM, ok := vm.Platform["videoram"]; ok {
+		videoRAM, _ := strconv.Atoi(_videoRAM)
+		if err := d.Set(vmSchemaVideoRAM, videoRAM); err != nil {
+			return err
+		}
+	}
+
+	// Keys set by the template or other tools are not tracked
+	vcpuParams, err := fillVCPUParamsSchema(filterVCPUParams(vm.VCPUParams, d.Get(vmSchemaVCPUParams).([]interface{})))
+	if err != nil {
+		return err
+	}
+	if err = d.Set(vmSchemaVCPUParams, vcpuParams); err != nil {
+		return err
+	}
+
+	// XAPI records the pool featureset on every start, so it is only tracked when configured
+	if d.Get(vmSchemaCPUFeatures).(string) != "" {
+		if err := d.Set(vmSchemaCPUFeatures, vm.Platform[vmPlatformFeatureset]); err != nil {
+			return err
+		}
+	}
+
+	if err := setSchemaIPAddresses(c, vm, d); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaPowerState, strings.ToLower(string(vm.PowerState))); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaTags, vm.Tags); err != nil {
+		return err
+	}
+
+	// Destroy blocked by destroy_protection alone is not listed
+	dBlockedOperations := d.Get(vmSchemaBlockedOperations).(*schema.Set)
+	hideDestroy := d.Get(vmSchemaDestroyProtection).(bool) && !dBlockedOperations.Contains(vmOperationDestroy)
+
+	blockedOperations := make([]string, 0, len(vm.BlockedOperations))
+	for operation := range vm.BlockedOperations {
+		if hideDestroy && string(operation) == vmOperationDestroy {
+			continue
+		}
+		blockedOperations = append(blockedOperations, string(operation))
+	}
+	if err := d.Set(vmSchemaBlockedOperations, blockedOperations); err != nil {
+		return err
+	}
+
+	dOtherConfig := d.Get(vmSchemaOtherConfig).(map[string]interface{})
+	if err := d.Set(vmSchemaOtherConfig, filterManagedMap(vm.OtherConfig, dOtherConfig)); err != nil {
+		return err
+	}
+
+	dNVRAM := d.Get(vmSchemaNVRAM).(map[string]interface{})
+	if err := d.Set(vmSchemaNVRAM, filterManagedMap(vm.NVRAM, dNVRAM)); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaNVRAMContents, vm.NVRAM); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaGenerationID, vm.GenerationID); err != nil {
+		return err
+	}
+
+	dBIOSStrings := d.Get(vmSchemaBIOSStrings).(map[string]interface{})
+	if err := d.Set(vmSchemaBIOSStrings, filterManagedMap(vm.BIOSStrings, dBIOSStrings)); err != nil {
+		return err
+	}
+
+	dPlatform := d.Get(vmSchemaPlatform).(map[string]interface{})
+	if err := d.Set(vmSchemaPlatform, filterManagedMap(vm.Platform, dPlatform)); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaFirmware, vmFirmware(vm)); err != nil {
+		return err
+	}
+
+	if err := d.Set(vmSchemaSecureBoot, vmSecureBoot(vm)); err != nil {
+		return err
+	}
+
+	affinityHost, err := queryHostUUID(c, vm.Affinity)
+	if err != nil {
+		return err
+	}
+	if err = d.Set(vmSchemaAffinityHost, affinityHost); err != nil {
+		return err
+	}
+
+	residentOn, err := queryHostUUID(c, vm.ResidentOn)
+	if err != nil {
+		return err
+	}
+	if err = d.Set(vmSchemaResidentOn, residentOn); err != nil {
+		return err
+	}
+
+	if err = d.Set(vmSchemaHARestartPriority, vm.HARestartPriority); err != nil {
+		return err
+	}
+
+	if err = d.Set(vmSchemaHAAlwaysRun, vm.HAAlwaysRun); err != nil {
+		return err
+	}
+
+	if err = d.Set(vmSchemaOrder, vm.Order); err != nil {
+		return err
+	}
+
+	if err = d.Set(vmSchemaStartDelay, vm.StartDelay); err != nil {
+		return err
+	}
+
+	if err = d.Set(vmSchemaShutdownDelay, vm.ShutdownDelay); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -551,6 +1494,28 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	// Validate the topology before anything is changed
+	if _coresPerSocket, ok := d.GetOk(vmSchemaCoresPerSocket); ok {
+		vcpus := vm.VCPUCount
+		if d.HasChange(vmSchemaVcpus) {
+			vcpus = d.Get(vmSchemaVcpus).(int)
+		}
+		if d.HasChange(vmSchemaVcpusMax) {
+			vcpus = d.Get(vmSchemaVcpusMax).(int)
+		}
+
+		if err := validateCoresPerSocket(vcpus, _coresPerSocket.(int)); err != nil {
+			return err
+		}
+	}
+
+	if d.Get(vmSchemaSnapshotBeforeUpdate).(bool) && hasVMConfigChange(d) {
+		if err := snapshotVM(c, vm, snapshotReasonUpdate, d.Get(vmSchemaSnapshotRetention).(int)); err != nil {
+			log.Printf("[ERROR] Error taking snapshot before update - %s", err)
+			return err
+		}
+	}
+
 	d.Partial(true)
 
 	if d.HasChange(vmSchemaNameLabel) {
@@ -563,6 +1528,37 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetPartial(vmSchemaNameLabel)
 	}
 
+	if d.HasChange(vmSchemaNameDescription) {
+		_, dNameDescription := d.GetChange(vmSchemaNameDescription)
+		if err := c.client.VM.SetNameDescription(c.session, vm.VMRef, dNameDescription.(string)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaNameDescription)
+	}
+
+	// Static memory and maximum VCPUs can only be changed while the VM is halted
+	restarted := false
+	if haltFields := vmChangesRequiringHalt(d, vm); len(haltFields) > 0 && vm.PowerState == xenAPI.VMPowerStateRunning {
+		if !d.Get(vmSchemaAllowRestart).(bool) {
+			return fmt.Errorf("changing %s requires VM %q to be halted, set %q to restart it automatically",
+				strings.Join(haltFields, ", "), vm.Name, vmSchemaAllowRestart)
+		}
+
+		log.Printf("[DEBUG] Halting VM %s to change %s", vm.UUID, strings.Join(haltFields, ", "))
+		if d.Get(vmSchemaForcePowerTransitions).(bool) {
+			if err := setVMPowerState(c, vm, powerStateHalted, true, ""); err != nil {
+				return err
+			}
+		} else {
+			timeout := time.Duration(d.Get(vmSchemaShutdownTimeout).(int)) * time.Second
+			if err := shutdownVM(c, vm, timeout); err != nil {
+				return err
+			}
+		}
+		restarted = true
+	}
+
 	updatedFields := make([]string, 0, 5)
 	updateMemory := false
 
@@ -604,13 +1600,58 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
-	if d.HasChange(vmSchemaVcpus) {
-		_, vcpus := d.GetChange(vmSchemaVcpus)
-		vm.VCPUCount = vcpus.(int)
+	if d.HasChange(vmSchemaVcpus) || d.HasChange(vmSchemaVcpusMax) || d.HasChange(vmSchemaVcpusAtStartup) {
+		if d.HasChange(vmSchemaVcpus) {
+			_, vcpus := d.GetChange(vmSchemaVcpus)
+			vm.VCPUCount = vcpus.(int)
+			vm.VCPUsAtStartup = vcpus.(int)
+		}
+		if d.HasChange(vmSchemaVcpusMax) {
+			_, vcpus := d.GetChange(vmSchemaVcpusMax)
+			vm.VCPUCount = vcpus.(int)
+		}
+		if d.HasChange(vmSchemaVcpusAtStartup) {
+			_, vcpus := d.GetChange(vmSchemaVcpusAtStartup)
+			vm.VCPUsAtStartup = vcpus.(int)
+		}
 		if err := vm.UpdateVCPUs(c); err != nil {
 			return err
 		}
 		d.SetPartial(vmSchemaVcpus)
+		d.SetPartial(vmSchemaVcpusMax)
+		d.SetPartial(vmSchemaVcpusAtStartup)
+	}
+
+	if d.HasChange(vmSchemaVCPUParams) {
+		o, n := d.GetChange(vmSchemaVCPUParams)
+		params := readVCPUParamsChange(o.([]interface{}), n.([]interface{}))
+		if err := updateVMVCPUParams(c, vm, params); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaVCPUParams)
+	}
+
+	if d.HasChange(vmSchemaNVRAM) {
+		o, n := d.GetChange(vmSchemaNVRAM)
+		mergeManagedMap(vm.NVRAM, o.(map[string]interface{}), n.(map[string]interface{}))
+
+		if err := c.client.VM.SetNVRAM(c.session, vm.VMRef, vm.NVRAM); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaNVRAM)
+	}
+
+	// Other power states are reached by the power state reconciliation below
+	if restarted && d.Get(vmSchemaPowerState).(string) == powerStateRunning {
+		log.Printf("[DEBUG] Starting VM %s again", vm.UUID)
+		err := setVMPowerState(c, vm, powerStateRunning,
+			d.Get(vmSchemaForcePowerTransitions).(bool),
+			d.Get(vmSchemaPlacementStrategy).(string))
+		if err != nil {
+			return err
+		}
 	}
 
 	if d.HasChange(vmSchemaNetworkInterfaces) {
@@ -621,7 +1662,7 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 
 		var err error
 		var remove []*VIFDescriptor
-		if remove, err = readVIFsFromSchema(c, os.Difference(ns).List()); err == nil {
+		if remove, err = readVIFsFromSchema(c, os.Difference(ns).List()); err != nil {
 			return err
 		}
 
@@ -654,7 +1695,14 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 					}
 				}
 				if vifToRemove != nil {
-					log.Println(fmt.Sprintf("[DEBUG] Removing VIF %q", vif.UUID))
+					if vifToRemove.CurrentlyAttached {
+						log.Println(fmt.Sprintf("[DEBUG] Unplugging VIF %q", vifToRemove.UUID))
+						if err := unplugVIF(c, vifToRemove.VIFRef, vifPlugTimeout); err != nil {
+							return err
+						}
+					}
+
+					log.Println(fmt.Sprintf("[DEBUG] Removing VIF %q", vifToRemove.UUID))
 					if err := c.client.VIF.Destroy(c.session, vifToRemove.VIFRef); err != nil {
 						return err
 					}
@@ -663,7 +1711,7 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		}
 
 		var create []*VIFDescriptor
-		if create, err = readVIFsFromSchema(c, ns.Difference(os).List()); err == nil {
+		if create, err = readVIFsFromSchema(c, ns.Difference(os).List()); err != nil {
 			return err
 		}
 
@@ -672,11 +1720,15 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 			for _, vif := range create {
 				vif.VM = vm
 				if _, err := createVIF(c, vif); err != nil {
-					return nil
+					return err
 				}
 			}
 		}
 
+		// Locking and other_config are not part of the hash, so interfaces stay in place when they change
+		if err = updateVIFs(c, vm, ns.List(), os.List()); err != nil {
+			return err
+		}
 	}
 
 	if d.HasChange(vmSchemaCdRom) {
@@ -686,8 +1738,23 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		ns := n.(*schema.Set)
 
 		var err error
-		var remove []*VBDDescriptor
-		if remove, err = readVBDsFromSchema(c, os.Difference(ns).List()); err == nil {
+		removed := os.Difference(ns).List()
+		added := ns.Difference(os).List()
+		if err = resolveISONames(c, added); err != nil {
+			return err
+		}
+
+		// Changing the ISO swaps the media of an existing drive instead of replacing the drive
+		var pairs [][2]map[string]interface{}
+		pairs, removed, added = pairCDROMChanges(removed, added)
+		for _, pair := range pairs {
+			if err = changeCDROMMedia(c, vm, pair[0], pair[1]); err != nil {
+				return err
+			}
+		}
+
+		var remove []*VBDDescriptor
+		if remove, err = readVBDsFromSchema(c, removed); err != nil {
 			return err
 		}
 
@@ -720,6 +1787,13 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 					}
 				}
 				if vbdToRemove != nil {
+					if vbdToRemove.CurrentlyAttached {
+						log.Println(fmt.Sprintf("[DEBUG] Unplugging cdrom %q", vbdToRemove.UUID))
+						if err := unplugVBD(c, vbdToRemove.VBDRef, vbdUnplugTimeout); err != nil {
+							return err
+						}
+					}
+
 					log.Println(fmt.Sprintf("[DEBUG] Removing cdrom %q", vbd.UUID))
 					if err := c.client.VBD.Destroy(c.session, vbdToRemove.VBDRef); err != nil {
 						return err
@@ -729,7 +1803,7 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		}
 
 		var create []*VBDDescriptor
-		if create, err = readVBDsFromSchema(c, ns.Difference(os).List()); err == nil {
+		if create, err = readVBDsFromSchema(c, orderByUserDevice(added)); err != nil {
 			return err
 		}
 
@@ -737,11 +1811,21 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 			log.Println(fmt.Sprintf("[DEBUG] Will create %d cdroms", len(create)))
 			for _, cdrom := range create {
 				cdrom.VM = vm
+				cdrom.Type = xenAPI.VbdTypeCD
+				cdrom.Mode = xenAPI.VbdModeRO
 				if _, err := createVBD(c, cdrom); err != nil {
 					return err
 				}
 			}
 		}
+
+		if err = updateVBDsQoS(c, vm, ns.List()); err != nil {
+			return err
+		}
+
+		if err = updateVBDsOptions(c, vm, os.List(), ns.List(), cdromHash); err != nil {
+			return err
+		}
 	}
 
 	if d.HasChange(vmSchemaHardDrive) {
@@ -752,7 +1836,7 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 
 		var err error
 		var remove []*VBDDescriptor
-		if remove, err = readVBDsFromSchema(c, os.Difference(ns).List()); err == nil {
+		if remove, err = readVBDsFromSchema(c, os.Difference(ns).List()); err != nil {
 			return err
 		}
 
@@ -785,16 +1869,36 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 					}
 				}
 				if vbdToRemove != nil {
+					if vbdToRemove.CurrentlyAttached {
+						log.Println(fmt.Sprintf("[DEBUG] Unplugging HDD %q", vbdToRemove.UUID))
+						if err := unplugVBD(c, vbdToRemove.VBDRef, vbdUnplugTimeout); err != nil {
+							return err
+						}
+					}
+
 					log.Println(fmt.Sprintf("[DEBUG] Removing HDD %q", vbd.UUID))
 					if err := c.client.VBD.Destroy(c.session, vbdToRemove.VBDRef); err != nil {
 						return err
 					}
+
+					if vbdToRemove.VDI != nil && vbdToRemove.VDI.OtherConfig[vdiOtherConfigInlineDisk] == "true" &&
+						vbdToRemove.VDI.OtherConfig[vdiOtherConfigDetachOnly] != "true" {
+						log.Println(fmt.Sprintf("[DEBUG] Destroying VDI %q of removed HDD", vbdToRemove.VDI.UUID))
+						if err := c.client.VDI.Destroy(c.session, vbdToRemove.VDI.VDIRef); err != nil {
+							return err
+						}
+					}
 				}
 			}
 		}
 
+		added := ns.Difference(os).List()
+		if _, err = createInlineVDIs(c, vm, added); err != nil {
+			return err
+		}
+
 		var create []*VBDDescriptor
-		if create, err = readVBDsFromSchema(c, ns.Difference(os).List()); err == nil {
+		if create, err = readVBDsFromSchema(c, orderByUserDevice(added)); err != nil {
 			return err
 		}
 
@@ -802,20 +1906,48 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 			log.Println(fmt.Sprintf("[DEBUG] Will create %d HDDs", len(create)))
 			for _, hdd := range create {
 				hdd.VM = vm
+				hdd.Type = xenAPI.VbdTypeDisk
 				if _, err := createVBD(c, hdd); err != nil {
 					return err
 				}
 			}
 		}
+
+		// Size, QoS and names are not part of the hash, so changed disks stay in place
+		if err = resizeVBDs(c, vm, ns.List()); err != nil {
+			return err
+		}
+
+		if err = updateVBDsQoS(c, vm, ns.List()); err != nil {
+			return err
+		}
+
+		if err = updateVBDsOptions(c, vm, os.List(), ns.List(), vbdHash); err != nil {
+			return err
+		}
+
+		if err = updateVDINames(c, ns.List()); err != nil {
+			return err
+		}
+
+		if err = updateVDIsDetachOnly(c, ns.List()); err != nil {
+			return err
+		}
+
+		if err = updateVDIsOnBoot(c, ns.List()); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaHardDrive)
 	}
 
-	dXenstoreDataRaw, ok := d.GetOk(vmSchemaXenstoreData)
-	if ok {
+	if d.HasChange(vmSchemaXenstoreData) {
 		dXenstoreData := make(map[string]string)
-		for key, value := range dXenstoreDataRaw.(map[string]interface{}) {
+		for key, value := range d.Get(vmSchemaXenstoreData).(map[string]interface{}) {
 			dXenstoreData[key] = value.(string)
 		}
 
+		// XAPI mirrors the data to /local/domain/<domid>/vm-data when the VM is running
 		if err := c.client.VM.SetXenstoreData(c.session, vm.VMRef, dXenstoreData); err != nil {
 			return err
 		}
@@ -825,7 +1957,7 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 
 	if d.HasChange(vmSchemaBootOrder) {
 		_, n := d.GetChange(vmSchemaBootOrder)
-		order := n.(string)
+		order := strings.ToLower(n.(string))
 		vm.HVMBootParameters["order"] = order
 
 		if err := c.client.VM.SetHVMBootParams(c.session, vm.VMRef, vm.HVMBootParameters); err != nil {
@@ -839,10 +1971,6 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		_, n := d.GetChange(vmSchemaCoresPerSocket)
 		coresPerSocket := n.(int)
 
-		if vm.VCPUCount%coresPerSocket != 0 {
-			return fmt.Errorf("%d cores could not fit to %d cores-per-socket topology", vm.VCPUCount, coresPerSocket)
-		}
-
 		vm.Platform["cores-per-socket"] = strconv.Itoa(coresPerSocket)
 
 		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
@@ -852,6 +1980,144 @@ func resourceVMUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetPartial(vmSchemaCoresPerSocket)
 	}
 
+	if d.HasChange(vmSchemaCPUFeatures) {
+		_, n := d.GetChange(vmSchemaCPUFeatures)
+
+		if n.(string) == "" {
+			delete(vm.Platform, vmPlatformFeatureset)
+		} else {
+			vm.Platform[vmPlatformFeatureset] = n.(string)
+		}
+
+		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaCPUFeatures)
+	}
+
+	if d.HasChange(vmSchemaGuestType) {
+		o, n := d.GetChange(vmSchemaGuestType)
+		applyGuestTypePreset(vm.Platform, vm.OtherConfig, o.(string), n.(string))
+
+		// Explicitly configured flags take precedence over the preset
+		mergeManagedMap(vm.Platform, nil, d.Get(vmSchemaPlatform).(map[string]interface{}))
+
+		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
+			return err
+		}
+
+		if err := c.client.VM.SetOtherConfig(c.session, vm.VMRef, vm.OtherConfig); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaGuestType)
+	}
+
+	if d.HasChange(vmSchemaVGA) || d.HasChange(vmSchemaVideoRAM) {
+		if vga, ok := d.GetOk(vmSchemaVGA); ok {
+			vm.Platform["vga"] = vga.(string)
+		}
+
+		if videoRAM, ok := d.GetOk(vmSchemaVideoRAM); ok {
+			vm.Platform["videoram"] = strconv.Itoa(videoRAM.(int))
+		}
+
+		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaVGA)
+		d.SetPartial(vmSchemaVideoRAM)
+	}
+
+	if d.HasChange(vmSchemaTags) {
+		if err := c.client.VM.SetTags(c.session, vm.VMRef, readStringSet(d.Get(vmSchemaTags).(*schema.Set))); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaTags)
+	}
+
+	if d.HasChange(vmSchemaBlockedOperations) || d.HasChange(vmSchemaDestroyProtection) {
+		if err := updateVMBlockedOperations(c, vm, readVMBlockedOperations(d)); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaBlockedOperations)
+		d.SetPartial(vmSchemaDestroyProtection)
+	}
+
+	if d.HasChange(vmSchemaOtherConfig) {
+		o, n := d.GetChange(vmSchemaOtherConfig)
+		mergeManagedMap(vm.OtherConfig, o.(map[string]interface{}), n.(map[string]interface{}))
+
+		if err := c.client.VM.SetOtherConfig(c.session, vm.VMRef, vm.OtherConfig); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaOtherConfig)
+	}
+
+	if d.HasChange(vmSchemaPlatform) {
+		o, n := d.GetChange(vmSchemaPlatform)
+		mergeManagedMap(vm.Platform, o.(map[string]interface{}), n.(map[string]interface{}))
+
+		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaPlatform)
+	}
+
+	if d.HasChange(vmSchemaAffinityHost) {
+		_, n := d.GetChange(vmSchemaAffinityHost)
+
+		if err := updateVMAffinity(c, vm, n.(string)); err != nil {
+			return err
+		}
+
+		// Move the running VM to its new home instead of waiting for the next start
+		if n.(string) != "" && vm.PowerState == xenAPI.VMPowerStateRunning && vm.ResidentOn != vm.Affinity {
+			if err := migrateVM(c, vm, vm.Affinity, d.Get(vmSchemaMigrationSRUUID).(string)); err != nil {
+				return err
+			}
+		}
+
+		d.SetPartial(vmSchemaAffinityHost)
+	}
+
+	if err := updateVMHAOptions(c, vm, d); err != nil {
+		return err
+	}
+
+	if d.HasChange(vmSchemaSecureBoot) {
+		_, n := d.GetChange(vmSchemaSecureBoot)
+
+		if err := setVMFirmware(c, vm, vmFirmware(vm), n.(bool)); err != nil {
+			return err
+		}
+
+		if err := c.client.VM.SetPlatform(c.session, vm.VMRef, vm.Platform); err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaSecureBoot)
+	}
+
+	if d.HasChange(vmSchemaPowerState) {
+		_, n := d.GetChange(vmSchemaPowerState)
+
+		err := setVMPowerState(c, vm, n.(string),
+			d.Get(vmSchemaForcePowerTransitions).(bool),
+			d.Get(vmSchemaPlacementStrategy).(string))
+		if err != nil {
+			return err
+		}
+
+		d.SetPartial(vmSchemaPowerState)
+	}
+
 	d.Partial(false)
 
 	return resourceVMRead(d, m)
@@ -877,14 +2143,57 @@ func resourceVMDelete(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	if d.Get(vmSchemaDestroyProtection).(bool) {
+		return fmt.Errorf("VM %q is protected from destruction, set %q to false and apply before destroying it", vm.Name, vmSchemaDestroyProtection)
+	}
+
+	// Blocked operations protect the VM from XenCenter, not from Terraform
+	if len(vm.BlockedOperations) > 0 {
+		log.Printf("[TRACE] Clearing blocked operations - %s", d.Id())
+		if err := updateVMBlockedOperations(c, &vm, nil); err != nil {
+			return err
+		}
+	}
+
 	// Shutdown VM
 	if vm.PowerState == xenAPI.VMPowerStateRunning {
-		log.Printf("[TRACE] Shutting down VM - %s", d.Id());
+		log.Printf("[TRACE] Shutting down VM - %s", d.Id())
+		if d.Get(vmSchemaForcePowerTransitions).(bool) {
+			if err := c.client.VM.HardShutdown(c.session, vm.VMRef); err != nil {
+				return err
+			}
+		} else {
+			timeout := time.Duration(d.Get(vmSchemaShutdownTimeout).(int)) * time.Second
+			if err := shutdownVM(c, &vm, timeout); err != nil {
+				return err
+			}
+		}
+	} else if vm.PowerState != xenAPI.VMPowerStateHalted {
+		log.Printf("[TRACE] Shutting down %s VM - %s", vm.PowerState, d.Id())
 		if err := c.client.VM.HardShutdown(c.session, vm.VMRef); err != nil {
 			return err
 		}
 	}
 
+	// Keep the VM together with its disks and interfaces in the template catalog
+	if d.Get(vmSchemaOnDestroy).(string) == vmOnDestroyConvertToTemplate {
+		log.Printf("[TRACE] Converting VM to template - %s", d.Id())
+		if err := c.client.VM.SetIsATemplate(c.session, vm.VMRef, true); err != nil {
+			log.Printf("[ERROR] Error converting VM to template - %s", err)
+			return err
+		}
+
+		d.SetId("")
+		return nil
+	}
+
+	if d.Get(vmSchemaSnapshotBeforeDestroy).(bool) {
+		if err := snapshotVM(c, &vm, snapshotReasonDestroy, d.Get(vmSchemaSnapshotRetention).(int)); err != nil {
+			log.Printf("[ERROR] Error taking snapshot before destroy - %s", err)
+			return err
+		}
+	}
+
 	// Destroy Network Interfaces
 	log.Printf("[TRACE] Retrieving VIFs")
 	vifs, err := c.client.VM.GetVIFs(c.session, vm.VMRef)
@@ -910,6 +2219,20 @@ func resourceVMDelete(d *schema.ResourceData, m interface{}) error {
 	}
 	log.Printf("[DEBUG] Found %d Template VBDs", len(vbds))
 
+	log.Printf("[TRACE] Retrieving inline VDIs")
+	var inlineVDIs []xenAPI.VDIRef
+	if inlineVDIs, err = queryInlineVDIs(c, &vm); err != nil {
+		log.Printf("[ERROR] Retrieving inline VDIs")
+		return err
+	}
+
+	log.Printf("[TRACE] Retrieving config drive VDIs")
+	var configDrives []xenAPI.VDIRef
+	if configDrives, err = queryConfigDriveVDIs(c, &vm); err != nil {
+		log.Printf("[ERROR] Retrieving config drive VDIs")
+		return err
+	}
+
 	// Destroy VM
 	log.Printf("[TRACE] Destroying VM")
 	if err := c.client.VM.Destroy(c.session, vm.VMRef); err != nil {
@@ -922,10 +2245,173 @@ func resourceVMDelete(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	for _, vdi := range inlineVDIs {
+		log.Printf("[TRACE] Destroying inline VDI - %s", vdi)
+		if err = c.client.VDI.Destroy(c.session, vdi); err != nil {
+			log.Printf("[ERROR] Error Destroying inline VDI - %s", vdi)
+			return err
+		}
+	}
+
+	for _, vdi := range configDrives {
+		log.Printf("[TRACE] Destroying config drive VDI - %s", vdi)
+		if err = c.client.VDI.Destroy(c.session, vdi); err != nil {
+			log.Printf("[ERROR] Error Destroying config drive VDI - %s", vdi)
+			return err
+		}
+	}
+
 	d.SetId("")
 	return nil
 }
 
+// Returns UUIDs of the existing VDIs the configuration attaches to the VM
+func readConfiguredVDIUUIDs(d *schema.ResourceData) []string {
+	uuids := make([]string, 0)
+
+	for _, key := range []string{vmSchemaHardDrive, vmSchemaCdRom} {
+		for _, schm := range d.Get(key).(*schema.Set).List() {
+			data := schm.(map[string]interface{})
+			if data[vbdSchemaTemplateDevice].(bool) {
+				continue
+			}
+			if uuid, ok := data[vbdSchemaVdiUUID].(string); ok && uuid != "" {
+				uuids = append(uuids, uuid)
+			}
+		}
+	}
+
+	return uuids
+}
+
+// Destroys a VM whose creation failed together with the disks created for it, including
+// created VDIs which were never attached. Disks attached from the configuration and CDs
+// other than config drives are kept.
+func rollbackVMCreate(c *Connection, vm *VMDescriptor, keep []string, created []xenAPI.VDIRef) error {
+	powerState, err := c.client.VM.GetPowerState(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	if powerState != xenAPI.VMPowerStateHalted {
+		if err = c.client.VM.HardShutdown(c.session, vm.VMRef); err != nil {
+			return err
+		}
+	}
+
+	// Blocked operations may prevent destroy
+	if err = c.client.VM.SetBlockedOperations(c.session, vm.VMRef, map[xenAPI.VMOperations]string{}); err != nil {
+		return err
+	}
+
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	vdis := make([]xenAPI.VDIRef, 0)
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		if vbd.Empty {
+			continue
+		}
+
+		if vbd.Type == xenAPI.VbdTypeDisk || vbd.OtherConfig[vbdOtherConfigConfigDrive] == "true" {
+			uuid, err := c.client.VDI.GetUUID(c.session, vbd.VDI)
+			if err != nil {
+				return err
+			}
+
+			if !containsString(keep, uuid) {
+				vdis = append(vdis, vbd.VDI)
+			}
+		}
+	}
+
+	for _, vdi := range created {
+		attached := false
+		for _, ref := range vdis {
+			if ref == vdi {
+				attached = true
+				break
+			}
+		}
+
+		if !attached {
+			vdis = append(vdis, vdi)
+		}
+	}
+
+	if err = c.client.VM.Destroy(c.session, vm.VMRef); err != nil {
+		return err
+	}
+
+	for _, vdi := range vdis {
+		log.Printf("[DEBUG] Destroying VDI %s of failed VM", vdi)
+		if err = c.client.VDI.Destroy(c.session, vdi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the changed fields which can not be applied to a running VM.
+// Firmware keeps its variables in memory while running, so NVRAM is only written to halted VMs.
+func vmChangesRequiringHalt(d *schema.ResourceData, vm *VMDescriptor) []string {
+	fields := make([]string, 0)
+
+	for _, field := range []string{vmSchemaStaticMemoryMin, vmSchemaStaticMemoryMax} {
+		if d.HasChange(field) {
+			fields = append(fields, field)
+		}
+	}
+
+	if d.HasChange(vmSchemaVcpus) && d.Get(vmSchemaVcpus).(int) != vm.VCPUCount {
+		fields = append(fields, vmSchemaVcpus)
+	}
+
+	if d.HasChange(vmSchemaVcpusMax) && d.Get(vmSchemaVcpusMax).(int) != vm.VCPUCount {
+		fields = append(fields, vmSchemaVcpusMax)
+	}
+
+	if d.HasChange(vmSchemaNVRAM) {
+		fields = append(fields, vmSchemaNVRAM)
+	}
+
+	return fields
+}
+
+// Options which only affect how the provider manages the VM, changing them alone does not touch the VM
+var vmProviderOptions = []string{
+	vmSchemaWaitForIP,
+	vmSchemaWaitForTools,
+	vmSchemaPlacementStrategy,
+	vmSchemaForcePowerTransitions,
+	vmSchemaShutdownTimeout,
+	vmSchemaMigrationSRUUID,
+	vmSchemaOnDestroy,
+	vmSchemaSnapshotBeforeUpdate,
+	vmSchemaSnapshotBeforeDestroy,
+	vmSchemaSnapshotRetention,
+	vmSchemaAllowRestart,
+}
+
+// Returns true if the update changes the VM itself rather than only provider options
+func hasVMConfigChange(d *schema.ResourceData) bool {
+	for key := range resourceVM().Schema {
+		if !containsString(vmProviderOptions, key) && d.HasChange(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func resourceVMExists(d *schema.ResourceData, m interface{}) (bool, error) {
 	log.Printf("[TRACE] resourceVMExists - %s", d.Id())
 
@@ -946,3 +2432,359 @@ func resourceVMExists(d *schema.ResourceData, m interface{}) (bool, error) {
 	log.Printf("[TRACE] VM exists");
 	return true, nil
 }
+
+// Picks the address to export as ip_address: first IPv4 by device order, otherwise first reported one
+func primaryIPAddress(networks map[int][]string) (string, []string) {
+	devices := make([]int, 0, len(networks))
+	for device := range networks {
+		devices = append(devices, device)
+	}
+	sort.Ints(devices)
+
+	primary := ""
+	addresses := make([]string, 0)
+	for _, device := range devices {
+		for _, address := range networks[device] {
+			if primary == "" {
+				if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+					primary = address
+				}
+			}
+			addresses = append(addresses, address)
+		}
+	}
+
+	if primary == "" && len(addresses) > 0 {
+		primary = addresses[0]
+	}
+
+	return primary, addresses
+}
+
+func setSchemaIPAddresses(c *Connection, vm *VMDescriptor, d *schema.ResourceData) error {
+	networks, err := vm.QueryGuestNetworks(c)
+	if err != nil {
+		return err
+	}
+
+	primary, addresses := primaryIPAddress(networks)
+
+	if err = d.Set(vmSchemaIPAddress, primary); err != nil {
+		return err
+	}
+
+	return d.Set(vmSchemaIPAddresses, addresses)
+}
+
+// Polls guest metrics until the guest agent reports an IP address
+func waitForVMIPAddress(c *Connection, vm *VMDescriptor, timeout time.Duration) error {
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"waiting"},
+		Target:  []string{"ready"},
+		Refresh: func() (interface{}, string, error) {
+			if err := vm.Query(c); err != nil {
+				return nil, "", err
+			}
+
+			networks, err := vm.QueryGuestNetworks(c)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if primary, _ := primaryIPAddress(networks); primary != "" {
+				log.Printf("[DEBUG] VM %s reported IP address %s", vm.UUID, primary)
+				return vm, "ready", nil
+			}
+
+			return vm, "waiting", nil
+		},
+		Timeout:    timeout,
+		Delay:      10 * time.Second,
+		MinTimeout: 5 * time.Second,
+	}
+
+	_, err := stateConf.WaitForState()
+	return err
+}
+
+// Waits until the guest reports that PV drivers are running
+func waitForVMTools(c *Connection, vm *VMDescriptor, timeout time.Duration) error {
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"waiting"},
+		Target:  []string{"ready"},
+		Refresh: func() (interface{}, string, error) {
+			if err := vm.Query(c); err != nil {
+				return nil, "", err
+			}
+
+			if vm.GuestMetrics == "" || vm.GuestMetrics == nullRef {
+				return vm, "waiting", nil
+			}
+
+			metrics, err := c.client.VMGuestMetrics.GetRecord(c.session, vm.GuestMetrics)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if metrics.PVDriversDetected {
+				log.Printf("[DEBUG] VM %s reported PV drivers", vm.UUID)
+				return vm, "ready", nil
+			}
+
+			return vm, "waiting", nil
+		},
+		Timeout:    timeout,
+		Delay:      10 * time.Second,
+		MinTimeout: 5 * time.Second,
+	}
+
+	_, err := stateConf.WaitForState()
+	return err
+}
+
+// Sets the VM's home server, empty UUID resets it
+func updateVMAffinity(c *Connection, vm *VMDescriptor, hostUUID string) error {
+	host := &HostDescriptor{
+		HostRef: xenAPI.HostRef(nullRef),
+	}
+
+	if hostUUID != "" {
+		host.UUID = hostUUID
+		if err := host.Load(c); err != nil {
+			return err
+		}
+	}
+
+	if err := c.client.VM.SetAffinity(c.session, vm.VMRef, host.HostRef); err != nil {
+		return err
+	}
+
+	vm.Affinity = host.HostRef
+
+	return nil
+}
+
+// Returns UUID of the referenced host or empty string for null reference
+func queryHostUUID(c *Connection, ref xenAPI.HostRef) (string, error) {
+	if ref == "" || ref == nullRef {
+		return "", nil
+	}
+
+	host := &HostDescriptor{
+		HostRef: ref,
+	}
+	if err := host.Query(c); err != nil {
+		return "", err
+	}
+
+	return host.UUID, nil
+}
+
+// Commits changed HA related fields of the VM
+func updateVMHAOptions(c *Connection, vm *VMDescriptor, d *schema.ResourceData) error {
+	if d.HasChange(vmSchemaHARestartPriority) {
+		vm.HARestartPriority = d.Get(vmSchemaHARestartPriority).(string)
+		if err := c.client.VM.SetHaRestartPriority(c.session, vm.VMRef, vm.HARestartPriority); err != nil {
+			return err
+		}
+		d.SetPartial(vmSchemaHARestartPriority)
+	}
+
+	if d.HasChange(vmSchemaHAAlwaysRun) {
+		vm.HAAlwaysRun = d.Get(vmSchemaHAAlwaysRun).(bool)
+		if err := c.client.VM.SetHaAlwaysRun(c.session, vm.VMRef, vm.HAAlwaysRun); err != nil {
+			return err
+		}
+		d.SetPartial(vmSchemaHAAlwaysRun)
+	}
+
+	if d.HasChange(vmSchemaOrder) {
+		vm.Order = d.Get(vmSchemaOrder).(int)
+		if err := c.client.VM.SetOrder(c.session, vm.VMRef, vm.Order); err != nil {
+			return err
+		}
+		d.SetPartial(vmSchemaOrder)
+	}
+
+	if d.HasChange(vmSchemaStartDelay) {
+		vm.StartDelay = d.Get(vmSchemaStartDelay).(int)
+		if err := c.client.VM.SetStartDelay(c.session, vm.VMRef, vm.StartDelay); err != nil {
+			return err
+		}
+		d.SetPartial(vmSchemaStartDelay)
+	}
+
+	if d.HasChange(vmSchemaShutdownDelay) {
+		vm.ShutdownDelay = d.Get(vmSchemaShutdownDelay).(int)
+		if err := c.client.VM.SetShutdownDelay(c.session, vm.VMRef, vm.ShutdownDelay); err != nil {
+			return err
+		}
+		d.SetPartial(vmSchemaShutdownDelay)
+	}
+
+	return nil
+}
+
+// Returns firmware the VM boots with, XAPI defaults to BIOS when unset
+func vmFirmware(vm *VMDescriptor) string {
+	if firmware, ok := vm.HVMBootParameters["firmware"]; ok && firmware != "" {
+		return firmware
+	}
+	return vmFirmwareBIOS
+}
+
+// Returns whether Secure Boot is enabled. With auto it is enabled once the pool has certificates.
+func vmSecureBoot(vm *VMDescriptor) bool {
+	return vm.Platform["secureboot"] == "true" || vm.Platform["secureboot"] == "auto"
+}
+
+// Validates and sets firmware and secure boot on the descriptor, the caller commits
+// HVM boot params and platform
+func setVMFirmware(c *Connection, vm *VMDescriptor, firmware string, secureBoot bool) error {
+	if firmware == vmFirmwareUEFI {
+		if vm.IsPV {
+			return fmt.Errorf("UEFI firmware is not supported for PV guests")
+		}
+
+		recommendations, err := c.client.VM.GetRecommendations(c.session, vm.VMRef)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(recommendations, `field="supports-uefi" value="no"`) {
+			return fmt.Errorf("template of VM %q does not support UEFI firmware", vm.Name)
+		}
+	}
+
+	if secureBoot && firmware != vmFirmwareUEFI {
+		return fmt.Errorf("%q requires %q to be %q", vmSchemaSecureBoot, vmSchemaFirmware, vmFirmwareUEFI)
+	}
+
+	pool := &PoolDescriptor{}
+	if err := pool.Load(c); err != nil {
+		return err
+	}
+
+	if firmware == vmFirmwareUEFI && pool.Restrictions["restrict_uefi_boot"] == "true" {
+		return fmt.Errorf("pool %q does not allow UEFI guests", pool.Name)
+	}
+
+	if secureBoot && pool.Restrictions["restrict_uefi_secureboot"] == "true" {
+		return fmt.Errorf("pool %q does not allow Secure Boot guests", pool.Name)
+	}
+
+	vm.HVMBootParameters["firmware"] = firmware
+
+	// Keeps auto of the template when Secure Boot stays enabled
+	if secureBoot != vmSecureBoot(vm) {
+		vm.Platform["secureboot"] = strconv.FormatBool(secureBoot)
+	}
+
+	return nil
+}
+
+// Recommended platform flags for each guest type
+var vmGuestTypePresets = map[string]map[string]string{
+	vmGuestTypeWindows: {
+		"viridian":                "true",
+		"viridian_reference_tsc":  "true",
+		"viridian_time_ref_count": "true",
+		"timeoffset":              "0",
+		"nx":                      "true",
+		"acpi":                    "1",
+		"apic":                    "true",
+		"pae":                     "true",
+		"hpet":                    "true",
+	},
+	vmGuestTypeLinux: {
+		"viridian":   "false",
+		"timeoffset": "0",
+		"nx":         "true",
+		"acpi":       "1",
+		"apic":       "true",
+		"pae":        "true",
+	},
+}
+
+// Prefix of other_config keys holding the platform flags a guest type preset replaced
+const vmOtherConfigGuestTypePresetPrefix = "terraform_guest_type_preset_"
+
+// Replaces the platform flags of the old guest type preset with the flags of the new one.
+// Flags replaced by a preset are kept in other_config and restored once the preset is
+// removed, flags changed since the preset was applied are left alone.
+func applyGuestTypePreset(platform, otherConfig map[string]string, o, n string) {
+	for k, v := range vmGuestTypePresets[o] {
+		saved, ok := otherConfig[vmOtherConfigGuestTypePresetPrefix+k]
+		delete(otherConfig, vmOtherConfigGuestTypePresetPrefix+k)
+
+		if platform[k] != v {
+			continue
+		}
+
+		if ok {
+			platform[k] = saved
+		} else {
+			delete(platform, k)
+		}
+	}
+
+	for k, v := range vmGuestTypePresets[n] {
+		if old, ok := platform[k]; ok {
+			otherConfig[vmOtherConfigGuestTypePresetPrefix+k] = old
+		}
+		platform[k] = v
+	}
+}
+
+// Applies the configured subset of keys onto a map read from XAPI. Keys which were
+// configured before but are not anymore are removed, all other keys are left intact.
+func mergeManagedMap(target map[string]string, o, n map[string]interface{}) {
+	for k := range o {
+		if _, ok := n[k]; !ok {
+			delete(target, k)
+		}
+	}
+
+	for k, v := range n {
+		target[k] = v.(string)
+	}
+}
+
+// Returns only the keys of a map read from XAPI which are managed by the configuration
+func filterManagedMap(source map[string]string, managed map[string]interface{}) map[string]string {
+	filtered := make(map[string]string)
+
+	for k := range managed {
+		if v, ok := source[k]; ok {
+			filtered[k] = v
+		}
+	}
+
+	return filtered
+}
+
+// Returns the operations to block, including destroy when the VM is protected
+func readVMBlockedOperations(d *schema.ResourceData) []string {
+	operations := readStringSet(d.Get(vmSchemaBlockedOperations).(*schema.Set))
+
+	if d.Get(vmSchemaDestroyProtection).(bool) && !containsString(operations, vmOperationDestroy) {
+		operations = append(operations, vmOperationDestroy)
+	}
+
+	return operations
+}
+
+// Replaces the set of operations blocked on the VM
+func updateVMBlockedOperations(c *Connection, vm *VMDescriptor, operations []string) error {
+	blockedOperations := make(map[xenAPI.VMOperations]string)
+	for _, operation := range operations {
+		blockedOperations[xenAPI.VMOperations(operation)] = "true"
+	}
+
+	if err := c.client.VM.SetBlockedOperations(c.session, vm.VMRef, blockedOperations); err != nil {
+		return err
+	}
+
+	vm.BlockedOperations = blockedOperations
+
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"log"
+	"os"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	vmExportSchemaVMUUID      = "vm_uuid"
+	vmExportSchemaDestination = "destination"
+	vmExportSchemaCompress    = "compress"
+	vmExportSchemaSize        = "size"
+)
+
+func resourceVMExport() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVMExportCreate,
+		Read:   resourceVMExportRead,
+		Delete: resourceVMExportDelete,
+
+		Schema: map[string]*schema.Schema{
+			vmExportSchemaVMUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vmExportSchemaDestination: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			vmExportSchemaCompress: &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				ForceNew: true,
+			},
+
+			vmExportSchemaSize: &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceVMExportCreate(d *schema.ResourceData, m interface{}) error {
+	c := m.(*Connection)
+
+	vm := &VMDescriptor{
+		UUID: d.Get(vmExportSchemaVMUUID).(string),
+	}
+	if err := vm.Load(c); err != nil {
+		return err
+	}
+
+	destination := d.Get(vmExportSchemaDestination).(string)
+
+	size, err := exportXVA(c, vm, destination, d.Get(vmExportSchemaCompress).(bool))
+	if err != nil {
+		log.Printf("[ERROR] Failed to export VM %s - %s", vm.UUID, err)
+		return err
+	}
+
+	d.SetId(destination)
+
+	return d.Set(vmExportSchemaSize, int(size))
+}
+
+func resourceVMExportRead(d *schema.ResourceData, m interface{}) error {
+	destination := d.Get(vmExportSchemaDestination).(string)
+
+	// Remote destinations can not be inspected, assume the image is still there
+	if isRemoteLocation(destination) {
+		return nil
+	}
+
+	info, err := os.Stat(destination)
+	if os.IsNotExist(err) {
+		log.Printf("[DEBUG] Exported image %s is gone", destination)
+		d.SetId("")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.Set(vmExportSchemaSize, int(info.Size()))
+}
+
+// Exported images outlive the resource, destroying it only removes it from the state
+func resourceVMExportDelete(d *schema.ResourceData, m interface{}) error {
+	d.SetId("")
+	return nil
+}
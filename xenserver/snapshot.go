@@ -0,0 +1,225 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/fiveai/go-xen-api-client"
+)
+
+const (
+	// Key in snapshot's other_config marking snapshots taken by the provider. VDI snapshots
+	// store their retention group as value.
+	vmOtherConfigTerraformSnapshot  = "terraform_snapshot"
+	vdiOtherConfigTerraformSnapshot = "terraform_snapshot"
+
+	// Value marking VDI snapshots which belong to no retention group
+	vdiSnapshotNoGroup = "true"
+
+	// Key in snapshot's other_config marking VDI snapshots whose resource was destroyed and
+	// which are only kept for the retention of their group
+	vdiOtherConfigSnapshotReleased = "terraform_snapshot_released"
+
+	snapshotReasonUpdate  = "update"
+	snapshotReasonDestroy = "destroy"
+)
+
+// Takes a snapshot of the VM before a destructive operation and prunes older provider snapshots,
+// keeping at most retention of them. Zero retention keeps all snapshots.
+func snapshotVM(c *Connection, vm *VMDescriptor, reason string, retention int) error {
+	name := fmt.Sprintf("%s before %s %s", vm.Name, reason, time.Now().UTC().Format(time.RFC3339))
+
+	log.Printf("[DEBUG] Taking snapshot %q of VM %s", name, vm.UUID)
+
+	snapshot, err := c.client.VM.Snapshot(c.session, vm.VMRef, name)
+	if err != nil {
+		return err
+	}
+
+	if err = c.client.VM.AddToOtherConfig(c.session, snapshot, vmOtherConfigTerraformSnapshot, reason); err != nil {
+		return err
+	}
+
+	if retention > 0 {
+		return pruneVMSnapshots(c, vm, retention)
+	}
+
+	return nil
+}
+
+// Destroys the oldest provider snapshots of the VM, so that only retention of them remain
+func pruneVMSnapshots(c *Connection, vm *VMDescriptor, retention int) error {
+	refs, err := c.client.VM.GetSnapshots(c.session, vm.VMRef)
+	if err != nil {
+		return err
+	}
+
+	type snapshotInfo struct {
+		ref  xenAPI.VMRef
+		time time.Time
+	}
+
+	snapshots := make([]snapshotInfo, 0, len(refs))
+	for _, ref := range refs {
+		record, err := c.client.VM.GetRecord(c.session, ref)
+		if err != nil {
+			return err
+		}
+
+		// Snapshots taken by other tools are left alone
+		if _, ok := record.OtherConfig[vmOtherConfigTerraformSnapshot]; !ok {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshotInfo{ref, record.SnapshotTime})
+	}
+
+	if len(snapshots) <= retention {
+		return nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].time.Before(snapshots[j].time)
+	})
+
+	for _, snapshot := range snapshots[:len(snapshots)-retention] {
+		if err = destroySnapshot(c, snapshot.ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Destroys the snapshot together with its disks
+func destroySnapshot(c *Connection, snapshot xenAPI.VMRef) error {
+	vbdRefs, err := c.client.VM.GetVBDs(c.session, snapshot)
+	if err != nil {
+		return err
+	}
+
+	vdis := make([]xenAPI.VDIRef, 0, len(vbdRefs))
+	for _, vbdRef := range vbdRefs {
+		vbd, err := c.client.VBD.GetRecord(c.session, vbdRef)
+		if err != nil {
+			return err
+		}
+
+		if vbd.Type == xenAPI.VbdTypeDisk && !vbd.Empty {
+			vdis = append(vdis, vbd.VDI)
+		}
+	}
+
+	log.Printf("[DEBUG] Destroying snapshot %s", snapshot)
+
+	if err = c.client.VM.Destroy(c.session, snapshot); err != nil {
+		return err
+	}
+
+	for _, vdi := range vdis {
+		if err = c.client.VDI.Destroy(c.session, vdi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Takes a snapshot of the VDI, tagged with the retention group it belongs to
+func snapshotVDI(c *Connection, vdi *VDIDescriptor, name, group string) (xenAPI.VDIRef, error) {
+	log.Printf("[DEBUG] Taking snapshot %q of VDI %s", name, vdi.UUID)
+
+	snapshot, err := c.client.VDI.Snapshot(c.session, vdi.VDIRef, map[string]string{})
+	if err != nil {
+		return "", err
+	}
+
+	if err = c.client.VDI.SetNameLabel(c.session, snapshot, name); err != nil {
+		return "", err
+	}
+
+	if group == "" {
+		group = vdiSnapshotNoGroup
+	}
+
+	if err = c.client.VDI.AddToOtherConfig(c.session, snapshot, vdiOtherConfigTerraformSnapshot, group); err != nil {
+		return "", err
+	}
+
+	return snapshot, nil
+}
+
+// Destroys the oldest snapshots of the VDI in the retention group beyond the retention. Snapshots
+// still owned by a resource count towards the retention but are never destroyed, only released
+// ones are.
+func pruneVDISnapshots(c *Connection, vdi *VDIDescriptor, group string, retention int) error {
+	refs, err := c.client.VDI.GetSnapshots(c.session, vdi.VDIRef)
+	if err != nil {
+		return err
+	}
+
+	type snapshotInfo struct {
+		ref      xenAPI.VDIRef
+		uuid     string
+		time     time.Time
+		released bool
+	}
+
+	snapshots := make([]snapshotInfo, 0, len(refs))
+	for _, ref := range refs {
+		record, err := c.client.VDI.GetRecord(c.session, ref)
+		if err != nil {
+			return err
+		}
+
+		// Snapshots of other groups and taken by other tools are left alone
+		if record.OtherConfig[vdiOtherConfigTerraformSnapshot] != group {
+			continue
+		}
+
+		released := record.OtherConfig[vdiOtherConfigSnapshotReleased] == "true"
+		snapshots = append(snapshots, snapshotInfo{ref, record.UUID, record.SnapshotTime, released})
+	}
+
+	if len(snapshots) <= retention {
+		return nil
+	}
+
+	// Newest first, so everything past the retention is expired
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].time.After(snapshots[j].time)
+	})
+
+	for _, snapshot := range snapshots[retention:] {
+		if !snapshot.released {
+			continue
+		}
+
+		log.Printf("[DEBUG] Destroying snapshot %s of VDI %s", snapshot.uuid, vdi.UUID)
+		if err = c.client.VDI.Destroy(c.session, snapshot.ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
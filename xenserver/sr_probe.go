@@ -0,0 +1,177 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/fiveai/go-xen-api-client"
+)
+
+// Targets listed by probing an iSCSI portal without a target IQN
+type iscsiProbeTargets struct {
+	XMLName xml.Name `xml:"iscsi-target-iqns"`
+	Targets []struct {
+		IPAddress string `xml:"IPAddress"`
+		TargetIQN string `xml:"TargetIQN"`
+	} `xml:"TGT"`
+}
+
+// LUNs listed by probing an iSCSI target without a SCSI ID
+type iscsiProbeLUNs struct {
+	XMLName xml.Name `xml:"iscsi-target"`
+	LUNs    []struct {
+		LUNID  int    `xml:"LUNid"`
+		SCSIID string `xml:"SCSIid"`
+		Vendor string `xml:"vendor"`
+		Size   int64  `xml:"size"`
+	} `xml:"LUN"`
+}
+
+// Block devices listed by probing the host bus adapters of a host
+type hbaProbeDevices struct {
+	XMLName xml.Name `xml:"Devlist"`
+	Devices []struct {
+		Path   string `xml:"path"`
+		SCSIID string `xml:"SCSIid"`
+		Vendor string `xml:"vendor"`
+		Serial string `xml:"serial"`
+		Size   int64  `xml:"size"`
+		LUN    int    `xml:"lun"`
+	} `xml:"BlockDevice"`
+}
+
+// Probes the storage for the SR type from the host. Storage managers report the discovered
+// details either as result or as the last parameter of the error about the missing ones.
+func probeSR(c *Connection, host xenAPI.HostRef, deviceConfig map[string]string, srType string) (string, error) {
+	result, err := c.client.SR.Probe(c.session, host, deviceConfig, srType, map[string]string{})
+	if err == nil {
+		return result, nil
+	}
+
+	if xenErr, ok := err.(*xenAPI.Error); ok {
+		params := xenErr.Params()
+		if len(params) > 0 && strings.HasPrefix(strings.TrimSpace(params[len(params)-1]), "<") {
+			return params[len(params)-1], nil
+		}
+	}
+
+	return "", err
+}
+
+// Discovers the target IQN and SCSI ID of an iSCSI SR, unless they are configured. A LUN
+// number selects the SCSI ID when the target offers several LUNs.
+func discoverISCSI(c *Connection, host xenAPI.HostRef, deviceConfig map[string]string, lun int) error {
+	if deviceConfig[srDeviceConfigTargetIQN] == "" {
+		result, err := probeSR(c, host, deviceConfig, srTypeISCSI)
+		if err != nil {
+			return err
+		}
+
+		var targets iscsiProbeTargets
+		if err = xml.Unmarshal([]byte(result), &targets); err != nil {
+			return fmt.Errorf("unexpected iSCSI target list - %s", err)
+		}
+
+		iqns := make([]string, 0)
+		for _, target := range targets.Targets {
+			// The wildcard stands for all targets of the portal
+			if target.TargetIQN != "*" && !containsString(iqns, target.TargetIQN) {
+				iqns = append(iqns, target.TargetIQN)
+			}
+		}
+
+		if len(iqns) != 1 {
+			return fmt.Errorf("iSCSI portal %s offers %d targets, set %q to one of %v", deviceConfig[srDeviceConfigTarget], len(iqns), srISCSISchemaTargetIQN, iqns)
+		}
+
+		log.Printf("[DEBUG] Discovered iSCSI target %s", iqns[0])
+		deviceConfig[srDeviceConfigTargetIQN] = iqns[0]
+	}
+
+	if deviceConfig[srDeviceConfigSCSIID] == "" {
+		result, err := probeSR(c, host, deviceConfig, srTypeISCSI)
+		if err != nil {
+			return err
+		}
+
+		var luns iscsiProbeLUNs
+		if err = xml.Unmarshal([]byte(result), &luns); err != nil {
+			return fmt.Errorf("unexpected iSCSI LUN list - %s", err)
+		}
+
+		ids := make([]string, 0)
+		for _, l := range luns.LUNs {
+			if lun >= 0 && l.LUNID != lun {
+				continue
+			}
+			ids = append(ids, l.SCSIID)
+		}
+
+		if len(ids) != 1 {
+			return fmt.Errorf("iSCSI target %s has %d matching LUNs, set %q or %q to select one of %v", deviceConfig[srDeviceConfigTargetIQN], len(ids), srISCSISchemaLUN, srISCSISchemaSCSIID, ids)
+		}
+
+		log.Printf("[DEBUG] Discovered SCSI ID %s", ids[0])
+		deviceConfig[srDeviceConfigSCSIID] = ids[0]
+	}
+
+	return nil
+}
+
+// Discovers the SCSI ID of a Fibre Channel or FCoE SR, unless it is configured. A LUN number
+// selects the SCSI ID when the host sees several LUNs.
+func discoverHBA(c *Connection, host xenAPI.HostRef, srType string, deviceConfig map[string]string, lun int) error {
+	if deviceConfig[srDeviceConfigSCSIID] != "" {
+		return nil
+	}
+
+	result, err := probeSR(c, host, deviceConfig, srType)
+	if err != nil {
+		return err
+	}
+
+	var devices hbaProbeDevices
+	if err = xml.Unmarshal([]byte(result), &devices); err != nil {
+		return fmt.Errorf("unexpected HBA device list - %s", err)
+	}
+
+	// Each path to a LUN is listed as a device of its own
+	ids := make([]string, 0)
+	for _, device := range devices.Devices {
+		if lun >= 0 && device.LUN != lun {
+			continue
+		}
+		if !containsString(ids, device.SCSIID) {
+			ids = append(ids, device.SCSIID)
+		}
+	}
+
+	if len(ids) != 1 {
+		return fmt.Errorf("host bus adapters see %d matching LUNs, set %q or %q to select one of %v", len(ids), srHBASchemaLUN, srHBASchemaSCSIID, ids)
+	}
+
+	log.Printf("[DEBUG] Discovered SCSI ID %s", ids[0])
+	deviceConfig[srDeviceConfigSCSIID] = ids[0]
+
+	return nil
+}
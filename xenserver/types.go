@@ -21,22 +21,31 @@ package xenserver
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/fiveai/go-xen-api-client"
 )
 
+// Reference XAPI returns for unset object fields
+const nullRef = "OpaqueRef:NULL"
+
 type Range struct {
 	Min int
 	Max int
 }
 
 type NetworkDescriptor struct {
-	UUID        string
-	Name        string
-	Description string
-	Bridge      string
-	MTU         int
+	UUID               string
+	Name               string
+	Description        string
+	Bridge             string
+	MTU                int
+	OtherConfig        map[string]string
+	Purpose            []string
+	DefaultLockingMode xenAPI.NetworkDefaultLockingMode
+	Managed            bool
 
 	NetworkRef xenAPI.NetworkRef
 }
@@ -50,6 +59,11 @@ type VMDescriptor struct {
 	StaticMemory      Range
 	DynamicMemory     Range
 	VCPUCount         int
+	VCPUsAtStartup    int
+	VCPUParams        map[string]string
+	BIOSStrings       map[string]string
+	NVRAM             map[string]string
+	GenerationID      string
 	VIFCount          int
 	VBDCount          int
 	PCICount          int
@@ -58,6 +72,16 @@ type VMDescriptor struct {
 	HVMBootParameters map[string]string
 	Platform          map[string]string
 	IsATemplate       bool
+	GuestMetrics      xenAPI.VMGuestMetricsRef
+	Affinity          xenAPI.HostRef
+	ResidentOn        xenAPI.HostRef
+	HARestartPriority string
+	HAAlwaysRun       bool
+	Order             int
+	StartDelay        int
+	ShutdownDelay     int
+	Tags              []string
+	BlockedOperations map[xenAPI.VMOperations]string
 
 	VMRef xenAPI.VMRef
 }
@@ -71,6 +95,14 @@ type VIFDescriptor struct {
 	IsAutogeneratedMAC bool
 	DeviceOrder        int
 	OtherConfig        map[string]string
+	LockingMode        xenAPI.VifLockingMode
+	IPv4Allowed        []string
+	IPv6Allowed        []string
+	IPv4Address        string
+	IPv4Gateway        string
+	IPv6Address        string
+	IPv6Gateway        string
+	CurrentlyAttached  bool
 
 	VIFRef xenAPI.VIFRef
 }
@@ -83,38 +115,96 @@ type SRDescriptor struct {
 	Type        string
 	ContentType string
 	Shared      bool
+	PBDs        []xenAPI.PBDRef
+	Tags        []string
+	OtherConfig map[string]string
+
+	PhysicalSize        int
+	PhysicalUtilisation int
+	VirtualAllocation   int
 
 	SRRef xenAPI.SRRef
 }
 
+type PBDDescriptor struct {
+	UUID              string
+	Host              xenAPI.HostRef
+	SR                xenAPI.SRRef
+	DeviceConfig      map[string]string
+	CurrentlyAttached bool
+
+	PBDRef xenAPI.PBDRef
+}
+
 type VDIDescriptor struct {
-	Name       string
-	UUID       string
-	SR         *SRDescriptor
-	IsShared   bool
-	IsReadOnly bool
-	Size       int
+	Name         string
+	Description  string
+	UUID         string
+	SR           *SRDescriptor
+	IsShared     bool
+	IsReadOnly   bool
+	Size         int
+	OtherConfig  map[string]string
+	SMConfig     map[string]string
+	AllowCaching bool
+	OnBoot       xenAPI.OnBoot
+	CbtEnabled   bool
 
 	VDIRef xenAPI.VDIRef
 }
 
 type VBDDescriptor struct {
-	UUID             string
-	VM               *VMDescriptor
-	VDI              *VDIDescriptor
-	Device           string
-	UserDevice       string
-	Mode             xenAPI.VbdMode
-	Type             xenAPI.VbdType
-	Bootable         bool
-	OtherConfig      map[string]string
-	IsTemplateDevice bool
+	UUID               string
+	VM                 *VMDescriptor
+	VDI                *VDIDescriptor
+	Device             string
+	UserDevice         string
+	Mode               xenAPI.VbdMode
+	Type               xenAPI.VbdType
+	Bootable           bool
+	OtherConfig        map[string]string
+	IsTemplateDevice   bool
+	QoSAlgorithmType   string
+	QoSAlgorithmParams map[string]string
+	CurrentlyAttached  bool
+	Unpluggable        bool
 
 	VBDRef xenAPI.VBDRef
 }
 
+type HostDescriptor struct {
+	UUID        string
+	Name        string
+	Description string
+
+	HostRef xenAPI.HostRef
+}
+
+type PoolDescriptor struct {
+	UUID         string
+	Name         string
+	Restrictions map[string]string
+	Master       xenAPI.HostRef
+	DefaultSR    xenAPI.SRRef
+	SuspendSR    xenAPI.SRRef
+	CrashDumpSR  xenAPI.SRRef
+
+	PoolRef xenAPI.PoolRef
+}
+
 type PIFDescriptor struct {
-	UUID string
+	UUID           string
+	Network        xenAPI.NetworkRef
+	MAC            string
+	Device         string
+	Management     bool
+	IPMode         xenAPI.IPConfigurationMode
+	IP             string
+	Netmask        string
+	Gateway        string
+	DNS            string
+	DisallowUnplug bool
+	OtherConfig    map[string]string
 
 	PIFRef xenAPI.PIFRef
 }
@@ -129,6 +219,17 @@ type VLANDescriptor struct {
 	VLANRef xenAPI.VLANRef
 }
 
+type BondDescriptor struct {
+	UUID         string
+	Master       PIFDescriptor
+	Slaves       []PIFDescriptor
+	Mode         xenAPI.BondMode
+	Properties   map[string]string
+	PrimarySlave string
+
+	BondRef xenAPI.BondRef
+}
+
 func (this *NetworkDescriptor) Load(c *Connection) error {
 	var network xenAPI.NetworkRef
 
@@ -180,6 +281,14 @@ func (this *NetworkDescriptor) Query(c *Connection) error {
 	this.Description = network.NameDescription
 	this.MTU = network.MTU
 	this.Bridge = network.Bridge
+	this.OtherConfig = network.OtherConfig
+	this.DefaultLockingMode = network.DefaultLockingMode
+	this.Managed = network.Managed
+
+	this.Purpose = make([]string, 0, len(network.Purpose))
+	for _, purpose := range network.Purpose {
+		this.Purpose = append(this.Purpose, string(purpose))
+	}
 
 	return nil
 }
@@ -236,6 +345,7 @@ func (this *VMDescriptor) Query(c *Connection) error {
 	this.PowerState = vm.PowerState
 	this.IsPV = vm.PVBootloader != ""
 	this.VCPUCount = vm.VCPUsMax
+	this.VCPUsAtStartup = vm.VCPUsAtStartup
 	this.StaticMemory = Range{
 		Min: vm.MemoryStaticMin,
 		Max: vm.MemoryStaticMax,
@@ -244,13 +354,36 @@ func (this *VMDescriptor) Query(c *Connection) error {
 		Min: vm.MemoryDynamicMin,
 		Max: vm.MemoryDynamicMax,
 	}
+	this.VCPUParams = vm.VCPUsParams
+	if this.VCPUParams == nil {
+		this.VCPUParams = make(map[string]string)
+	}
+	this.BIOSStrings = vm.BiosStrings
+	this.GenerationID = vm.GenerationID
+	this.NVRAM = vm.NVRAM
+	if this.NVRAM == nil {
+		this.NVRAM = make(map[string]string)
+	}
 	this.VIFCount = len(vm.VIFs)
 	this.VBDCount = len(vm.VBDs)
 	this.PCICount = len(vm.AttachedPCIs)
 	this.OtherConfig = vm.OtherConfig
 	this.XenstoreData = vm.XenstoreData
 	this.HVMBootParameters = vm.HVMBootParams
+	if this.HVMBootParameters == nil {
+		this.HVMBootParameters = make(map[string]string)
+	}
 	this.IsATemplate = vm.IsATemplate
+	this.GuestMetrics = vm.GuestMetrics
+	this.Affinity = vm.Affinity
+	this.ResidentOn = vm.ResidentOn
+	this.HARestartPriority = vm.HaRestartPriority
+	this.HAAlwaysRun = vm.HaAlwaysRun
+	this.Order = vm.Order
+	this.StartDelay = vm.StartDelay
+	this.ShutdownDelay = vm.ShutdownDelay
+	this.Tags = vm.Tags
+	this.BlockedOperations = vm.BlockedOperations
 
 	if this.Platform, err = c.client.VM.GetPlatform(c.session, this.VMRef); err != nil {
 		return err
@@ -259,7 +392,54 @@ func (this *VMDescriptor) Query(c *Connection) error {
 	return nil
 }
 
+// Returns the IP addresses reported by the guest agent keyed by device number
+func (this *VMDescriptor) QueryGuestNetworks(c *Connection) (map[int][]string, error) {
+	networks := make(map[int][]string)
+
+	if this.GuestMetrics == "" || this.GuestMetrics == nullRef {
+		return networks, nil
+	}
+
+	metrics, err := c.client.VMGuestMetrics.GetRecord(c.session, this.GuestMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys look like "0/ip", "0/ipv4/0" or "0/ipv6/1"
+	keys := make([]string, 0, len(metrics.Networks))
+	for key := range metrics.Networks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		device, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) < 2 {
+			log.Printf("[WARN] Unexpected guest network key %q", key)
+			continue
+		}
+
+		address := metrics.Networks[key]
+		if address == "" || containsString(networks[device], address) {
+			continue
+		}
+
+		networks[device] = append(networks[device], address)
+	}
+
+	return networks, nil
+}
+
 func (this *VMDescriptor) UpdateMemory(c *Connection) error {
+	// Only the dynamic range can be changed while the VM is running
+	if this.PowerState == xenAPI.VMPowerStateRunning {
+		return c.client.VM.SetMemoryDynamicRange(c.session,
+			this.VMRef,
+			this.DynamicMemory.Min,
+			this.DynamicMemory.Max)
+	}
+
 	return c.client.VM.SetMemoryLimits(c.session,
 		this.VMRef,
 		this.StaticMemory.Min,
@@ -269,13 +449,123 @@ func (this *VMDescriptor) UpdateMemory(c *Connection) error {
 }
 
 func (this *VMDescriptor) UpdateVCPUs(c *Connection) error {
-	if err := c.client.VM.SetVCPUsMax(c.session, this.VMRef, this.VCPUCount); err != nil {
+	currentMax, err := c.client.VM.GetVCPUsMax(c.session, this.VMRef)
+	if err != nil {
+		return err
+	}
+
+	if this.PowerState == xenAPI.VMPowerStateRunning {
+		if currentMax != this.VCPUCount {
+			return fmt.Errorf("maximum number of VCPUs can only be changed when VM is halted")
+		}
+
+		// Hot-add VCPUs up to VCPUs_max
+		return c.client.VM.SetVCPUsNumberLive(c.session, this.VMRef, this.VCPUsAtStartup)
+	}
+
+	// VCPUs_at_startup may never exceed VCPUs_max, so order the calls accordingly
+	if this.VCPUCount >= currentMax {
+		if err := c.client.VM.SetVCPUsMax(c.session, this.VMRef, this.VCPUCount); err != nil {
+			return err
+		}
+		if err := c.client.VM.SetVCPUsAtStartup(c.session, this.VMRef, this.VCPUsAtStartup); err != nil {
+			return err
+		}
+	} else {
+		if err := c.client.VM.SetVCPUsAtStartup(c.session, this.VMRef, this.VCPUsAtStartup); err != nil {
+			return err
+		}
+		if err := c.client.VM.SetVCPUsMax(c.session, this.VMRef, this.VCPUCount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *HostDescriptor) Load(c *Connection) error {
+	var host xenAPI.HostRef
+
+	hasHostName := false
+	hasHostUUID := false
+
+	if this.Name != "" {
+		hosts, err := c.client.Host.GetByNameLabel(c.session, this.Name)
+		if err != nil {
+			return err
+		}
+
+		if len(hosts) == 0 {
+			return fmt.Errorf("Host %q not found!", this.Name)
+		}
+
+		hasHostName = true
+		host = hosts[0]
+	}
+
+	if !hasHostName {
+		if this.UUID != "" {
+			_host, err := c.client.Host.GetByUUID(c.session, this.UUID)
+			if err != nil {
+				return err
+			}
+			hasHostUUID = true
+			host = _host
+		}
+	}
+
+	if !hasHostName && !hasHostUUID {
+		return fmt.Errorf("Either name or UUID should be specified!")
+	}
+
+	this.HostRef = host
+
+	return this.Query(c)
+}
+
+func (this *HostDescriptor) Query(c *Connection) error {
+	host, err := c.client.Host.GetRecord(c.session, this.HostRef)
+	if err != nil {
 		return err
 	}
-	if err := c.client.VM.SetVCPUsAtStartup(c.session, this.VMRef, this.VCPUCount); err != nil {
+
+	this.UUID = host.UUID
+	this.Name = host.NameLabel
+	this.Description = host.NameDescription
+
+	return nil
+}
+
+// Loads the pool the connection belongs to
+func (this *PoolDescriptor) Load(c *Connection) error {
+	pools, err := c.client.Pool.GetAll(c.session)
+	if err != nil {
 		return err
 	}
 
+	if len(pools) == 0 {
+		return fmt.Errorf("Pool not found!")
+	}
+
+	this.PoolRef = pools[0]
+
+	return this.Query(c)
+}
+
+func (this *PoolDescriptor) Query(c *Connection) error {
+	pool, err := c.client.Pool.GetRecord(c.session, this.PoolRef)
+	if err != nil {
+		return err
+	}
+
+	this.UUID = pool.UUID
+	this.Name = pool.NameLabel
+	this.Restrictions = pool.Restrictions
+	this.Master = pool.Master
+	this.DefaultSR = pool.DefaultSR
+	this.SuspendSR = pool.SuspendImageSR
+	this.CrashDumpSR = pool.CrashDumpSR
+
 	return nil
 }
 
@@ -303,6 +593,26 @@ func (this *VIFDescriptor) Query(c *Connection) error {
 	this.IsAutogeneratedMAC = vif.MACAutogenerated
 	this.MAC = vif.MAC
 	this.OtherConfig = vif.OtherConfig
+	this.LockingMode = vif.LockingMode
+	this.IPv4Allowed = vif.Ipv4Allowed
+	this.IPv6Allowed = vif.Ipv6Allowed
+	this.CurrentlyAttached = vif.CurrentlyAttached
+	this.IPv4Address = ""
+	this.IPv4Gateway = ""
+	if vif.Ipv4ConfigurationMode == xenAPI.VifIpv4ConfigurationModeStatic {
+		if len(vif.Ipv4Addresses) > 0 {
+			this.IPv4Address = vif.Ipv4Addresses[0]
+		}
+		this.IPv4Gateway = vif.Ipv4Gateway
+	}
+	this.IPv6Address = ""
+	this.IPv6Gateway = ""
+	if vif.Ipv6ConfigurationMode == xenAPI.VifIpv6ConfigurationModeStatic {
+		if len(vif.Ipv6Addresses) > 0 {
+			this.IPv6Address = vif.Ipv6Addresses[0]
+		}
+		this.IPv6Gateway = vif.Ipv6Gateway
+	}
 
 	if this.Network == nil {
 		this.Network = &NetworkDescriptor{
@@ -377,11 +687,43 @@ func (this *SRDescriptor) Query(c *Connection) error {
 	this.Shared = sr.Shared
 	this.Type = sr.Type
 	this.ContentType = sr.ContentType
+	this.PBDs = sr.PBDs
+	this.Tags = sr.Tags
+	this.OtherConfig = sr.OtherConfig
+	this.PhysicalSize = sr.PhysicalSize
+	this.PhysicalUtilisation = sr.PhysicalUtilisation
+	this.VirtualAllocation = sr.VirtualAllocation
 	log.Println("[DEBUG] ", sr.SmConfig)
 
 	return nil
 }
 
+func (this *PBDDescriptor) Load(c *Connection) error {
+	pbd, err := c.client.PBD.GetByUUID(c.session, this.UUID)
+	if err != nil {
+		return err
+	}
+
+	this.PBDRef = pbd
+
+	return this.Query(c)
+}
+
+func (this *PBDDescriptor) Query(c *Connection) error {
+	pbd, err := c.client.PBD.GetRecord(c.session, this.PBDRef)
+	if err != nil {
+		return err
+	}
+
+	this.UUID = pbd.UUID
+	this.Host = pbd.Host
+	this.SR = pbd.SR
+	this.DeviceConfig = pbd.DeviceConfig
+	this.CurrentlyAttached = pbd.CurrentlyAttached
+
+	return nil
+}
+
 func (this *VDIDescriptor) Load(c *Connection) error {
 	var vdi xenAPI.VDIRef
 
@@ -430,9 +772,15 @@ func (this *VDIDescriptor) Query(c *Connection) error {
 
 	this.UUID = vdi.UUID
 	this.Name = vdi.NameLabel
+	this.Description = vdi.NameDescription
 	this.IsReadOnly = vdi.ReadOnly
 	this.IsShared = vdi.Sharable
 	this.Size = vdi.VirtualSize
+	this.OtherConfig = vdi.OtherConfig
+	this.SMConfig = vdi.SmConfig
+	this.AllowCaching = vdi.AllowCaching
+	this.OnBoot = vdi.OnBoot
+	this.CbtEnabled = vdi.CbtEnabled
 
 	sr := &SRDescriptor{
 		SRRef: vdi.SR,
@@ -447,7 +795,7 @@ func (this *VDIDescriptor) Query(c *Connection) error {
 	return nil
 }
 
-/*func (this *VBDDescriptor) Load(c *Connection) error {
+func (this *VBDDescriptor) Load(c *Connection) error {
 	var vbd xenAPI.VBDRef
 
 	if this.UUID != "" {
@@ -457,13 +805,13 @@ func (this *VDIDescriptor) Query(c *Connection) error {
 		}
 		vbd = _vbd
 	} else {
-		return fmt.Errorf("%q should be specified!", vbdSchemaUUID)
+		return fmt.Errorf("UUID should be specified!")
 	}
 
 	this.VBDRef = vbd
 
 	return this.Query(c)
-}*/
+}
 
 func (this *VBDDescriptor) Query(c *Connection) error {
 
@@ -481,6 +829,10 @@ func (this *VBDDescriptor) Query(c *Connection) error {
 	this.Bootable = vbd.Bootable
 	this.Mode = vbd.Mode
 	this.OtherConfig = vbd.OtherConfig
+	this.QoSAlgorithmType = vbd.QosAlgorithmType
+	this.QoSAlgorithmParams = vbd.QosAlgorithmParams
+	this.CurrentlyAttached = vbd.CurrentlyAttached
+	this.Unpluggable = vbd.Unpluggable
 
 	isTemplateDevice := false
 
@@ -506,6 +858,12 @@ func (this *VBDDescriptor) Query(c *Connection) error {
 
 	this.VM = vm
 
+	// Empty CD drives have no VDI
+	if vbd.Empty {
+		this.VDI = nil
+		return nil
+	}
+
 	vdi := &VDIDescriptor{
 		VDIRef: vbd.VDI,
 	}
@@ -565,6 +923,17 @@ func (this *PIFDescriptor) Query(c *Connection) error {
 	}
 
 	this.UUID = pif.UUID
+	this.Network = pif.Network
+	this.MAC = pif.MAC
+	this.Device = pif.Device
+	this.Management = pif.Management
+	this.IPMode = pif.IPConfigurationMode
+	this.IP = pif.IP
+	this.Netmask = pif.Netmask
+	this.Gateway = pif.Gateway
+	this.DNS = pif.DNS
+	this.DisallowUnplug = pif.DisallowUnplug
+	this.OtherConfig = pif.OtherConfig
 
 	return nil
 }
@@ -623,3 +992,62 @@ func (this *VLANDescriptor) Query(c *Connection) error {
 
 	return nil
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *BondDescriptor) Load(c *Connection) error {
+	if this.UUID == "" {
+		return fmt.Errorf("UUID should be specified!")
+	}
+
+	bond, err := c.client.Bond.GetByUUID(c.session, this.UUID)
+	if err != nil {
+		return err
+	}
+
+	this.BondRef = bond
+
+	return this.Query(c)
+}
+
+func (this *BondDescriptor) Query(c *Connection) error {
+	bond, err := c.client.Bond.GetRecord(c.session, this.BondRef)
+	if err != nil {
+		return err
+	}
+
+	this.UUID = bond.UUID
+	this.Mode = bond.Mode
+	this.Properties = bond.Properties
+
+	master := PIFDescriptor{
+		PIFRef: bond.Master,
+	}
+	if err = master.Query(c); err != nil {
+		return err
+	}
+	this.Master = master
+
+	this.Slaves = make([]PIFDescriptor, 0, len(bond.Slaves))
+	for _, ref := range bond.Slaves {
+		slave := PIFDescriptor{
+			PIFRef: ref,
+		}
+		if err = slave.Query(c); err != nil {
+			return err
+		}
+		this.Slaves = append(this.Slaves, slave)
+		if ref == bond.PrimarySlave {
+			this.PrimarySlave = slave.UUID
+		}
+	}
+
+	return nil
+}
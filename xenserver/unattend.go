@@ -0,0 +1,60 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	unattendSchemaSRUUID      = "sr_uuid"
+	unattendSchemaUnattendXML = "unattend_xml"
+
+	unattendVolumeLabel = "unattend"
+)
+
+// Returns the schema for the windows_unattend block of the VM resource
+func resourceWindowsUnattend() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			unattendSchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			unattendSchemaUnattendXML: &schema.Schema{
+				Type:      schema.TypeString,
+				Required:  true,
+				ForceNew:  true,
+				Sensitive: true,
+			},
+		},
+	}
+}
+
+// Attaches the answer file as CD. Windows Setup, including the specialize and oobe passes
+// of a sysprepped template, looks for it in the root of removable read-only media.
+func createUnattendDrive(c *Connection, vm *VMDescriptor, s map[string]interface{}) error {
+	files := map[string][]byte{
+		"autounattend.xml": []byte(s[unattendSchemaUnattendXML].(string)),
+		"unattend.xml":     []byte(s[unattendSchemaUnattendXML].(string)),
+	}
+
+	return createISODrive(c, vm, s[unattendSchemaSRUUID].(string), unattendVolumeLabel, files)
+}
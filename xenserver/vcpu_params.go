@@ -0,0 +1,187 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+const (
+	vcpuParamsSchemaMask   = "mask"
+	vcpuParamsSchemaCap    = "cap"
+	vcpuParamsSchemaWeight = "weight"
+)
+
+// Returns the schema for the vcpu_params block of the VM resource
+func resourceVCPUParams() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			vcpuParamsSchemaMask: &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeInt,
+					ValidateFunc: validation.IntAtLeast(0),
+				},
+			},
+			vcpuParamsSchemaCap: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			vcpuParamsSchemaWeight: &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntBetween(0, 65535),
+			},
+		},
+	}
+}
+
+// Converts the vcpu_params block into VCPUs_params keys, unset attributes map to empty values
+func readVCPUParamsFromSchema(s []interface{}) map[string]string {
+	params := map[string]string{
+		vcpuParamsSchemaMask:   "",
+		vcpuParamsSchemaCap:    "",
+		vcpuParamsSchemaWeight: "",
+	}
+
+	if len(s) == 0 || s[0] == nil {
+		return params
+	}
+
+	data := s[0].(map[string]interface{})
+
+	mask := data[vcpuParamsSchemaMask].([]interface{})
+	cpus := make([]string, 0, len(mask))
+	for _, cpu := range mask {
+		cpus = append(cpus, strconv.Itoa(cpu.(int)))
+	}
+	params[vcpuParamsSchemaMask] = strings.Join(cpus, ",")
+
+	// Zero is the scheduler default for both, so it is not written
+	if vcpuCap := data[vcpuParamsSchemaCap].(int); vcpuCap != 0 {
+		params[vcpuParamsSchemaCap] = strconv.Itoa(vcpuCap)
+	}
+	if weight := data[vcpuParamsSchemaWeight].(int); weight != 0 {
+		params[vcpuParamsSchemaWeight] = strconv.Itoa(weight)
+	}
+
+	return params
+}
+
+// Returns the VCPUs_params keys to write for a change of the vcpu_params block. Keys which
+// were neither configured before nor now are left to the template and other tools.
+func readVCPUParamsChange(o, n []interface{}) map[string]string {
+	old := readVCPUParamsFromSchema(o)
+	params := readVCPUParamsFromSchema(n)
+
+	for key, value := range params {
+		if value == "" && old[key] == "" {
+			delete(params, key)
+		}
+	}
+
+	return params
+}
+
+// Returns only the VCPUs_params keys managed by the vcpu_params block
+func filterVCPUParams(params map[string]string, s []interface{}) map[string]string {
+	managed := make(map[string]interface{})
+	for key, value := range readVCPUParamsFromSchema(s) {
+		if value != "" {
+			managed[key] = value
+		}
+	}
+
+	return filterManagedMap(params, managed)
+}
+
+// Converts the VM's VCPUs_params into the vcpu_params block
+func fillVCPUParamsSchema(params map[string]string) ([]interface{}, error) {
+	data := make(map[string]interface{})
+
+	if mask := params[vcpuParamsSchemaMask]; mask != "" {
+		cpus := make([]interface{}, 0)
+		for _, cpu := range strings.Split(mask, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(cpu))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse VCPU mask %q - %s", mask, err)
+			}
+			cpus = append(cpus, n)
+		}
+		data[vcpuParamsSchemaMask] = cpus
+	}
+
+	for _, key := range []string{vcpuParamsSchemaCap, vcpuParamsSchemaWeight} {
+		if value := params[key]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse VCPU %s %q - %s", key, value, err)
+			}
+			data[key] = n
+		}
+	}
+
+	if len(data) == 0 {
+		return []interface{}{}, nil
+	}
+
+	return []interface{}{data}, nil
+}
+
+// Writes the VCPU parameters to the VM, applying them to the running domain as well
+func updateVMVCPUParams(c *Connection, vm *VMDescriptor, params map[string]string) error {
+	for key, value := range params {
+		if value == "" {
+			delete(vm.VCPUParams, key)
+		} else {
+			vm.VCPUParams[key] = value
+		}
+	}
+
+	if err := c.client.VM.SetVCPUsParams(c.session, vm.VMRef, vm.VCPUParams); err != nil {
+		return err
+	}
+
+	if vm.PowerState != xenAPI.VMPowerStateRunning {
+		return nil
+	}
+
+	// Removed parameters can not be reset live, they take effect on the next start
+	for key, value := range params {
+		if value == "" {
+			continue
+		}
+
+		log.Printf("[DEBUG] Setting VCPU parameter %s=%s on running VM %s", key, value, vm.UUID)
+		if err := c.client.VM.AddToVCPUsParamsLive(c.session, vm.VMRef, key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
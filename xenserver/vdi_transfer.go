@@ -0,0 +1,114 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fiveai/go-xen-api-client"
+)
+
+const (
+	vdiFormatRaw = "raw"
+	vdiFormatVHD = "vhd"
+)
+
+// Builds a request to the XAPI HTTP handler. The session is passed as cookie rather than in
+// the URL, which ends up in the messages of transport errors.
+func (c *Connection) newHandlerRequest(method, handler string, params url.Values, body io.Reader) (*http.Request, error) {
+	handlerURL := fmt.Sprintf("%s/%s?%s", strings.TrimRight(c.url, "/"), handler, params.Encode())
+
+	req, err := http.NewRequest(method, handlerURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: string(c.session)})
+
+	return req, nil
+}
+
+// Streams content of the reader into the VDI using the import_raw_vdi handler
+func importRawVDI(c *Connection, vdi xenAPI.VDIRef, format string, r io.Reader, size int64) error {
+	params := url.Values{}
+	params.Set("vdi", string(vdi))
+	params.Set("format", format)
+
+	req, err := c.newHandlerRequest(http.MethodPut, "import_raw_vdi", params, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	log.Printf("[DEBUG] Uploading %d bytes of %s data to VDI %s", size, format, vdi)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to import data to VDI %s: %s", vdi, resp.Status)
+	}
+
+	return nil
+}
+
+// Populates the VDI with a raw or VHD image read from a local file or HTTP(S) URL
+func importVDISource(c *Connection, vdi xenAPI.VDIRef, format string, source string) error {
+	r, size, err := openTransferSource(source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return importRawVDI(c, vdi, format, r, size)
+}
+
+// Streams the VDI (or snapshot) as raw or VHD image from the export_raw_vdi handler to a local path
+// or HTTP(S) URL and returns the number of bytes transferred
+func exportRawVDI(c *Connection, vdi *VDIDescriptor, format string, destination string) (int64, error) {
+	params := url.Values{}
+	params.Set("vdi", string(vdi.VDIRef))
+	params.Set("format", format)
+
+	req, err := c.newHandlerRequest(http.MethodGet, "export_raw_vdi", params, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to export VDI %s: %s", vdi.UUID, resp.Status)
+	}
+
+	log.Printf("[DEBUG] Exporting VDI %s as %s to %s", vdi.UUID, format, destination)
+
+	return writeTransferDestination(resp.Body, resp.ContentLength, destination)
+}
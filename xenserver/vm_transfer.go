@@ -0,0 +1,262 @@
+/*
+ * The MIT License (MIT)
+ * Copyright (c) 2016 Maksym Borodin <borodin.maksym@gmail.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+ * documentation files (the "Software"), to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+ * and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all copies or substantial portions
+ * of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO
+ * THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF
+ * CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+package xenserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiveai/go-xen-api-client"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	xvaImportSchemaSource = "source"
+	xvaImportSchemaSRUUID = "sr_uuid"
+)
+
+var opaqueRefRegexp = regexp.MustCompile(`OpaqueRef:[0-9a-fA-F-]+`)
+
+// Returns the schema for the import_xva block of the VM resource
+func resourceXVAImport() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			xvaImportSchemaSource: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			xvaImportSchemaSRUUID: &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+		},
+	}
+}
+
+// Opens an image source, which is either a local path or a HTTP(S) URL, and returns its content length
+func openTransferSource(source string) (io.ReadCloser, int64, error) {
+	if isRemoteLocation(source) {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("failed to download %s: %s", source, resp.Status)
+		}
+
+		return resp.Body, resp.ContentLength, nil
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+// Streams the XVA into the SR using the import handler and returns the imported VM
+func importXVA(c *Connection, source string, sr *SRDescriptor, timeout time.Duration) (xenAPI.VMRef, error) {
+	r, size, err := openTransferSource(source)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	task, err := c.client.Task.Create(c.session, "Import XVA", source)
+	if err != nil {
+		return "", err
+	}
+	defer c.client.Task.Destroy(c.session, task)
+
+	params := url.Values{}
+	params.Set("sr_id", string(sr.SRRef))
+	params.Set("task_id", string(task))
+
+	req, err := c.newHandlerRequest(http.MethodPut, "import", params, r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+
+	log.Printf("[DEBUG] Importing XVA %s (%d bytes) to SR %s", source, size, sr.UUID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to import XVA %s: %s", source, resp.Status)
+	}
+
+	result, err := waitForTask(c, task, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	// Result is XML-RPC encoded array of the imported VMs
+	ref := opaqueRefRegexp.FindString(result)
+	if ref == "" {
+		return "", fmt.Errorf("import of XVA %s did not return a VM", source)
+	}
+
+	return xenAPI.VMRef(ref), nil
+}
+
+// Waits for the task to finish and returns its result
+func waitForTask(c *Connection, task xenAPI.TaskRef, timeout time.Duration) (string, error) {
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{string(xenAPI.TaskStatusTypePending)},
+		Target:  []string{string(xenAPI.TaskStatusTypeSuccess)},
+		Refresh: func() (interface{}, string, error) {
+			record, err := c.client.Task.GetRecord(c.session, task)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if record.Status == xenAPI.TaskStatusTypeFailure || record.Status == xenAPI.TaskStatusTypeCancelled {
+				return nil, "", fmt.Errorf("task %s: %s", record.Status, strings.Join(record.ErrorInfo, ", "))
+			}
+
+			return record, string(record.Status), nil
+		},
+		Timeout:    timeout,
+		MinTimeout: 2 * time.Second,
+	}
+
+	record, err := stateConf.WaitForState()
+	if err != nil {
+		return "", err
+	}
+
+	return record.(xenAPI.TaskRecord).Result, nil
+}
+
+// Returns true if the location is a HTTP(S) URL rather than a local path
+func isRemoteLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Streams the VM (or snapshot) as XVA from the export handler to a local path or HTTP(S) URL
+// and returns the number of bytes transferred
+func exportXVA(c *Connection, vm *VMDescriptor, destination string, compress bool) (int64, error) {
+	params := url.Values{}
+	params.Set("uuid", vm.UUID)
+	params.Set("use_compression", strconv.FormatBool(compress))
+
+	req, err := c.newHandlerRequest(http.MethodGet, "export", params, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to export VM %s: %s", vm.UUID, resp.Status)
+	}
+
+	log.Printf("[DEBUG] Exporting VM %s to %s", vm.UUID, destination)
+
+	return writeTransferDestination(resp.Body, resp.ContentLength, destination)
+}
+
+// Writes the content of the reader to a local path or uploads it to a HTTP(S) URL
+// and returns the number of bytes transferred
+func writeTransferDestination(r io.Reader, size int64, destination string) (int64, error) {
+	if isRemoteLocation(destination) {
+		counter := &countingReader{r: r}
+
+		req, err := http.NewRequest(http.MethodPut, destination, counter)
+		if err != nil {
+			return 0, err
+		}
+		req.ContentLength = size
+
+		upload, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		upload.Body.Close()
+
+		if upload.StatusCode < 200 || upload.StatusCode > 299 {
+			return 0, fmt.Errorf("failed to upload to %s: %s", destination, upload.Status)
+		}
+
+		return counter.n, nil
+	}
+
+	// Write to a temporary file first, so that a failed export does not leave a truncated image behind
+	f, err := ioutil.TempFile(filepath.Dir(destination), filepath.Base(destination)+".")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), destination)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Reader counting the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}